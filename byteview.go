@@ -24,6 +24,11 @@ import (
 	"time"
 )
 
+var (
+	_ io.ReaderAt = ByteView{}
+	_ io.WriterTo = ByteView{}
+)
+
 // A ByteView holds an immutable view of bytes.
 // Internally it wraps either a []byte or a string,
 // but that detail is invisible to callers.
@@ -35,6 +40,12 @@ type ByteView struct {
 	b []byte
 	s string
 	e time.Time
+
+	version string
+
+	// etag is the hash of the value, as sent by the peer it was loaded
+	// from or computed when it was cached, if any.
+	etag string
 }
 
 // Returns the expire time associated with this view
@@ -42,6 +53,12 @@ func (v ByteView) Expire() time.Time {
 	return v.e
 }
 
+// Version returns the version the Getter gave to the value with
+// SetVersion, or "" if it gave none.
+func (v ByteView) Version() string {
+	return v.version
+}
+
 // Len returns the view's length.
 func (v ByteView) Len() int {
 	if v.b != nil {
@@ -55,6 +55,34 @@ func TestByteView(t *testing.T) {
 	}
 }
 
+func TestByteViewWriteToLeavesViewUnchanged(t *testing.T) {
+	const s = "some large cached payload"
+	for _, v := range []ByteView{of([]byte(s)), of(s)} {
+		var dest bytes.Buffer
+		n, err := v.WriteTo(&dest)
+		if err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		if n != int64(len(s)) || dest.String() != s {
+			t.Errorf("WriteTo wrote %d bytes %q; want %d bytes %q", n, dest.String(), len(s), s)
+		}
+
+		// Mutating what was written must not affect the view.
+		dest.Bytes()[0] = 'X'
+		if got := v.String(); got != s {
+			t.Errorf("view changed after write to %q; want %q", got, s)
+		}
+		got, err := io.ReadAll(v.Reader())
+		if err != nil || string(got) != s {
+			t.Errorf("Reader = %q, %v; want %q", got, err, s)
+		}
+		got[0] = 'X'
+		if v.String() != s {
+			t.Errorf("view changed after mutating Reader output to %q; want %q", v.String(), s)
+		}
+	}
+}
+
 // of returns a byte view of the []byte or string in x.
 func of(x interface{}) ByteView {
 	if bytes, ok := x.([]byte); ok {
@@ -19,66 +19,1021 @@ package consistenthash
 
 import (
 	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
+	"sync"
+	"unsafe"
 
 	"github.com/segmentio/fasthash/fnv1"
 )
 
+// Hash maps data to a position on the ring. The full 64 bits of the
+// result are used, which spreads the replicas of many members more
+// evenly than a 32-bit hash would; see Hash32 to use a 32-bit hash
+// function instead.
 type Hash func(data []byte) uint64
 
+// Mix returns a Hash that applies a finalizer to the result of fn so that
+// every bit of the input affects the high bits of the hash. This improves
+// the distribution of hash functions, like FNV, whose high bits vary
+// little between keys that only differ in their last bytes.
+func Mix(fn Hash) Hash {
+	return func(data []byte) uint64 {
+		return fmix64(fn(data))
+	}
+}
+
+// fmix64 is the finalizer of MurmurHash3, a bijection whose every output
+// bit depends on every input bit.
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Hash32 adapts a 32-bit hash function, such as crc32.ChecksumIEEE,
+// to a Hash.
+func Hash32(fn func(data []byte) uint32) Hash {
+	return func(data []byte) uint64 {
+		return uint64(fn(data))
+	}
+}
+
+// StableHash is the 64-bit FNV-1a hash of data. Unlike the default hash
+// of New, which may change between releases, it is guaranteed to keep
+// mapping the same data to the same value, so that tests may assert
+// which member owns a key, e.g. with Ownership.
+func StableHash(data []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 is the 64-bit xxHash of data with a zero seed. It spreads
+// keys over the ring better than the default FNV-1 hash, but maps them
+// to different members, so every peer must switch to it at once.
+func XXHash64(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// KetamaPoints is the number of points each member has on a ketama ring
+// whose members all have the same weight.
+const KetamaPoints = 160
+
+// KetamaHash is the hash ketama maps keys to its ring with: the first
+// four bytes of the MD5 digest of data, read as a little-endian integer.
+func KetamaHash(data []byte) uint64 {
+	digest := md5.Sum(data)
+	return uint64(binary.LittleEndian.Uint32(digest[:4]))
+}
+
+// LoadReporter returns the current load of a member of the hash, e.g.
+// its number of requests in flight. It is called for every member on
+// each lookup, so it should be cheap and must not allocate.
+type LoadReporter func(member string) int64
+
+// A Map is safe for concurrent use: lookups share a read lock, so they
+// only wait for changes to the members.
 type Map struct {
+	mu sync.RWMutex // guards the fields below but hash
+
 	hash     Hash
+	hashKeys bool   // whether hash is known not to modify nor retain data
+	seed     uint64 // mixed into the hashes unless zero
 	replicas int
-	keys     []int // Sorted
-	hashMap  map[int]string
+	keys     []uint64          // Sorted
+	owners   []string          // owner of each of the sorted keys
+	hashMap  map[uint64]string // owner of each point, to find those taken
+	members  map[string]bool
+
+	// replicaKey, if non-nil, makes the data hashed into the points of
+	// the replicas, set with SetReplicaKeyFunc.
+	replicaKey ReplicaKeyFunc
+
+	// collisions counts the replicas moved because their point was taken.
+	collisions int
+
+	// weights holds the number of replicas each member was added with.
+	weights map[string]int
+
+	// probes holds, for each member with replicas whose point was taken,
+	// the alternate point each such replica was moved to, from 1, or -1
+	// if it was dropped. Ketama maps do not keep it.
+	probes map[string]map[int]int
+
+	// ketama is set by NewKetama, when the points of the members are
+	// derived from the names returned by ketamaName and from their
+	// weights.
+	ketama     bool
+	ketamaName func(member string) string
+
+	loadReporter LoadReporter
+	loadFactor   float64
 }
 
 func New(replicas int, fn Hash) *Map {
 	m := &Map{
 		replicas: replicas,
 		hash:     fn,
-		hashMap:  make(map[int]string),
+		hashMap:  make(map[uint64]string),
+		members:  make(map[string]bool),
+		weights:  make(map[string]int),
 	}
 	if m.hash == nil {
 		m.hash = fnv1.HashBytes64
 	}
+	m.hashKeys = isBuiltinHash(m.hash)
 	return m
 }
 
+// builtinHashes are the hashes known not to modify nor retain their data,
+// which are given the memory of keys rather than a copy.
+var builtinHashes = []Hash{fnv1.HashBytes64, XXHash64, KetamaHash, StableHash}
+
+// isBuiltinHash returns whether fn is one of builtinHashes.
+func isBuiltinHash(fn Hash) bool {
+	p := reflect.ValueOf(fn).Pointer()
+	for _, b := range builtinHashes {
+		if reflect.ValueOf(b).Pointer() == p {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSeeded is like New, but mixes seed into the hashes of the replicas
+// and keys, so that members of the same names own other keys than with
+// another seed, e.g. to keep clusters sharing peer names from sharing
+// their placement. Every seed gives a different placement, but the zero
+// seed gives that of New. A string may be turned into a seed with
+// StableHash.
+func NewSeeded(replicas int, fn Hash, seed uint64) *Map {
+	m := New(replicas, fn)
+	m.seed = seed
+	return m
+}
+
+// NewKetama returns an empty hash that places keys like libketama, the
+// consistent hash of many memcached clients, so that both agree on the
+// owner of each key given members of the same names and weights. Each
+// member has KetamaPoints points times its share of the total weight,
+// which AddWithWeight sets; Add gives members a weight of 1. The points
+// of a member are derived from the server name ketama knows it by, which
+// is "host:port" (e.g. "10.0.0.1:11211"); name maps members to that name,
+// or if nil, members are named after their server name. The replicas of
+// the members depend on the total weight, so they all move when a member
+// with another weight than the others is added or removed.
+func NewKetama(name func(member string) string) *Map {
+	m := New(KetamaPoints, KetamaHash)
+	m.ketama = true
+	m.ketamaName = name
+	return m
+}
+
+// ReplicaKeyFunc returns the data hashed into the point of a replica of
+// member, numbered from 0, e.g. to place members like another consistent
+// hash does. When that point is taken by another replica, the next
+// points tried are those of the same replica of member+"#1", "#2", ...
+type ReplicaKeyFunc func(member string, replica int) []byte
+
+// DefaultReplicaKey is the ReplicaKeyFunc of a hash without one: the hex
+// MD5 digest of the replica number followed by the member.
+func DefaultReplicaKey(member string, replica int) []byte {
+	sum := md5.Sum([]byte(strconv.Itoa(replica) + member))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// SetReplicaKeyFunc sets the function making the data hashed into the
+// points of the replicas. It must be called before adding members.
+func (m *Map) SetReplicaKeyFunc(fn ReplicaKeyFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replicaKey = fn
+}
+
 // Returns true if there are no items available.
 func (m *Map) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.keys) == 0
 }
 
 // Adds some keys to the hash.
 func (m *Map) Add(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		m.addReplicas(key, m.replicas)
+	}
+	m.sortKeys()
+}
+
+// AddWithWeight adds key to the hash with weight times the replicas of
+// the other keys, so that it owns about weight times as many keys. The
+// replicas of a key are the same for any weight, plus more for a higher
+// one, so that changing the weight of a key only moves the keys it gains
+// or loses.
+func (m *Map) AddWithWeight(key string, weight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addReplicas(key, m.replicas*weight)
+	m.sortKeys()
+}
+
+// AddWithReplicas adds key to the hash with the given number of
+// replicas instead of the default one, e.g. fewer for a standby member
+// that should only own a few keys.
+func (m *Map) AddWithReplicas(key string, replicas int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addReplicas(key, replicas)
+	m.sortKeys()
+}
+
+// AddWeighted adds each key of weights with its weight, like
+// AddWithWeight. The keys are added in sorted order, so that replicas
+// that collide land in the same place every time.
+func (m *Map) AddWeighted(weights map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(weights))
+	for key := range weights {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	for _, key := range keys {
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hash([]byte(fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i)+key))))))
-			m.keys = append(m.keys, hash)
-			m.hashMap[hash] = key
+		m.addReplicas(key, m.replicas*weights[key])
+	}
+	m.sortKeys()
+}
+
+// Remove removes keys and their replicas from the hash. The other keys
+// keep their replicas, so only the keys owned by the removed ones move.
+// Keys that are not in the hash are ignored.
+func (m *Map) Remove(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(keys...)
+}
+
+// remove implements Remove; m.mu must be held.
+func (m *Map) remove(keys ...string) {
+	removed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if m.members[key] {
+			removed[key] = true
+			delete(m.members, key)
+			delete(m.weights, key)
+			delete(m.probes, key)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if m.ketama {
+		m.sortKeys()
+		return
+	}
+	// Compact the keys and their owners in place, which keeps them
+	// sorted, along with the unsorted keys of an Add in progress.
+	kept, sorted := 0, 0
+	for i, hash := range m.keys {
+		var owner string
+		if i < len(m.owners) {
+			owner = m.owners[i]
+		} else {
+			owner = m.hashMap[hash]
+		}
+		if removed[owner] {
+			delete(m.hashMap, hash)
+			continue
+		}
+		m.keys[kept] = hash
+		if i < len(m.owners) {
+			m.owners[kept] = owner
+			sorted++
+		}
+		kept++
+	}
+	m.keys = m.keys[:kept]
+	m.owners = m.owners[:sorted]
+}
+
+// maxProbes bounds the points tried for a replica whose point is taken.
+const maxProbes = 16
+
+// addReplicas adds the replicas of key, replacing those it had. A replica
+// whose point is already taken is moved to the next free one of a few
+// alternate points, or dropped if they are all taken, rather than
+// stealing the point from its owner. m.mu must be held.
+func (m *Map) addReplicas(key string, replicas int) {
+	if m.ketama {
+		// The points are made by sortKeys, once all weights are known.
+		m.members[key] = true
+		m.weights[key] = replicas
+		return
+	}
+	if m.members[key] {
+		m.remove(key)
+	}
+	var buf pointBuffers
+	for i := 0; i < replicas; i++ {
+		placed := -1
+		for probe := 0; probe < maxProbes; probe++ {
+			if probe > 0 {
+				m.collisions++
+			}
+			hash := m.replicaPoint(key, i, probe, &buf)
+			if _, taken := m.hashMap[hash]; !taken {
+				m.keys = append(m.keys, hash)
+				m.hashMap[hash] = key
+				placed = probe
+				break
+			}
+		}
+		if placed != 0 {
+			m.setProbe(key, i, placed)
+		}
+	}
+	m.members[key] = true
+	m.weights[key] = replicas
+}
+
+// setProbe records that replica i of member was moved to the alternate
+// point probe, or dropped if probe is -1. m.mu must be held.
+func (m *Map) setProbe(member string, i, probe int) {
+	if m.probes == nil {
+		m.probes = make(map[string]map[int]int)
+	}
+	if m.probes[member] == nil {
+		m.probes[member] = make(map[int]int)
+	}
+	m.probes[member][i] = probe
+}
+
+// pointBuffers are the buffers replicaPoint builds the data of points
+// in, reused for all the replicas of a member.
+type pointBuffers struct {
+	vnode, digest []byte
+}
+
+// replicaPoint returns the point of replica i of key, or with a positive
+// probe its alternate point of that number. By default, it is the hash
+// of the hex MD5 digest of its vnode name, like DefaultReplicaKey makes
+// it. m.mu must be held.
+func (m *Map) replicaPoint(key string, i, probe int, buf *pointBuffers) uint64 {
+	if m.replicaKey != nil {
+		member := key
+		if probe > 0 {
+			member = key + "#" + strconv.Itoa(probe)
 		}
+		return m.hashOf(m.replicaKey(member, i))
+	}
+	if buf.digest == nil {
+		buf.digest = make([]byte, 2*md5.Size)
 	}
-	sort.Ints(m.keys)
+	buf.vnode = strconv.AppendInt(buf.vnode[:0], int64(i), 10)
+	buf.vnode = append(buf.vnode, key...)
+	if probe > 0 {
+		buf.vnode = append(buf.vnode, '#')
+		buf.vnode = strconv.AppendInt(buf.vnode, int64(probe), 10)
+	}
+	sum := md5.Sum(buf.vnode)
+	hex.Encode(buf.digest, sum[:])
+	return m.hashOf(buf.digest)
+}
+
+// addKetamaPoints replaces the points of the members with those libketama
+// gives them for their weights. m.mu must be held.
+func (m *Map) addKetamaPoints() {
+	m.keys = m.keys[:0]
+	m.hashMap = make(map[uint64]string, len(m.members)*KetamaPoints)
+	m.collisions = 0
+
+	members := make([]string, 0, len(m.members))
+	total := 0
+	for member := range m.members {
+		members = append(members, member)
+		total += m.weights[member]
+	}
+	// The first member in order keeps a point two members share.
+	sort.Strings(members)
+	for _, member := range members {
+		name := member
+		if m.ketamaName != nil {
+			name = m.ketamaName(member)
+		}
+		// libketama computes the number of digests in single precision,
+		// whose rounding decides the count of some weights.
+		share := float32(m.weights[member]) / float32(total)
+		digests := int(math.Floor(float64(float32(float64(share) * 40 * float64(float32(len(members)))))))
+		for i := 0; i < digests; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for h := 0; h < 4; h++ {
+				hash := uint64(binary.LittleEndian.Uint32(digest[h*4:]))
+				if _, taken := m.hashMap[hash]; taken {
+					m.collisions++
+					continue
+				}
+				m.keys = append(m.keys, hash)
+				m.hashMap[hash] = member
+			}
+		}
+	}
+}
+
+// Collisions returns how many times a replica was moved because its
+// point on the ring was taken by another replica. A high count means
+// the hash function has too few bits for the number of replicas.
+func (m *Map) Collisions() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.collisions
+}
+
+// sortKeys sorts the keys added since the last call into the ring. The
+// keys past the owners are those added, which are sorted on their own
+// and merged with the others, so that adding a few members to a large
+// ring does not sort it all again. m.mu must be held.
+func (m *Map) sortKeys() {
+	if m.ketama {
+		m.addKetamaPoints()
+		slices.Sort(m.keys)
+		m.setOwners()
+		return
+	}
+	n := len(m.owners)
+	if n == len(m.keys) {
+		return
+	}
+	added := slices.Clone(m.keys[n:])
+	slices.Sort(added)
+	// Merge from the end, where the added keys left room.
+	m.owners = slices.Grow(m.owners, len(added))[:len(m.keys)]
+	i, j := n-1, len(added)-1
+	for k := len(m.keys) - 1; j >= 0; k-- {
+		if i >= 0 && m.keys[i] > added[j] {
+			m.keys[k] = m.keys[i]
+			m.owners[k] = m.owners[i]
+			i--
+		} else {
+			m.keys[k] = added[j]
+			m.owners[k] = m.hashMap[added[j]]
+			j--
+		}
+	}
+}
+
+// setOwners sets the owners of the keys from hashMap, so that lookups
+// need not hash them again. m.mu must be held.
+func (m *Map) setOwners() {
+	m.owners = m.owners[:0]
+	for _, hash := range m.keys {
+		m.owners = append(m.owners, m.hashMap[hash])
+	}
+}
+
+// SetLoadReporter enables bounded loads: Get then skips the members whose
+// load, as returned by fn, would exceed loadFactor times the average load.
+// loadFactor must be greater than 1. A nil fn disables bounded loads.
+func (m *Map) SetLoadReporter(fn LoadReporter, loadFactor float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loadReporter = fn
+	m.loadFactor = loadFactor
 }
 
 // Gets the closest item in the hash to the provided key.
 func (m *Map) Get(key string) string {
-	if m.IsEmpty() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.get(key)
+}
+
+// get implements Get; m.mu must be held.
+func (m *Map) get(key string) string {
+	if m.loadReporter != nil && len(m.keys) != 0 {
+		return m.getBounded(m.search(key), m.loadReporter, m.loadFactor)
+	}
+	return m.owner(key)
+}
+
+// GetHashed is like Get, but takes the hash of the key by the Hash of the
+// map instead of the key, for callers that already computed it. It
+// returns the item Get returns for a key with this hash.
+func (m *Map) GetHashed(hash uint64) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.getHashed(hash)
+}
+
+// getHashed implements GetHashed; m.mu must be held.
+func (m *Map) getHashed(hash uint64) string {
+	if len(m.keys) == 0 {
 		return ""
 	}
+	idx := m.searchHash(m.mixSeed(hash))
+	if m.loadReporter != nil {
+		return m.getBounded(idx, m.loadReporter, m.loadFactor)
+	}
+	return m.owners[idx]
+}
+
+// GetBounded gets the closest item in the hash to the provided key whose
+// load, once given one more unit, does not exceed loadFactor times the
+// average load of all items. Items missing from loads have no load.
+func (m *Map) GetBounded(key string, loads map[string]int64, loadFactor float64) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return ""
+	}
+	return m.getBounded(m.search(key), func(member string) int64 { return loads[member] }, loadFactor)
+}
+
+// getBounded implements GetBounded for the key whose first replica is at
+// idx in keys, with the loads reported by load; m.mu must be held.
+func (m *Map) getBounded(idx int, load LoadReporter, loadFactor float64) string {
+
+	var total int64
+	for member := range m.members {
+		total += load(member)
+	}
+	bound := int64(math.Ceil(loadFactor * float64(total+1) / float64(len(m.members))))
+
+	for i := 0; i < len(m.keys); i++ {
+		member := m.owners[(idx+i)%len(m.owners)]
+		if load(member)+1 <= bound {
+			return member
+		}
+	}
+
+	// Every item is over the bound, which only happens with a
+	// loadFactor below 1.
+	return m.owners[idx]
+}
+
+// GetN gets up to n distinct items of the hash for the provided key, in
+// the order their replicas follow the key on the ring, so that the first
+// one is the item Get returns without bounded loads.
+func (m *Map) GetN(key string, n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.getN(key, n)
+}
+
+// getN implements GetN; m.mu must be held.
+func (m *Map) getN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(m.members) {
+		n = len(m.members)
+	}
+	items := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	idx := m.search(key)
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		item := m.owners[(idx+i)%len(m.owners)]
+		if !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// A Frozen is a copy of a Map that never changes, so that its lookups
+// take no lock. Callers publishing a new one whenever their Map changes,
+// e.g. with an atomic.Pointer, look keys up without contending on it.
+type Frozen struct {
+	m *Map
+}
+
+// Freeze returns a copy of m as it is now, which the changes of m leave
+// alone.
+func (m *Map) Freeze() *Frozen {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make(map[string]bool, len(m.members))
+	for member := range m.members {
+		members[member] = true
+	}
+	return &Frozen{m: &Map{
+		hash:         m.hash,
+		hashKeys:     m.hashKeys,
+		seed:         m.seed,
+		replicas:     m.replicas,
+		keys:         slices.Clone(m.keys),
+		owners:       slices.Clone(m.owners),
+		members:      members,
+		loadReporter: m.loadReporter,
+		loadFactor:   m.loadFactor,
+	}}
+}
+
+// IsEmpty returns true if there are no items available.
+func (f *Frozen) IsEmpty() bool {
+	return len(f.m.keys) == 0
+}
+
+// Get is Map.Get on the frozen copy.
+func (f *Frozen) Get(key string) string {
+	return f.m.get(key)
+}
 
-	hash := int(m.hash([]byte(key)))
+// GetHashed is Map.GetHashed on the frozen copy.
+func (f *Frozen) GetHashed(hash uint64) string {
+	return f.m.getHashed(hash)
+}
+
+// GetN is Map.GetN on the frozen copy.
+func (f *Frozen) GetN(key string, n int) []string {
+	return f.m.getN(key, n)
+}
+
+// Contains returns whether member is a member of the hash.
+func (m *Map) Contains(member string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.members[member]
+}
+
+// Members returns the members of the hash, sorted.
+func (m *Map) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make([]string, 0, len(m.members))
+	for member := range m.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
 
+// ReplicaCount returns the number of replicas member has on the ring,
+// which is less than it was added with if some collided with the
+// replicas of members added later.
+func (m *Map) ReplicaCount(member string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.members[member] {
+		return 0
+	}
+	n := 0
+	for _, owner := range m.owners {
+		if owner == member {
+			n++
+		}
+	}
+	return n
+}
+
+// Snapshot is the configuration and the members of a Map, from which
+// Restore and UnmarshalJSON rebuild its ring, e.g. to reproduce in a test
+// the placement of keys of a running process. The hash function and the
+// ReplicaKeyFunc of the map are not part of it.
+type Snapshot struct {
+	Replicas int    `json:"replicas"`
+	Seed     uint64 `json:"seed,omitempty"`
+	Ketama   bool   `json:"ketama,omitempty"`
+
+	// Members holds the number of replicas each member was added with,
+	// e.g. Replicas times its weight.
+	Members map[string]int `json:"members"`
+
+	// Probes holds, for each member with replicas whose point was taken
+	// by another replica, the alternate point each of them was moved to,
+	// numbered from 1, or -1 if it was dropped. These depend on the order
+	// in which the members were added, which the ring does not otherwise
+	// tell.
+	Probes map[string]map[int]int `json:"probes,omitempty"`
+}
+
+// Snapshot returns the configuration and the members of m.
+func (m *Map) Snapshot() Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := Snapshot{
+		Replicas: m.replicas,
+		Seed:     m.seed,
+		Ketama:   m.ketama,
+		Members:  make(map[string]int, len(m.weights)),
+	}
+	for member, replicas := range m.weights {
+		s.Members[member] = replicas
+	}
+	for member, probes := range m.probes {
+		if s.Probes == nil {
+			s.Probes = make(map[string]map[int]int, len(m.probes))
+		}
+		s.Probes[member] = make(map[int]int, len(probes))
+		for i, probe := range probes {
+			s.Probes[member][i] = probe
+		}
+	}
+	return s
+}
+
+// MarshalJSON implements json.Marshaler, encoding the Snapshot of m.
+func (m *Map) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, restoring m from the
+// encoded Snapshot like Restore.
+func (m *Map) UnmarshalJSON(data []byte) error {
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return m.Restore(s)
+}
+
+// Restore replaces the configuration and the members of m with those of
+// s, placing every replica where it was when s was taken, so that Get
+// returns the same owners. m must have been made with the hash function,
+// the ReplicaKeyFunc and, for ketama, the constructor of the map s was
+// taken from; Restore fails if a replica finds its point taken, which
+// means they differ. m is left unchanged then.
+func (m *Map) Restore(s Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.Ketama != m.ketama {
+		return fmt.Errorf("consistenthash: snapshot of a map with Ketama %t restored into one with Ketama %t", s.Ketama, m.ketama)
+	}
+	r := &Map{
+		hash:       m.hash,
+		hashKeys:   m.hashKeys,
+		seed:       s.Seed,
+		replicas:   s.Replicas,
+		hashMap:    make(map[uint64]string),
+		members:    make(map[string]bool, len(s.Members)),
+		weights:    make(map[string]int, len(s.Members)),
+		replicaKey: m.replicaKey,
+		ketama:     m.ketama,
+		ketamaName: m.ketamaName,
+	}
+	members := make([]string, 0, len(s.Members))
+	for member := range s.Members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	var buf pointBuffers
+	for _, member := range members {
+		replicas := s.Members[member]
+		r.members[member] = true
+		r.weights[member] = replicas
+		if r.ketama {
+			// The points are made by sortKeys from the weights alone.
+			continue
+		}
+		for i := 0; i < replicas; i++ {
+			probe := s.Probes[member][i]
+			if probe != 0 {
+				r.setProbe(member, i, probe)
+			}
+			if probe < 0 {
+				r.collisions += maxProbes - 1
+				continue
+			}
+			r.collisions += probe
+			hash := r.replicaPoint(member, i, probe, &buf)
+			if owner, taken := r.hashMap[hash]; taken {
+				return fmt.Errorf("consistenthash: point of replica %d of %q in the snapshot is taken by %q: the map was made with another hash", i, member, owner)
+			}
+			r.keys = append(r.keys, hash)
+			r.hashMap[hash] = member
+		}
+	}
+	r.sortKeys()
+	m.seed, m.replicas = r.seed, r.replicas
+	m.keys, m.owners, m.hashMap = r.keys, r.owners, r.hashMap
+	m.members, m.weights, m.probes = r.members, r.weights, r.probes
+	m.collisions = r.collisions
+	return nil
+}
+
+// Distribution estimates the fraction of the key space each member owns
+// by looking up the owners of the samples keys of SampleKeys, like Churn.
+// Bounded loads are ignored. Members owning no sampled key are reported
+// with a zero fraction.
+func (m *Map) Distribution(samples int) map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make(map[string]float64, len(m.members))
+	for member := range m.members {
+		res[member] = 0
+	}
+	if samples <= 0 || len(m.keys) == 0 {
+		return res
+	}
+	for _, key := range SampleKeys(samples, 1) {
+		res[m.owner(key)]++
+	}
+	for member := range res {
+		res[member] /= float64(samples)
+	}
+	return res
+}
+
+// Churn estimates the fraction of the key space whose owner differs
+// between the old and new hashes, e.g. before and after peers changed,
+// by comparing the owners of the samples keys SampleKeys returns for the
+// seed 1, so the estimate is reproducible for the same hashes. Bounded loads
+// are ignored. A nil or empty hash owns no key, so the churn from or to
+// it is 1 unless both hashes are empty.
+func Churn(old, new *Map, samples int) float64 {
+	if samples <= 0 {
+		return 0
+	}
+	if old != nil {
+		old.mu.RLock()
+		defer old.mu.RUnlock()
+	}
+	if new != nil && new != old {
+		new.mu.RLock()
+		defer new.mu.RUnlock()
+	}
+	moved := 0
+	for _, key := range SampleKeys(samples, 1) {
+		if old.owner(key) != new.owner(key) {
+			moved++
+		}
+	}
+	return float64(moved) / float64(samples)
+}
+
+// SampleKeys returns n pseudo-random keys, the same for the same n and
+// seed in any process and release, e.g. to check how a change to the
+// members of a hash moves keys.
+func SampleKeys(n int, seed int64) []string {
+	rnd := rand.New(rand.NewSource(seed))
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.FormatUint(rnd.Uint64(), 36)
+	}
+	return keys
+}
+
+// A Move is a key whose owner differs between two hashes, as returned by
+// Moves. From or To is empty for a hash that owns no key.
+type Move struct {
+	Key, From, To string
+}
+
+// Moves returns the keys among keys whose owner differs between the old
+// and new hashes, in order, e.g. to check that removing a member only
+// moves its keys. Bounded loads are ignored.
+func Moves(old, new *Map, keys ...string) []Move {
+	if old != nil {
+		old.mu.RLock()
+		defer old.mu.RUnlock()
+	}
+	if new != nil && new != old {
+		new.mu.RLock()
+		defer new.mu.RUnlock()
+	}
+	var moves []Move
+	for _, key := range keys {
+		if from, to := old.owner(key), new.owner(key); from != to {
+			moves = append(moves, Move{Key: key, From: from, To: to})
+		}
+	}
+	return moves
+}
+
+// Ownership returns the member owning each of keys in a hash of members
+// with the given replicas and hash function, as New makes it.
+func Ownership(members []string, replicas int, fn Hash, keys ...string) map[string]string {
+	m := New(replicas, fn)
+	m.Add(members...)
+	owners := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owners[key] = m.owner(key)
+	}
+	return owners
+}
+
+// owner returns the member owning key, regardless of loads, or "" if m
+// is nil or empty. m.mu must be held.
+func (m *Map) owner(key string) string {
+	if m == nil || len(m.keys) == 0 {
+		return ""
+	}
+	return m.owners[m.search(key)]
+}
+
+// hashOf returns the hash of data mixed with the seed of m, if any. As
+// the mix is a bijection, it reorders the points without adding
+// collisions.
+func (m *Map) hashOf(data []byte) uint64 {
+	return m.mixSeed(m.hash(data))
+}
+
+// mixSeed returns h mixed with the seed of m, if any.
+func (m *Map) mixSeed(h uint64) uint64 {
+	if m.seed != 0 {
+		h = fmix64(h ^ m.seed)
+	}
+	return h
+}
+
+// search returns the index in keys of the first replica for key.
+func (m *Map) search(key string) int {
+	if !m.hashKeys {
+		// Other hashes might modify the memory of the key.
+		return m.searchHash(m.hashOf([]byte(key)))
+	}
+	return m.searchHash(m.hashOf(unsafe.Slice(unsafe.StringData(key), len(key))))
+}
+
+// searchHash returns the index in keys of the first replica for a key
+// with the given hash, mixed with the seed.
+func (m *Map) searchHash(hash uint64) int {
 	// Binary search for appropriate replica.
-	idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
+	idx, _ := slices.BinarySearch(m.keys, hash)
 
 	// Means we have cycled back to the first replica.
 	if idx == len(m.keys) {
 		idx = 0
 	}
-
-	return m.hashMap[m.keys[idx]]
+	return idx
 }
@@ -17,10 +17,19 @@ limitations under the License.
 package consistenthash
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/segmentio/fasthash/fnv1"
+	"hash/crc32"
+	"math"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -92,6 +101,7 @@ func TestDistribution(t *testing.T) {
 
 	hashFuncs := map[string]Hash{
 		"fasthash/fnv1": fnv1.HashBytes64,
+		"xxhash":        XXHash64,
 	}
 
 	for name, hashFunc := range hashFuncs {
@@ -116,6 +126,280 @@ func TestDistribution(t *testing.T) {
 	}
 }
 
+func TestHash64Distribution(t *testing.T) {
+	const (
+		replicas = 512
+		cases    = 100000
+	)
+	node := func(i int) string { return fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256) }
+	newMap := func(hashFn Hash, nodes int) *Map {
+		hosts := make([]string, nodes)
+		for i := range hosts {
+			hosts[i] = node(i)
+		}
+		hash := New(replicas, hashFn)
+		hash.Add(hosts...)
+		return hash
+	}
+	variation := func(hashFn Hash) float64 {
+		const nodes = 64
+		hash := newMap(hashFn, nodes)
+		counts := map[string]int{}
+		for i := 0; i < cases; i++ {
+			counts[hash.Get(fmt.Sprintf("key-%d", i))]++
+		}
+		mean := float64(cases) / nodes
+		var variance float64
+		for i := 0; i < nodes; i++ {
+			d := float64(counts[node(i)]) - mean
+			variance += d * d / nodes
+		}
+		return math.Sqrt(variance) / mean
+	}
+
+	hash32 := Hash32(crc32.ChecksumIEEE)
+	hash64 := Mix(fnv1.HashBytes64)
+
+	// Keys are spread as evenly with either hash.
+	cv32, cv64 := variation(hash32), variation(hash64)
+	t.Logf("coefficient of variation of keys per node: 32-bit %.4f, 64-bit %.4f", cv32, cv64)
+	if cv64 > 1.5*cv32 {
+		t.Errorf("64-bit hash distributes keys worse than 32-bit hash: %.4f > %.4f", cv64, cv32)
+	}
+
+	// With many nodes, the replicas of different nodes collide on a
+	// 32-bit ring, but not on a 64-bit one.
+	const nodes = 1000
+	collisions32 := newMap(hash32, nodes).Collisions()
+	collisions64 := newMap(hash64, nodes).Collisions()
+	t.Logf("replica collisions: 32-bit %d, 64-bit %d", collisions32, collisions64)
+	if collisions64 != 0 {
+		t.Errorf("64-bit hash has %d replica collisions; want 0", collisions64)
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	} {
+		if got := XXHash64([]byte(tt.in)); got != tt.want {
+			t.Errorf("XXHash64(%q) = %#x; want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBoundedLoads(t *testing.T) {
+	hosts := []string{"a.svc.local", "b.svc.local", "c.svc.local", "d.svc.local"}
+	const loadFactor = 1.25
+
+	hash := New(50, nil)
+	hash.Add(hosts...)
+	loads := map[string]int64{}
+	hash.SetLoadReporter(func(member string) int64 { return loads[member] }, loadFactor)
+
+	// Skewed keyspace: most requests are for a handful of hot keys.
+	var total int64
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("hot-%d", i%3)
+		if i%5 == 0 {
+			key = fmt.Sprintf("cold-%d", i)
+		}
+		loads[hash.Get(key)]++
+		total++
+
+		bound := int64(math.Ceil(loadFactor * float64(total) / float64(len(hosts))))
+		for host, load := range loads {
+			if load > bound {
+				t.Fatalf("after %d requests, %s has load %d; want at most %d", total, host, load, bound)
+			}
+		}
+	}
+
+	// Lookups with bounded loads do not allocate.
+	if allocs := testing.AllocsPerRun(100, func() { hash.Get("hot-0") }); allocs != 0 {
+		t.Errorf("Get with bounded loads made %v allocations; want 0", allocs)
+	}
+
+	// Without a load reporter, the key always goes to its owner.
+	hash.SetLoadReporter(nil, 0)
+	owner := hash.Get("hot-0")
+	for i := 0; i < 10; i++ {
+		if got := hash.Get("hot-0"); got != owner {
+			t.Errorf("Get(hot-0) = %s; want %s", got, owner)
+		}
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(50, Hash32(crc32.ChecksumIEEE))
+	hash.Add("a", "b", "c", "d")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		items := hash.GetN(key, 3)
+		if len(items) != 3 {
+			t.Fatalf("GetN(%q, 3) = %q; want 3 items", key, items)
+		}
+		if items[0] != hash.Get(key) {
+			t.Errorf("GetN(%q, 3)[0] = %q; want Get(%q) = %q", key, items[0], key, hash.Get(key))
+		}
+		if items[0] == items[1] || items[1] == items[2] || items[0] == items[2] {
+			t.Errorf("GetN(%q, 3) = %q; want distinct items", key, items)
+		}
+	}
+	if items := hash.GetN("key", 10); len(items) != 4 {
+		t.Errorf("GetN(key, 10) = %q; want the 4 items", items)
+	}
+	if items := New(1, nil).GetN("key", 2); items != nil {
+		t.Errorf("GetN on an empty hash = %q; want nil", items)
+	}
+
+	// The order doesn't depend on the order members were added in.
+	other := New(50, Hash32(crc32.ChecksumIEEE))
+	other.Add("d", "c", "b", "a")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if a, b := hash.GetN(key, 4), other.GetN(key, 4); !reflect.DeepEqual(a, b) {
+			t.Errorf("GetN(%q, 4) = %q and %q depending on insertion order", key, a, b)
+		}
+	}
+}
+
+func TestAddCollisions(t *testing.T) {
+	// Replica 14 of each of these members hashes to the same CRC32.
+	const a, b = "10.0.0.1574", "10.0.0.2530"
+	hash := New(50, Hash32(crc32.ChecksumIEEE))
+	hash.Add(a, b)
+
+	if n := hash.Collisions(); n != 1 {
+		t.Errorf("Collisions() = %d; want 1", n)
+	}
+	for _, member := range []string{a, b} {
+		if n := hash.ReplicaCount(member); n != 50 {
+			t.Errorf("ReplicaCount(%q) = %d; want 50", member, n)
+		}
+	}
+	if len(hash.keys) != len(hash.hashMap) {
+		t.Errorf("%d points on the ring for %d replicas", len(hash.keys), len(hash.hashMap))
+	}
+}
+
+func TestAddWithReplicas(t *testing.T) {
+	hash := New(100, Hash32(crc32.ChecksumIEEE))
+	hash.Add("a", "b")
+	hash.AddWithReplicas("standby", 10)
+	if n := hash.ReplicaCount("standby"); n != 10 {
+		t.Errorf("ReplicaCount(standby) = %d; want 10", n)
+	}
+	if f := hash.Distribution(10000)["standby"]; f > 0.15 {
+		t.Errorf("standby with 10 replicas owns %.2f of the keys; want about 0.05", f)
+	}
+
+	// Adding a member again replaces its replicas.
+	hash.AddWithReplicas("standby", 100)
+	if n := hash.ReplicaCount("standby"); n != 100 {
+		t.Errorf("ReplicaCount(standby) after adding it again = %d; want 100", n)
+	}
+	if len(hash.keys) != 300 {
+		t.Errorf("%d points on the ring; want 300", len(hash.keys))
+	}
+}
+
+func TestRingInspection(t *testing.T) {
+	hash := New(100, Hash32(crc32.ChecksumIEEE))
+	if got := hash.Distribution(1000); len(got) != 0 {
+		t.Errorf("Distribution of an empty hash = %v; want none", got)
+	}
+	hash.Add("c", "a")
+	hash.AddWithWeight("b", 2)
+
+	if got, want := hash.Members(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() = %q; want %q", got, want)
+	}
+	for member, want := range map[string]int{"a": 100, "b": 200, "c": 100, "d": 0} {
+		if got := hash.ReplicaCount(member); got != want {
+			t.Errorf("ReplicaCount(%q) = %d; want %d", member, got, want)
+		}
+	}
+
+	dist := hash.Distribution(10000)
+	var total float64
+	for _, f := range dist {
+		total += f
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("Distribution sums to %f; want 1", total)
+	}
+	if dist["b"] < 0.4 || dist["b"] > 0.6 {
+		t.Errorf("Distribution of b = %.2f; want about 0.5", dist["b"])
+	}
+	if !reflect.DeepEqual(dist, hash.Distribution(10000)) {
+		t.Error("Distribution is not reproducible")
+	}
+
+	hash.Remove("b")
+	if got := hash.ReplicaCount("b"); got != 0 {
+		t.Errorf("ReplicaCount of a removed member = %d; want 0", got)
+	}
+	if _, ok := hash.Distribution(100)["b"]; ok {
+		t.Error("Distribution reports a removed member")
+	}
+}
+
+func TestChurn(t *testing.T) {
+	hash := Hash32(crc32.ChecksumIEEE)
+	const nodes = 10
+
+	// meanDeviation returns the mean distance between the churn caused by
+	// adding an 11th node and the ideal churn of 1/11, over several nodes.
+	meanDeviation := func(replicas int) float64 {
+		old := New(replicas, hash)
+		for i := 0; i < nodes; i++ {
+			old.Add(fmt.Sprintf("10.0.0.%d:8000", i))
+		}
+		if c := Churn(old, old, 1000); c != 0 {
+			t.Fatalf("Churn between identical hashes = %v; want 0", c)
+		}
+
+		var sum float64
+		const trials = 10
+		for j := 0; j < trials; j++ {
+			grown := New(replicas, hash)
+			for i := 0; i < nodes; i++ {
+				grown.Add(fmt.Sprintf("10.0.0.%d:8000", i))
+			}
+			grown.Add(fmt.Sprintf("10.0.1.%d:8000", j))
+			sum += math.Abs(Churn(old, grown, 10000) - 1.0/(nodes+1))
+		}
+		return sum / trials
+	}
+
+	small, large := meanDeviation(1), meanDeviation(200)
+	t.Logf("mean deviation from ideal churn: %.4f with 1 replica, %.4f with 200", small, large)
+	if large >= small {
+		t.Errorf("churn deviates by %.4f with 200 replicas; want less than %.4f with 1", large, small)
+	}
+	if large > 0.02 {
+		t.Errorf("churn deviates by %.4f with 200 replicas; want at most 0.02", large)
+	}
+
+	empty := New(1, hash)
+	if c := Churn(empty, New(1, hash), 100); c != 0 {
+		t.Errorf("Churn between empty hashes = %v; want 0", c)
+	}
+	single := New(1, hash)
+	single.Add("a")
+	if c := Churn(empty, single, 100); c != 1 {
+		t.Errorf("Churn from an empty hash = %v; want 1", c)
+	}
+}
+
 func BenchmarkGet8(b *testing.B)   { benchmarkGet(b, 8) }
 func BenchmarkGet32(b *testing.B)  { benchmarkGet(b, 32) }
 func BenchmarkGet128(b *testing.B) { benchmarkGet(b, 128) }
@@ -132,9 +416,746 @@ func benchmarkGet(b *testing.B, shards int) {
 
 	hash.Add(buckets...)
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
 		hash.Get(buckets[i&(shards-1)])
 	}
 }
+
+func BenchmarkAdd(b *testing.B) {
+	peers := make([]string, 100)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://10.0.%d.%d:8000", i/256, i%256)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		New(50, nil).Add(peers...)
+	}
+}
+
+// checkSorted reports whether the ring of m is the one sorting all its
+// points at once gives.
+func checkSorted(t *testing.T, m *Map, op string) {
+	t.Helper()
+	want := make([]uint64, 0, len(m.hashMap))
+	for hash := range m.hashMap {
+		want = append(want, hash)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if !reflect.DeepEqual(m.keys, want) {
+		t.Fatalf("after %s: keys differ from the sorted points (%d keys, %d points)", op, len(m.keys), len(want))
+	}
+	if len(m.owners) != len(want) {
+		t.Fatalf("after %s: %d owners for %d keys", op, len(m.owners), len(want))
+	}
+	for i, hash := range want {
+		if m.owners[i] != m.hashMap[hash] {
+			t.Fatalf("after %s: owner of key %d = %q; want %q", op, i, m.owners[i], m.hashMap[hash])
+		}
+	}
+}
+
+func TestIncrementalSort(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// A 16-bit hash makes collisions, and thus probes, common.
+	hash := New(20, func(data []byte) uint64 { return uint64(crc32.ChecksumIEEE(data) & 0xffff) })
+	member := func() string { return fmt.Sprintf("m%d", rnd.Intn(40)) }
+	for step := 0; step < 500; step++ {
+		var op string
+		switch rnd.Intn(5) {
+		case 0:
+			a, b := member(), member()
+			hash.Add(a, b)
+			op = fmt.Sprintf("Add(%s, %s)", a, b)
+		case 1:
+			a, w := member(), 1+rnd.Intn(3)
+			hash.AddWithWeight(a, w)
+			op = fmt.Sprintf("AddWithWeight(%s, %d)", a, w)
+		case 2:
+			a, r := member(), rnd.Intn(30)
+			hash.AddWithReplicas(a, r)
+			op = fmt.Sprintf("AddWithReplicas(%s, %d)", a, r)
+		case 3:
+			a, b := member(), member()
+			hash.AddWeighted(map[string]int{a: 1 + rnd.Intn(3), b: 1 + rnd.Intn(3)})
+			op = fmt.Sprintf("AddWeighted(%s, %s)", a, b)
+		default:
+			a, b := member(), member()
+			hash.Remove(a, b)
+			op = fmt.Sprintf("Remove(%s, %s)", a, b)
+		}
+		checkSorted(t, hash, op)
+	}
+	if hash.Collisions() == 0 {
+		t.Errorf("Collisions = 0; want the 16-bit hash to make some")
+	}
+}
+
+func BenchmarkAddOneByOne(b *testing.B) {
+	peers := make([]string, 500)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://10.0.%d.%d:8000", i/256, i%256)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hash := New(160, nil)
+		for _, peer := range peers {
+			hash.Add(peer)
+		}
+	}
+}
+
+func TestGetAllocs(t *testing.T) {
+	hash := New(50, nil)
+	for i := 0; i < 100; i++ {
+		hash.Add(fmt.Sprintf("shard-%d", i))
+	}
+	key := "some key"
+	if n := testing.AllocsPerRun(100, func() { hash.Get(key) }); n != 0 {
+		t.Errorf("Get made %v allocations; want 0", n)
+	}
+}
+
+func TestGetCopiesKeysForOtherHashes(t *testing.T) {
+	for _, fn := range []Hash{nil, XXHash64, KetamaHash, StableHash} {
+		if m := New(1, fn); !m.hashKeys {
+			t.Errorf("New with a built-in hash copies keys")
+		}
+	}
+
+	// A hash scribbling over its data leaves the keys alone.
+	hash := New(50, func(data []byte) uint64 {
+		h := StableHash(data)
+		for i := range data {
+			data[i] = 'x'
+		}
+		return h
+	})
+	hash.Add("a", "b", "c")
+	key := string([]byte("some key"))
+	hash.Get(key)
+	if key != "some key" {
+		t.Errorf("key hashed by a hash modifying its data became %q", key)
+	}
+}
+
+func TestAddWithWeight(t *testing.T) {
+	const cases = 20000
+	keys := make([]string, cases)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = fmt.Sprint(rnd.Int63())
+	}
+
+	hash := New(256, nil)
+	hash.AddWeighted(map[string]int{"a": 1, "b": 1})
+	hash.AddWithWeight("c", 2)
+	owners := make([]string, cases)
+	counts := map[string]int{}
+	for i, key := range keys {
+		owners[i] = hash.Get(key)
+		counts[owners[i]]++
+	}
+	for member, weight := range map[string]int{"a": 1, "b": 1, "c": 2} {
+		want := float64(weight) / 4
+		if got := float64(counts[member]) / cases; math.Abs(got-want) > 0.05 {
+			t.Errorf("%s owns %.3f of the keys; want about %.3f", member, got, want)
+		}
+	}
+
+	// Raising the weight of c only moves keys to c.
+	heavier := New(256, nil)
+	heavier.AddWeighted(map[string]int{"a": 1, "b": 1, "c": 3})
+	moved := 0
+	for i, key := range keys {
+		if owner := heavier.Get(key); owner != owners[i] {
+			moved++
+			if owner != "c" {
+				t.Fatalf("key %q moved from %s to %s; want only moves to c", key, owners[i], owner)
+			}
+		}
+	}
+	if got, want := float64(moved)/cases, 3.0/5-2.0/4; math.Abs(got-want) > 0.03 {
+		t.Errorf("raising the weight of c moved %.3f of the keys; want about %.3f", got, want)
+	}
+}
+
+func TestAddWeightedCollisions(t *testing.T) {
+	// A 16-bit hash makes the replicas collide, so that where they land
+	// depends on the order the members are added in.
+	hash16 := func(data []byte) uint64 { return uint64(crc32.ChecksumIEEE(data) & 0xffff) }
+	weights := map[string]int{}
+	for i := 0; i < 20; i++ {
+		weights[fmt.Sprintf("member-%d", i)] = 1 + i%3
+	}
+	want := New(100, hash16)
+	want.AddWeighted(weights)
+	if want.Collisions() == 0 {
+		t.Fatal("no collisions; want some to test with")
+	}
+	for i := 0; i < 10; i++ {
+		got := New(100, hash16)
+		got.AddWeighted(weights)
+		if !reflect.DeepEqual(got.owners, want.owners) {
+			t.Fatal("AddWeighted of the same weights built another ring")
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	hash := New(50, nil)
+	hash.Add("a", "b", "c")
+	keys := make([]string, 5000)
+	owners := make([]string, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+		owners[i] = hash.Get(keys[i])
+	}
+
+	hash.Remove("b", "missing")
+	for i, key := range keys {
+		owner := hash.Get(key)
+		if owner == "b" {
+			t.Fatalf("key %q still owned by removed b", key)
+		}
+		if owners[i] != "b" && owner != owners[i] {
+			t.Errorf("key %q moved from %s to %s; want only the keys of b to move", key, owners[i], owner)
+		}
+	}
+
+	rebuilt := New(50, nil)
+	rebuilt.Add("a", "c")
+	for _, key := range keys {
+		if got, want := hash.Get(key), rebuilt.Get(key); got != want {
+			t.Fatalf("Get(%q) after Remove = %s; want %s as in a rebuilt hash", key, got, want)
+		}
+	}
+
+	hash.Remove("missing")
+	hash.Remove("a", "c")
+	if !hash.IsEmpty() || hash.Get("key") != "" {
+		t.Errorf("hash with every member removed: IsEmpty = %v, Get = %q; want true, \"\"", hash.IsEmpty(), hash.Get("key"))
+	}
+}
+
+// The golden files hold the server libketama picks for each key, as
+// computed by a port of its ketama_create_continuum and ketama_get_server.
+func TestKetama(t *testing.T) {
+	for _, tt := range []struct {
+		golden  string
+		weights map[string]int
+	}{
+		{"ketama.golden", map[string]int{
+			"10.0.1.1:11211": 1, "10.0.1.2:11211": 1, "10.0.1.3:11211": 1, "10.0.1.4:11211": 1,
+		}},
+		{"ketama_weighted.golden", map[string]int{
+			"10.0.1.1:11211": 1, "10.0.1.2:11211": 2, "10.0.1.3:11211": 3,
+		}},
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", tt.golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Members named after URLs, as HTTPPool names its peers.
+		hash := NewKetama(func(member string) string {
+			return strings.TrimPrefix(member, "http://")
+		})
+		for server, weight := range tt.weights {
+			hash.AddWithWeight("http://"+server, weight)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			key, server, _ := strings.Cut(line, " ")
+			if got := hash.Get(key); got != "http://"+server {
+				t.Errorf("%s: Get(%q) = %q; want %q", tt.golden, key, got, "http://"+server)
+			}
+		}
+	}
+
+	// Members of the same weight have KetamaPoints points, whatever their
+	// number, so removing one leaves the others in place.
+	hash := NewKetama(nil)
+	hash.Add("10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211")
+	if n := hash.ReplicaCount("10.0.1.1:11211"); n != KetamaPoints {
+		t.Errorf("ReplicaCount = %d; want %d", n, KetamaPoints)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		before[key] = hash.Get(key)
+	}
+	hash.Remove("10.0.1.3:11211")
+	for key, owner := range before {
+		if owner != "10.0.1.3:11211" && hash.Get(key) != owner {
+			t.Errorf("key %q moved from %s after removing another member", key, owner)
+		}
+	}
+	if n := hash.ReplicaCount("10.0.1.1:11211"); n != KetamaPoints {
+		t.Errorf("ReplicaCount after Remove = %d; want %d", n, KetamaPoints)
+	}
+}
+
+func TestStableHash(t *testing.T) {
+	// Reference values of 64-bit FNV-1a.
+	for data, want := range map[string]uint64{
+		"":       0xcbf29ce484222325,
+		"a":      0xaf63dc4c8601ec8c,
+		"foobar": 0x85944171f73967e8,
+	} {
+		if got := StableHash([]byte(data)); got != want {
+			t.Errorf("StableHash(%q) = %#x; want %#x", data, got, want)
+		}
+	}
+}
+
+func ExampleOwnership() {
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"}
+	owners := Ownership(peers, 50, StableHash, "alpha", "beta", "gamma")
+	for _, key := range []string{"alpha", "beta", "gamma"} {
+		fmt.Println(key, owners[key])
+	}
+	// Output:
+	// alpha http://10.0.0.2:8000
+	// beta http://10.0.0.1:8000
+	// gamma http://10.0.0.3:8000
+}
+
+func TestNewSeeded(t *testing.T) {
+	members := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"}
+	ring := func(seed uint64) *Map {
+		m := NewSeeded(50, nil, seed)
+		m.Add(members...)
+		return m
+	}
+	unseeded := New(50, nil)
+	unseeded.Add(members...)
+
+	if c := Churn(unseeded, ring(0), 10000); c != 0 {
+		t.Errorf("churn between New and NewSeeded with a zero seed = %v; want 0", c)
+	}
+	if c := Churn(ring(42), ring(42), 10000); c != 0 {
+		t.Errorf("churn between hashes of the same seed = %v; want 0", c)
+	}
+	// With 3 members, about 2/3 of the keys move to another one.
+	for _, seeds := range [][2]uint64{{0, 1}, {1, 2}, {42, StableHash([]byte("cluster-b"))}} {
+		if c := Churn(ring(seeds[0]), ring(seeds[1]), 10000); c < 0.5 || c > 0.8 {
+			t.Errorf("churn between seeds %d and %d = %v; want about 0.67", seeds[0], seeds[1], c)
+		}
+	}
+	for member, share := range ring(1).Distribution(10000) {
+		if share < 0.2 || share > 0.5 {
+			t.Errorf("%s owns %v of the keys with a seed; want about 1/3", member, share)
+		}
+	}
+}
+
+func TestGetHashed(t *testing.T) {
+	members := []string{"10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000"}
+	for _, tt := range []struct {
+		name string
+		m    *Map
+		fn   Hash
+	}{
+		{"default", New(50, nil), fnv1.HashBytes64},
+		{"seeded", NewSeeded(50, XXHash64, 42), XXHash64},
+		{"ketama", NewKetama(nil), KetamaHash},
+	} {
+		if got := tt.m.GetHashed(1); got != "" {
+			t.Errorf("%s: GetHashed on an empty hash = %q; want \"\"", tt.name, got)
+		}
+		tt.m.Add(members...)
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			if got, want := tt.m.GetHashed(tt.fn([]byte(key))), tt.m.Get(key); got != want {
+				t.Fatalf("%s: GetHashed of the hash of %q = %q; want %q", tt.name, key, got, want)
+			}
+		}
+	}
+
+	// Bounded loads apply too.
+	m := New(50, nil)
+	m.Add(members...)
+	m.SetLoadReporter(func(member string) int64 {
+		if member == members[0] {
+			return 100
+		}
+		return 0
+	}, 1.25)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if got := m.GetHashed(fnv1.HashBytes64([]byte(key))); got == members[0] || got != m.Get(key) {
+			t.Fatalf("GetHashed of the hash of %q with an overloaded %s = %q; want %q", key, members[0], got, m.Get(key))
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	members := []string{"10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000"}
+	for _, tt := range []struct {
+		name string
+		m    *Map
+		fn   Hash
+	}{
+		{"default", New(50, nil), fnv1.HashBytes64},
+		{"seeded", NewSeeded(50, XXHash64, 42), XXHash64},
+		{"ketama", NewKetama(nil), KetamaHash},
+	} {
+		if f := tt.m.Freeze(); !f.IsEmpty() || f.Get("key") != "" {
+			t.Errorf("%s: frozen empty hash is not empty", tt.name)
+		}
+		tt.m.Add(members...)
+		f := tt.m.Freeze()
+		want := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			want[key] = tt.m.Get(key)
+			if got := f.Get(key); got != want[key] {
+				t.Fatalf("%s: frozen Get(%q) = %q; want %q", tt.name, key, got, want[key])
+			}
+			if got := f.GetHashed(tt.fn([]byte(key))); got != want[key] {
+				t.Fatalf("%s: frozen GetHashed of the hash of %q = %q; want %q", tt.name, key, got, want[key])
+			}
+			if got, want := f.GetN(key, 2), tt.m.GetN(key, 2); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: frozen GetN(%q, 2) = %q; want %q", tt.name, key, got, want)
+			}
+		}
+
+		// The frozen copy keeps the placement it was made with.
+		tt.m.Remove(members[0])
+		tt.m.Add("10.0.0.4:8000")
+		for key, want := range want {
+			if got := f.Get(key); got != want {
+				t.Fatalf("%s: frozen Get(%q) after the map changed = %q; want %q", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkGetHashed(b *testing.B) {
+	hash := New(50, nil)
+	var keys []string
+	var hashes []uint64
+	for i := 0; i < 128; i++ {
+		hash.Add(fmt.Sprintf("shard-%d", i))
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+		hashes = append(hashes, fnv1.HashBytes64([]byte(keys[i])))
+	}
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			hash.Get(keys[i&127])
+		}
+	})
+	b.Run("GetHashed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			hash.GetHashed(hashes[i&127])
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		newMap  func() *Map
+		restore func() *Map
+	}{
+		{"seeded", func() *Map { return NewSeeded(50, XXHash64, 42) }, func() *Map { return New(0, XXHash64) }},
+		{"ketama", func() *Map { return NewKetama(nil) }, func() *Map { return NewKetama(nil) }},
+	} {
+		m := tt.newMap()
+		m.Add("10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000", "10.0.0.4:8000")
+		m.AddWithWeight("10.0.0.5:8000", 3)
+		m.AddWithReplicas("10.0.0.6:8000", 10)
+		m.Remove("10.0.0.2:8000")
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := tt.restore()
+		if err := json.Unmarshal(data, restored); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(restored.Snapshot(), m.Snapshot()) {
+			t.Errorf("%s: restored Snapshot = %+v; want %+v", tt.name, restored.Snapshot(), m.Snapshot())
+		}
+		if got, want := restored.Members(), m.Members(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: restored Members = %q; want %q", tt.name, got, want)
+		}
+		for i := 0; i < 10000; i++ {
+			key := strconv.Itoa(i)
+			if got, want := restored.Get(key), m.Get(key); got != want {
+				t.Fatalf("%s: restored Get(%q) = %q; want %q", tt.name, key, got, want)
+			}
+		}
+	}
+
+	data, _ := json.Marshal(New(50, nil))
+	if err := json.Unmarshal(data, NewKetama(nil)); err == nil {
+		t.Error("snapshot of a map restored into a ketama one; want an error")
+	}
+}
+
+func TestSnapshotCollisions(t *testing.T) {
+	// A 16-bit hash makes the replicas collide, so that where they land
+	// depends on the order the members were added in.
+	hash16 := func(data []byte) uint64 { return uint64(crc32.ChecksumIEEE(data) & 0xffff) }
+	m := New(200, hash16)
+	for i := 9; i >= 0; i-- {
+		m.Add(fmt.Sprintf("member-%d", i))
+	}
+	m.Remove("member-8", "member-3")
+	m.AddWithWeight("member-3", 2)
+	if m.Collisions() == 0 {
+		t.Fatal("no collisions; want some to test with")
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := New(0, hash16)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.keys, m.keys) || !reflect.DeepEqual(restored.owners, m.owners) {
+		t.Error("restored ring differs from the original")
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), m.Snapshot()) {
+		t.Errorf("restored Snapshot = %+v; want %+v", restored.Snapshot(), m.Snapshot())
+	}
+
+	// Adding the members in order of their names places them otherwise,
+	// which Restore does not.
+	sorted := New(200, hash16)
+	sorted.AddWeighted(map[string]int{"member-0": 1, "member-1": 1, "member-2": 1, "member-3": 2, "member-4": 1, "member-5": 1, "member-6": 1, "member-7": 1, "member-9": 1})
+	if reflect.DeepEqual(sorted.owners, m.owners) {
+		t.Error("adding the members in order placed them like the original; want a test ring depending on the order")
+	}
+
+	// A map with another hash cannot take the replicas where they were.
+	if err := json.Unmarshal(data, New(0, func(data []byte) uint64 { return hash16(data) & 0xff })); err == nil {
+		t.Error("snapshot restored into a map with another hash; want an error")
+	}
+}
+
+func TestSetReplicaKeyFunc(t *testing.T) {
+	members := []string{"a:1", "b:2", "c:3", "d:4"}
+
+	// DefaultReplicaKey places members like a hash without a function.
+	def := New(50, nil)
+	def.SetReplicaKeyFunc(DefaultReplicaKey)
+	def.Add(members...)
+	plain := New(50, nil)
+	plain.Add(members...)
+	if c := Churn(plain, def, 10000); c != 0 {
+		t.Errorf("churn between DefaultReplicaKey and no function = %v; want 0", c)
+	}
+
+	// A "member-replica" format hashed with crc32, as another system may
+	// place its members: the owner of a key is that of the first point
+	// at or after its hash.
+	memberDashReplica := func(member string, replica int) []byte {
+		return []byte(member + "-" + strconv.Itoa(replica))
+	}
+	type point struct {
+		hash   uint64
+		member string
+	}
+	var points []point
+	for _, member := range members {
+		for i := 0; i < 10; i++ {
+			points = append(points, point{uint64(crc32.ChecksumIEEE(memberDashReplica(member, i))), member})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	hash := New(10, Hash32(crc32.ChecksumIEEE))
+	hash.SetReplicaKeyFunc(memberDashReplica)
+	hash.Add(members...)
+	if hash.Collisions() != 0 {
+		t.Fatalf("%d collisions; want none", hash.Collisions())
+	}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		h := uint64(crc32.ChecksumIEEE([]byte(key)))
+		idx := sort.Search(len(points), func(i int) bool { return points[i].hash >= h }) % len(points)
+		if got, want := hash.Get(key), points[idx].member; got != want {
+			t.Errorf("Get(%q) = %q; want %q", key, got, want)
+		}
+	}
+}
+
+func TestContainsMembers(t *testing.T) {
+	hash := New(50, nil)
+	if !hash.IsEmpty() || hash.Contains("a") || len(hash.Members()) != 0 {
+		t.Errorf("new hash: IsEmpty = %v, Contains(a) = %v, Members = %q; want true, false, []",
+			hash.IsEmpty(), hash.Contains("a"), hash.Members())
+	}
+
+	hash.Add("c", "a", "b")
+	hash.AddWithWeight("d", 2)
+	if got, want := hash.Members(), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members = %q; want %q", got, want)
+	}
+	for _, member := range []string{"a", "b", "c", "d"} {
+		if !hash.Contains(member) {
+			t.Errorf("Contains(%q) = false; want true", member)
+		}
+	}
+	if hash.Contains("e") || hash.IsEmpty() {
+		t.Errorf("Contains(e) = %v, IsEmpty = %v; want false, false", hash.Contains("e"), hash.IsEmpty())
+	}
+
+	hash.Remove("b", "d")
+	if got, want := hash.Members(), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members after Remove = %q; want %q", got, want)
+	}
+	if hash.Contains("b") || !hash.Contains("a") {
+		t.Errorf("after Remove(b): Contains(b) = %v, Contains(a) = %v; want false, true", hash.Contains("b"), hash.Contains("a"))
+	}
+
+	hash.Remove("a", "c")
+	if !hash.IsEmpty() || hash.Contains("a") || len(hash.Members()) != 0 {
+		t.Errorf("emptied hash: IsEmpty = %v, Contains(a) = %v, Members = %q; want true, false, []",
+			hash.IsEmpty(), hash.Contains("a"), hash.Members())
+	}
+}
+
+// randomMembers returns n distinct members named like peers.
+func randomMembers(rnd *rand.Rand, n int) []string {
+	seen := make(map[string]bool, n)
+	var members []string
+	for len(members) < n {
+		member := fmt.Sprintf("http://10.%d.%d.%d:8000", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func TestAddMemberMovesOnlyItsShare(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	keys := SampleKeys(5000, 1)
+	for trial := 0; trial < 50; trial++ {
+		replicas := []int{50, 100, 200}[rnd.Intn(3)]
+		seed := rnd.Uint64()
+		members := randomMembers(rnd, 2+rnd.Intn(15))
+		added := members[len(members)-1]
+
+		before := NewSeeded(replicas, nil, seed)
+		before.Add(members[:len(members)-1]...)
+		after := NewSeeded(replicas, nil, seed)
+		after.Add(members...)
+
+		moves := Moves(before, after, keys...)
+		for _, move := range moves {
+			if move.To != added {
+				t.Fatalf("adding %s to %q (replicas %d, seed %d) moved %q from %s to %s; want only moves to %s",
+					added, members[:len(members)-1], replicas, seed, move.Key, move.From, move.To, added)
+			}
+		}
+		// The new member takes about 1/n of the keys, give or take the
+		// spread of its replicas.
+		if share, fair := float64(len(moves))/float64(len(keys)), 1/float64(len(members)); share > 1.6*fair+0.01 {
+			t.Errorf("adding %s to %q (replicas %d, seed %d) moved %.3f of the keys; want about %.3f",
+				added, members[:len(members)-1], replicas, seed, share, fair)
+		}
+	}
+}
+
+func TestRemoveMemberMovesOnlyItsKeys(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	keys := SampleKeys(5000, 2)
+	for trial := 0; trial < 50; trial++ {
+		replicas := []int{50, 100, 200}[rnd.Intn(3)]
+		seed := rnd.Uint64()
+		members := randomMembers(rnd, 2+rnd.Intn(15))
+		removed := members[rnd.Intn(len(members))]
+
+		hash := NewSeeded(replicas, nil, seed)
+		hash.Add(members...)
+		owned := 0
+		for _, key := range keys {
+			if hash.Get(key) == removed {
+				owned++
+			}
+		}
+		before := NewSeeded(replicas, nil, seed)
+		before.Add(members...)
+		hash.Remove(removed)
+
+		moves := Moves(before, hash, keys...)
+		for _, move := range moves {
+			if move.From != removed {
+				t.Fatalf("removing %s from %q (replicas %d, seed %d) moved %q from %s to %s; want only keys of %s to move",
+					removed, members, replicas, seed, move.Key, move.From, move.To, removed)
+			}
+		}
+		if len(moves) != owned {
+			t.Errorf("removing %s from %q (replicas %d, seed %d) moved %d keys; want its %d keys",
+				removed, members, replicas, seed, len(moves), owned)
+		}
+	}
+}
+
+func TestPlacementIndependentOfOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	keys := SampleKeys(2000, 3)
+	for trial := 0; trial < 20; trial++ {
+		members := randomMembers(rnd, 2+rnd.Intn(15))
+		hash := New(50, nil)
+		hash.Add(members...)
+
+		shuffled := append([]string(nil), members...)
+		rnd.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		other := New(50, nil)
+		for _, member := range shuffled {
+			other.Add(member)
+		}
+		if moves := Moves(hash, other, keys...); len(moves) != 0 {
+			t.Fatalf("adding %q in the order %q moved %q from %s to %s; want the same placement",
+				members, shuffled, moves[0].Key, moves[0].From, moves[0].To)
+		}
+	}
+}
+
+// placementRings returns the hashes whose placement the golden files of
+// TestPlacementGolden hold.
+func placementRings() map[string]*Map {
+	members := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000", "http://10.0.0.4:8000", "http://10.0.0.5:8000"}
+	unseeded := New(50, nil)
+	unseeded.Add(members...)
+	seeded := NewSeeded(50, StableHash, 42)
+	seeded.Add(members[1:]...)
+	seeded.AddWithWeight(members[0], 2)
+	return map[string]*Map{"placement.golden": unseeded, "placement_seeded.golden": seeded}
+}
+
+// The golden files hold the owner of each of SampleKeys(500, 42), so that
+// a change to the placement of keys, which makes every peer of a cluster
+// mixing releases miss, does not go unnoticed.
+func TestPlacementGolden(t *testing.T) {
+	for golden, hash := range placementRings() {
+		data, err := os.ReadFile(filepath.Join("testdata", golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		keys := SampleKeys(len(lines), 42)
+		for i, line := range lines {
+			key, owner, _ := strings.Cut(line, " ")
+			if key != keys[i] {
+				t.Fatalf("%s: key %d = %q; want %q from SampleKeys", golden, i, key, keys[i])
+			}
+			if got := hash.Get(key); got != owner {
+				t.Errorf("%s: Get(%q) = %q; want %q with members %q", golden, key, got, owner, hash.Members())
+			}
+		}
+	}
+}
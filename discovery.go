@@ -0,0 +1,173 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Resolver looks up the DNS records of peers. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// DNSDiscoveryOptions are the configurations of WatchDNS.
+type DNSDiscoveryOptions struct {
+	// Name is the DNS name listing the peers, e.g. the name of a
+	// Kubernetes headless service.
+	Name string
+
+	// Port is the port the peers listen on. If zero, the peers and their
+	// ports are looked up from the SRV records of Name instead of its
+	// A and AAAA records.
+	Port int
+
+	// Scheme is the scheme of the peer URLs.
+	// If blank, it defaults to "http".
+	Scheme string
+
+	// Interval is the delay between two lookups.
+	// If zero, it defaults to 30 seconds.
+	Interval time.Duration
+
+	// Settle is the number of consecutive lookups that must return the same
+	// peers for them to replace the peers of the pool, so that flapping
+	// records do not reshuffle keys. The peers found by the first lookup
+	// are used right away.
+	// If zero, it defaults to 2.
+	Settle int
+
+	// Resolver optionally specifies the resolver to use.
+	// If nil, it defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// WatchDNS looks up the peers of pool from DNS every Interval and calls
+// pool.Set when they change, until ctx is done. Lookup errors leave the
+// peers unchanged. It returns ctx.Err() once ctx is done.
+func WatchDNS(ctx context.Context, pool *HTTPPool, o DNSDiscoveryOptions) error {
+	w := newDNSWatcher(pool, o)
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(ctx); err != nil {
+			pool.log().Warn("looking up peers", "name", w.opts.Name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type dnsWatcher struct {
+	pool *HTTPPool
+	opts DNSDiscoveryOptions
+
+	current   []string // peers given to Set, nil until the first lookup
+	candidate []string // peers returned by the latest lookups
+	seen      int      // number of consecutive lookups returning candidate
+}
+
+func newDNSWatcher(pool *HTTPPool, o DNSDiscoveryOptions) *dnsWatcher {
+	if o.Scheme == "" {
+		o.Scheme = "http"
+	}
+	if o.Interval == 0 {
+		o.Interval = 30 * time.Second
+	}
+	if o.Settle == 0 {
+		o.Settle = 2
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	return &dnsWatcher{pool: pool, opts: o}
+}
+
+// poll looks up the peers once and updates the pool if they settled on a
+// new set.
+func (w *dnsWatcher) poll(ctx context.Context) error {
+	peers, err := w.lookup(ctx)
+	if err != nil {
+		return err
+	}
+
+	if equalStrings(peers, w.candidate) {
+		w.seen++
+	} else {
+		w.candidate, w.seen = peers, 1
+	}
+	if equalStrings(peers, w.current) || (w.current != nil && w.seen < w.opts.Settle) {
+		return nil
+	}
+	if err := w.pool.SetE(peers...); err != nil {
+		return err
+	}
+	w.current = peers
+	return nil
+}
+
+// lookup returns the sorted URLs of the peers.
+func (w *dnsWatcher) lookup(ctx context.Context) ([]string, error) {
+	var hostPorts []string
+	if w.opts.Port == 0 {
+		_, srvs, err := w.opts.Resolver.LookupSRV(ctx, "", "", w.opts.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "looking up SRV records of %q", w.opts.Name)
+		}
+		for _, srv := range srvs {
+			hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	} else {
+		addrs, err := w.opts.Resolver.LookupHost(ctx, w.opts.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "looking up hosts of %q", w.opts.Name)
+		}
+		for _, addr := range addrs {
+			hostPorts = append(hostPorts, net.JoinHostPort(addr, strconv.Itoa(w.opts.Port)))
+		}
+	}
+
+	peers := make([]string, len(hostPorts))
+	for i, hostPort := range hostPorts {
+		peers[i] = w.opts.Scheme + "://" + hostPort
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	hosts []string
+	srvs  []*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	return r.hosts, r.err
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srvs, r.err
+}
+
+func poolPeers(p *HTTPPool) []string {
+	stats := p.PeerStats()
+	peers := make([]string, 0, len(stats))
+	for peer := range stats {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func TestDNSWatcher(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas}}
+	r := &fakeResolver{hosts: []string{"10.0.0.2", "10.0.0.1"}}
+	w := newDNSWatcher(p, DNSDiscoveryOptions{Name: "peers.local", Port: 8000, Resolver: r})
+	ctx := context.Background()
+
+	poll := func(want ...string) {
+		t.Helper()
+		if err := w.poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := poolPeers(p); !equalStrings(got, want) {
+			t.Fatalf("pool peers = %q; want %q", got, want)
+		}
+	}
+
+	// The first lookup is used right away.
+	poll("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+
+	// A peer leaving is only applied once it settled.
+	r.hosts = []string{"10.0.0.1"}
+	poll("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	poll("http://10.0.0.1:8000")
+
+	// Flapping records do not change the peers.
+	r.hosts = []string{"10.0.0.1", "10.0.0.3"}
+	poll("http://10.0.0.1:8000")
+	r.hosts = []string{"10.0.0.1"}
+	poll("http://10.0.0.1:8000")
+	r.hosts = []string{"10.0.0.1", "10.0.0.3"}
+	poll("http://10.0.0.1:8000")
+	poll("http://10.0.0.1:8000", "http://10.0.0.3:8000")
+
+	// Lookup errors leave the peers unchanged.
+	r.err = errors.New("no such host")
+	if err := w.poll(ctx); err == nil {
+		t.Error("poll with a failing resolver succeeded")
+	}
+	if got := poolPeers(p); len(got) != 2 {
+		t.Errorf("pool peers after lookup error = %q; want them unchanged", got)
+	}
+}
+
+func TestDNSWatcherSRV(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas}}
+	r := &fakeResolver{srvs: []*net.SRV{
+		{Target: "peer-1.peers.local.", Port: 8000},
+		{Target: "peer-0.peers.local.", Port: 8001},
+	}}
+	w := newDNSWatcher(p, DNSDiscoveryOptions{Name: "peers.local", Scheme: "https", Resolver: r})
+	if err := w.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://peer-0.peers.local:8001", "https://peer-1.peers.local:8000"}
+	if got := poolPeers(p); !equalStrings(got, want) {
+		t.Errorf("pool peers = %q; want %q", got, want)
+	}
+}
+
+func TestWatchDNSStops(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas}}
+	r := &fakeResolver{hosts: []string{"10.0.0.1"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WatchDNS(ctx, p, DNSDiscoveryOptions{Name: "peers.local", Port: 8000, Interval: time.Millisecond, Resolver: r})
+	}()
+
+	for len(poolPeers(p)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("WatchDNS = %v; want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchDNS did not stop after its context was cancelled")
+	}
+}
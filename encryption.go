@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	pb "accedo.io/groupcache/v2/groupcachepb"
+	"github.com/pkg/errors"
+)
+
+// ErrDecryptionFailed is returned when a value from a peer cannot be
+// decrypted with any of the EncryptionKeys, e.g. because it was not
+// encrypted, was encrypted with another key, or was tampered with.
+var ErrDecryptionFailed = errors.New("groupcache: value decryption failed")
+
+// valueCipher encrypts and decrypts the values of GetResponses.
+type valueCipher struct {
+	aeads   []cipher.AEAD // the first one encrypts
+	etagKey []byte        // derived from the first key to mask etags
+}
+
+// newValueCipher returns a valueCipher encrypting with the first of keys
+// and decrypting with any, or nil if there are none.
+func newValueCipher(keys [][]byte) (*valueCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	mac := hmac.New(sha256.New, keys[0])
+	mac.Write([]byte("groupcache etag"))
+	c := &valueCipher{aeads: make([]cipher.AEAD, len(keys)), etagKey: mac.Sum(nil)}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if c.aeads[i], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// seal encrypts the value of res, the response to a request for key of
+// group, with a new nonce that it sets in res.
+func (c *valueCipher) seal(res *pb.GetResponse, group, key string) error {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "generating nonce")
+	}
+	res.Value = aead.Seal(nil, nonce, res.Value, encryptionData(group, key))
+	res.Nonce = nonce
+	return nil
+}
+
+// open decrypts the value of out, the response to a request for key of
+// group, trying each key in turn.
+func (c *valueCipher) open(out *pb.GetResponse, group, key string) error {
+	for _, aead := range c.aeads {
+		if len(out.Nonce) != aead.NonceSize() {
+			continue
+		}
+		value, err := aead.Open(nil, out.Nonce, out.Value, encryptionData(group, key))
+		if err == nil {
+			out.Value, out.Nonce = value, nil
+			return nil
+		}
+	}
+	return ErrDecryptionFailed
+}
+
+// maskETag returns the etag sent for the value of key of group in place
+// of etag, a hash of the value, which would let whoever sees it confirm
+// guesses of the value.
+func (c *valueCipher) maskETag(etag, group, key string) string {
+	mac := hmac.New(sha256.New, c.etagKey)
+	mac.Write(encryptionData(group, key))
+	mac.Write([]byte("\x00" + etag))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// encryptionData is the additional data authenticated with the values,
+// so that the value of a key cannot be passed off as that of another.
+func encryptionData(group, key string) []byte {
+	return []byte(group + "\x00" + key)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "accedo.io/groupcache/v2/groupcachepb"
+)
+
+func TestValueCipher(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)
+	sealer, err := newValueCipher([][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := newValueCipher([][]byte{oldKey, newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte("secret value")
+	seal := func() *pb.GetResponse {
+		res := &pb.GetResponse{Value: append([]byte(nil), value...)}
+		if err := sealer.seal(res, "group", "key"); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Any of the keys decrypts.
+	res := seal()
+	if bytes.Contains(res.Value, value) {
+		t.Error("sealed value holds the plaintext")
+	}
+	if err := opener.open(res, "group", "key"); err != nil || !bytes.Equal(res.Value, value) {
+		t.Errorf("open = %q, %v; want %q, nil", res.Value, err, value)
+	}
+	if seal().Nonce == nil || bytes.Equal(seal().Nonce, seal().Nonce) {
+		t.Error("values sealed with the same nonce")
+	}
+
+	for name, tamper := range map[string]func(*pb.GetResponse) (group, key string){
+		"flipped bit": func(res *pb.GetResponse) (string, string) {
+			res.Value[0] ^= 1
+			return "group", "key"
+		},
+		"truncated": func(res *pb.GetResponse) (string, string) {
+			res.Value = res.Value[:len(res.Value)-1]
+			return "group", "key"
+		},
+		"other nonce": func(res *pb.GetResponse) (string, string) {
+			res.Nonce[0] ^= 1
+			return "group", "key"
+		},
+		"other key": func(res *pb.GetResponse) (string, string) {
+			return "group", "other key"
+		},
+		"unencrypted": func(res *pb.GetResponse) (string, string) {
+			res.Value, res.Nonce = value, nil
+			return "group", "key"
+		},
+	} {
+		res := seal()
+		group, key := tamper(res)
+		if err := opener.open(res, group, key); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("%s: open = %v; want ErrDecryptionFailed", name, err)
+		}
+	}
+
+	if _, err := NewHTTPPoolWith("http://localhost:8000", WithHTTPPoolOptions(HTTPPoolOptions{
+		EncryptionKeys: [][]byte{newKey, []byte("short")},
+	})); err == nil || !strings.Contains(err.Error(), "EncryptionKeys[1]") {
+		t.Errorf("NewHTTPPoolWith with a 5-byte key = %v; want an error naming EncryptionKeys[1]", err)
+	}
+}
+
+func TestHTTPPoolEncryption(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	cipher, err := newValueCipher([][]byte{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &HTTPPool{
+		opts: HTTPPoolOptions{
+			BasePath:           defaultBasePath,
+			ServerErrorHandler: DefaultServerErrorHandler,
+		},
+		cipher: cipher,
+	}
+	g := newGroup("TestHTTPPoolEncryption-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("value of "+key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	get := func(keys ...[]byte) (*pb.GetResponse, error) {
+		h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{EncryptionKeys: keys, VerifyChecksums: len(keys) > 0})
+		group, key := g.Name(), "key"
+		out := &pb.GetResponse{}
+		return out, h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out)
+	}
+
+	// A peer still encrypting with the old key decrypts the values of one
+	// that moved to the new key, and verifies their checksum.
+	out, err := get(oldKey, newKey)
+	if err != nil || string(out.Value) != "value of key" {
+		t.Errorf("Get with the key = %q, %v; want %q, nil", out.Value, err, "value of key")
+	}
+
+	if _, err := get(oldKey); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Get without the key = %v; want ErrDecryptionFailed", err)
+	}
+	// Peers without keys get the ciphertext, whose checksum and etag tell
+	// nothing about the value.
+	out, err = get()
+	if err != nil || bytes.Contains(out.Value, []byte("value of key")) {
+		t.Errorf("Get of a peer without encryption = %q, %v; want ciphertext", out.Value, err)
+	}
+	plain := []byte("value of key")
+	if out.Checksum == nil || *out.Checksum != crc32.Checksum(out.Value, crc32cTable) {
+		t.Errorf("checksum of an encrypted value = %v; want that of the ciphertext", out.Checksum)
+	}
+	if etag := out.GetEtag(); etag == "" || etag == valueETag(plain) {
+		t.Errorf("etag of an encrypted value = %q; want one not derived from the value alone", etag)
+	}
+	res, err := http.Get(ts.URL + defaultBasePath + g.Name() + "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if etag := res.Header.Get("ETag"); etag != `"`+out.GetEtag()+`"` {
+		t.Errorf("ETag header = %s; want the masked etag %q", etag, out.GetEtag())
+	}
+}
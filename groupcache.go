@@ -27,6 +27,10 @@ package groupcache
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -40,10 +44,120 @@ import (
 
 var logger *logrus.Entry
 
+// SetLogger sets the logrus logger used by the groups and pools that are
+// not given a Logger in their options.
 func SetLogger(log *logrus.Entry) {
 	logger = log
 }
 
+// Logger receives the diagnostics of groups and pools, as a message
+// followed by alternating keys and values, e.g. "key", key.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// resolveLogger returns l, or else a Logger writing to the logger given to
+// SetLogger, or else one discarding everything.
+func resolveLogger(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	if logger != nil {
+		return logrusLogger{logger}
+	}
+	return noopLogger{}
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...interface{}) {}
+func (noopLogger) Warn(string, ...interface{})  {}
+func (noopLogger) Error(string, ...interface{}) {}
+
+// logrusLogger adapts a logrus logger to a Logger.
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l logrusLogger) with(keyvals []interface{}) *logrus.Entry {
+	fields := make(logrus.Fields, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	return l.entry.WithFields(fields)
+}
+
+func (l logrusLogger) Debug(msg string, keyvals ...interface{}) { l.with(keyvals).Debug(msg) }
+func (l logrusLogger) Warn(msg string, keyvals ...interface{})  { l.with(keyvals).Warn(msg) }
+func (l logrusLogger) Error(msg string, keyvals ...interface{}) { l.with(keyvals).Error(msg) }
+
+type loggerKey struct{}
+
+// loggerFromContext returns the Logger that ServeHTTP attached to ctx.
+func loggerFromContext(ctx context.Context) Logger {
+	l, _ := ctx.Value(loggerKey{}).(Logger)
+	return resolveLogger(l)
+}
+
+// ErrValueTooLarge is returned by Get when the loaded value is larger than
+// the maximum set with WithMaxValueBytes.
+var ErrValueTooLarge = errors.New("groupcache: value too large")
+
+// ErrOverloaded is returned by Get when the group was made with
+// WithMaxFlights and as many loads are in flight. The Get may be retried
+// once some completed.
+var ErrOverloaded = errors.New("groupcache: too many loads in flight")
+
+// ErrPeerRateLimited is returned by Get when the group was made with
+// WithPeerRateLimit and fetching the key from its owner would exceed the
+// rate. The Get may be retried once the rate allows it.
+var ErrPeerRateLimited = errors.New("groupcache: peer request rate exceeded")
+
+// ErrDuplicateGroup is returned by TryNewGroup, and NewGroup panics with
+// it, when a group of the same name is already registered.
+var ErrDuplicateGroup = errors.New("groupcache: duplicate registration of group")
+
+// RemoveError is returned by Remove when some peers could not be told to
+// remove the key, even after retrying, so that they may still serve the
+// removed value until it expires or is evicted.
+type RemoveError struct {
+	Group string
+	Key   string
+	Peers map[string]error // the last error of each failed peer, by URL
+}
+
+func (e *RemoveError) Error() string {
+	urls := make([]string, 0, len(e.Peers))
+	for url := range e.Peers {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	msg := fmt.Sprintf("groupcache: removing key %q of group %q failed on %d peers", e.Key, e.Group, len(urls))
+	for i, url := range urls {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		msg += sep + url + ": " + e.Peers[url].Error()
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the failed peers.
+func (e *RemoveError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Peers))
+	for _, err := range e.Peers {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// ErrVersionMismatch is returned by RemoveVersion when the owner of the
+// key holds a value with another version, which it kept.
+var ErrVersionMismatch = errors.New("groupcache: version mismatch")
+
 // A Getter loads data for a key.
 type Getter interface {
 	// Get returns the value identified by key, populating dest.
@@ -79,6 +193,20 @@ func GetGroup(name string) *Group {
 	return g
 }
 
+// Groups returns all groups currently registered with NewGroup, sorted
+// by name. The returned slice is a snapshot; groups created or
+// deregistered afterwards are not reflected in it.
+func Groups() []*Group {
+	mu.RLock()
+	list := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
 // NewGroup creates a coordinated group-aware Getter from a Getter.
 //
 // The returned Getter tries (but does not guarantee) to run only one
@@ -87,47 +215,109 @@ func GetGroup(name string) *Group {
 // other processes receive copies of the answer once the original Get
 // completes.
 //
-// The group name must be unique for each getter.
+// The caches of the group hold up to cacheBytes. A cacheBytes of zero
+// turns caching off: no value is stored, so every Get loads its key from
+// its owner or with getter, while concurrent Gets still share a load.
+//
+// The group name must be unique for each getter; NewGroup panics if a
+// group of the same name is already registered. See TryNewGroup to get
+// an error instead.
 func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
-	g := newGroup(name, cacheBytes, getter, nil)
+	g, err := registerGroup(name, cacheBytes, getter, nil, callerLine(1))
+	if err != nil {
+		panic(err)
+	}
 	for _, optFn := range opts {
 		optFn(g)
 	}
 	return g
 }
 
-// DeregisterGroup removes group from group pool
+// TryNewGroup is like NewGroup, but returns an error wrapping
+// ErrDuplicateGroup rather than panicking if a group of the same name is
+// already registered, e.g. for plugins whose names may clash.
+func TryNewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) (*Group, error) {
+	g, err := registerGroup(name, cacheBytes, getter, nil, callerLine(1))
+	if err != nil {
+		return nil, err
+	}
+	for _, optFn := range opts {
+		optFn(g)
+	}
+	return g, nil
+}
+
+// ErrGroupDeregistered is returned by the methods of a group after it was
+// deregistered with DeregisterGroup.
+var ErrGroupDeregistered = errors.New("groupcache: group deregistered")
+
+// DeregisterGroup removes group from group pool, and frees its caches.
+// The Gets, Refreshes and Removes of the group that are in progress
+// complete, without caching their values; later ones return
+// ErrGroupDeregistered. A group of the same name may then be created.
+// Deregistering a group that is not registered does nothing.
 func DeregisterGroup(name string) {
 	mu.Lock()
+	g := groups[name]
 	delete(groups, name)
 	mu.Unlock()
+
+	if g != nil {
+		g.deregistered.Store(true)
+		g.mainCache.close()
+		g.hotCache.close()
+	}
 }
 
 // If peers is nil, the peerPicker is called via a sync.Once to initialize it.
 func newGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker) *Group {
+	g, err := registerGroup(name, cacheBytes, getter, peers, callerLine(1))
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// registerGroup creates and registers a group, unless its name is taken.
+// registeredAt is where it was created, to help find the first of
+// duplicate registrations.
+func registerGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker, registeredAt string) (*Group, error) {
 	if getter == nil {
-		panic("nil Getter")
+		return nil, errors.New("nil Getter")
 	}
 	mu.Lock()
 	defer mu.Unlock()
 	initPeerServerOnce.Do(callInitPeerServer)
-	if _, dup := groups[name]; dup {
-		panic("duplicate registration of group " + name)
+	if first, dup := groups[name]; dup {
+		return nil, fmt.Errorf("%w %q: first registered at %s; use distinct names or DeregisterGroup it first",
+			ErrDuplicateGroup, name, first.registeredAt)
 	}
 	g := &Group{
 		name:             name,
+		registeredAt:     registeredAt,
 		getter:           getter,
 		peers:            peers,
 		cacheBytes:       cacheBytes,
 		loadGroup:        &singleflight.Group{},
 		removeGroup:      &singleflight.Group{},
 		peerErrorHandler: DefaultPeerErrorHandler,
+		hotCache:         cache{revalidate: true},
 	}
 	if fn := newGroupHook; fn != nil {
 		fn(g)
 	}
 	groups[name] = g
-	return g
+	return g, nil
+}
+
+// callerLine returns the file and line of the caller of the function
+// calling it, skipping skip more frames.
+func callerLine(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
 }
 
 type GroupOption func(group *Group)
@@ -148,6 +338,223 @@ func WithPeerErrorHandler(handler PeerErrorHandler) GroupOption {
 	}
 }
 
+// WithLogger sets the Logger receiving the diagnostics of the group, such
+// as remote load errors. By default, they go to the logger given to
+// SetLogger, if any.
+func WithLogger(l Logger) GroupOption {
+	return func(group *Group) {
+		group.logger = l
+	}
+}
+
+// WithReplication makes each key owned by up to n peers instead of one,
+// when the PeerPicker of the group is a MultiPeerPicker. Get then tries
+// the owners in order until one succeeds, and Remove clears the key from
+// all of them before the other peers. Every owner loads the key itself:
+// values are not written back to the owners that missed them, as peers
+// cannot be sent a value to store.
+func WithReplication(n int) GroupOption {
+	return func(group *Group) {
+		group.replicas = n
+	}
+}
+
+// WithMaxConcurrentLoads bounds how many calls to the Getter of the group
+// may run at once, e.g. to protect a rate limited backend from a burst of
+// misses for distinct keys. Further loads wait for a slot, or for their
+// context to be done. Loads from peers do not count against the limit.
+// If n is zero, there is no limit.
+func WithMaxConcurrentLoads(n int) GroupOption {
+	return func(group *Group) {
+		group.loadSem = nil
+		if n > 0 {
+			group.loadSem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithNoSingleflightFn makes the loads of the keys for which fn returns
+// true run on their own rather than be shared by concurrent Gets, e.g.
+// for keys whose values change on every load, so that each Get gets a
+// value loaded after it started. Whether the values are cached is not
+// affected. These loads do not count against WithMaxFlights.
+func WithNoSingleflightFn(fn func(key string) bool) GroupOption {
+	return func(group *Group) {
+		group.noSingleflightFn = fn
+	}
+}
+
+// WithLocalLoadOnDecodeError makes Get treat a response of a peer that
+// cannot be decoded, which fails with ErrUndecodableResponse, like a miss:
+// the key is loaded from the next owner or locally without consulting
+// the PeerErrorHandler, so that a rolling deploy changing the wire format
+// does not fail Gets. Such responses are counted in
+// Stats.PeerDecodeErrors either way.
+func WithLocalLoadOnDecodeError() GroupOption {
+	return func(group *Group) {
+		group.localLoadOnDecodeError = true
+	}
+}
+
+// WithLoadLocallyOnPeerFailure makes Get load a key with the Getter of
+// the group when its owners could not be reached, timed out or answered
+// with a 5xx error, trading duplicate loads for availability during peer
+// outages. The value is then served and cached like any local load.
+// Without it, such a Get fails with the RemoteLoadError of the last
+// owner. Owners answering with a 4xx error never make Get load locally.
+// The errors of ProtoGetters that are not RemoteLoadErrors are left to
+// the PeerErrorHandler.
+func WithLoadLocallyOnPeerFailure() GroupOption {
+	return func(group *Group) {
+		group.loadLocallyOnPeerFailure = true
+	}
+}
+
+// WithMaxConcurrentRemoves bounds how many peers Remove and RemoveVersion
+// clear the key from at once, e.g. so that removing a key across
+// hundreds of peers does not open a connection to each at the same time.
+// If n is zero, all the peers are cleared at once.
+func WithMaxConcurrentRemoves(n int) GroupOption {
+	return func(group *Group) {
+		group.maxConcurrentRemoves = n
+	}
+}
+
+// WithPeerRateLimit bounds the rate of the fetches of the group from its
+// peers to rate per second, with bursts of up to burst fetches, e.g. so
+// that a runaway loop of Gets does not flood the owners of the keys.
+// Fetches beyond the rate fail with ErrPeerRateLimited rather than load
+// the key locally, unless wait is set, in which case they wait for the
+// rate to allow them as long as their context is not done. Throttled
+// fetches are counted in Stats.PeerRateLimited.
+// If rate is zero, there is no limit.
+func WithPeerRateLimit(rate float64, burst int, wait bool) GroupOption {
+	return func(group *Group) {
+		group.peerLimiter = nil
+		if rate > 0 {
+			group.peerLimiter = newRateLimiter(rate, burst, wait)
+		}
+	}
+}
+
+// WithCancelOnDisconnect makes the loads of values requested by peers stop
+// when the requesting peer goes away, rather than complete to fill the
+// cache. Since a load is shared by the concurrent requests for its key,
+// these then fail too.
+func WithCancelOnDisconnect() GroupOption {
+	return func(group *Group) {
+		group.cancelOnDisconnect = true
+	}
+}
+
+// WithMaxFlights bounds how many distinct keys may be loading at once,
+// counting loads from peers, e.g. to push back on a scan of cold keys or
+// a hung Getter. Further loads fail right away with ErrOverloaded, while
+// concurrent Gets of a key being loaded still wait for it.
+// If n is zero, there is no limit.
+func WithMaxFlights(n int) GroupOption {
+	return func(group *Group) {
+		group.loadGroup = &singleflight.Group{MaxFlights: n}
+	}
+}
+
+// WithServeStaleOnError makes Get return the expired value of a key,
+// rather than the error, when reloading the key fails, e.g. while the
+// backend is down. GetWithInfo then reports SourceStale. Values that
+// expired more than maxStale ago are not served; maxStale must be
+// positive. Expired values are kept in the caches until replaced or
+// evicted to allow this.
+func WithServeStaleOnError(maxStale time.Duration) GroupOption {
+	return func(group *Group) {
+		group.maxStale = maxStale
+		group.mainCache.keepExpired = maxStale > 0
+		group.hotCache.keepExpired = maxStale > 0
+	}
+}
+
+// minRemoveBackoff is the least backoff of the retries of removes, so
+// that they never spin.
+const minRemoveBackoff = time.Millisecond
+
+// WithRemoveRetries makes Remove retry each peer that failed to remove
+// the key with a transient error, such as a network error or a 5xx or 429
+// response, up to attempts times in all. Retries wait for a jittered
+// backoff doubling from minBackoff up to maxBackoff, or for as long as
+// the Retry-After header of the response of the peer asks, up to the
+// deadline of the context. A minBackoff under a millisecond is taken as a
+// millisecond, and a maxBackoff under minBackoff as minBackoff.
+// By default, peers are tried once.
+func WithRemoveRetries(attempts int, minBackoff, maxBackoff time.Duration) GroupOption {
+	if minBackoff < minRemoveBackoff {
+		minBackoff = minRemoveBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return func(group *Group) {
+		group.removeAttempts = attempts
+		group.removeMinBackoff = minBackoff
+		group.removeMaxBackoff = maxBackoff
+	}
+}
+
+// WithReadRepair makes a peer that loaded a key itself because its owners
+// failed push the value back to them, so that they have it cached once
+// they recover. Each owner implementing ProtoSetter is tried up to
+// attempts times in the background, with the backoff of WithRemoveRetries.
+// By default, a value loaded after its owners failed stays with the peer
+// that loaded it.
+func WithReadRepair(attempts int, minBackoff, maxBackoff time.Duration) GroupOption {
+	if minBackoff < minRemoveBackoff {
+		minBackoff = minRemoveBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return func(group *Group) {
+		group.repairAttempts = attempts
+		group.repairMinBackoff = minBackoff
+		group.repairMaxBackoff = maxBackoff
+	}
+}
+
+// maxPendingRepairs bounds the pushes of WithReadRepair in flight for a
+// group, past which values are not pushed back.
+const maxPendingRepairs = 1024
+
+// WithSizeFn overrides how much an entry counts towards the cacheBytes limit of
+// the group. By default an entry counts for the length of its key and value.
+func WithSizeFn(sizeFn func(key string, value ByteView) int64) GroupOption {
+	return func(group *Group) {
+		group.mainCache.sizeFn = sizeFn
+		group.hotCache.sizeFn = sizeFn
+	}
+}
+
+// WithMaxValueBytes prevents values larger than maxBytes from being cached.
+// When serveUncached is false, Get returns ErrValueTooLarge for such values;
+// otherwise they are returned to the caller without being cached.
+func WithMaxValueBytes(maxBytes int64, serveUncached bool) GroupOption {
+	return func(group *Group) {
+		group.maxValueBytes = maxBytes
+		group.serveOversizedValues = serveUncached
+	}
+}
+
+// KeyNormalizeFn maps the keys that name the same value to a single one,
+// e.g. by trimming spaces or folding case. It must be idempotent, as keys
+// are normalized both by the peer requesting them and the one serving them.
+type KeyNormalizeFn func(key string) string
+
+// WithKeyNormalizeFn normalizes the keys passed to the group with fn before
+// they are looked up in the caches, used to pick their owner or passed to
+// the Getter, so that keys normalizing to the same one share an entry.
+func WithKeyNormalizeFn(fn KeyNormalizeFn) GroupOption {
+	return func(group *Group) {
+		group.keyNormalizeFn = fn
+	}
+}
+
 // newGroupHook, if non-nil, is called right after a new group is created.
 var newGroupHook func(*Group)
 
@@ -178,11 +585,83 @@ func callInitPeerServer() {
 // A Group is a cache namespace and associated data loaded spread over
 // a group of 1 or more machines.
 type Group struct {
-	name       string
-	getter     Getter
-	peersOnce  sync.Once
-	peers      PeerPicker
-	cacheBytes int64 // limit for sum of mainCache and hotCache size
+	name         string
+	registeredAt string // file:line of the NewGroup call
+	getter       Getter
+	peersOnce    sync.Once
+	peers        PeerPicker
+	cacheBytes   int64 // limit for sum of mainCache and hotCache size
+
+	// maxValueBytes, if positive, is the size above which loaded values
+	// are not cached, and only served if serveOversizedValues is set.
+	maxValueBytes        int64
+	serveOversizedValues bool
+
+	// keyNormalizeFn, if non-nil, normalizes the keys passed to the
+	// group, set with WithKeyNormalizeFn.
+	keyNormalizeFn KeyNormalizeFn
+
+	// logger receives the diagnostics of the group; nil means the
+	// package logger.
+	logger Logger
+
+	// replicas is the number of owners of each key set with
+	// WithReplication; 0 or 1 means a single owner.
+	replicas int
+
+	// loadSem holds a token for each call to getter in progress when
+	// WithMaxConcurrentLoads is set; nil means no limit.
+	loadSem chan struct{}
+
+	// activeLoads is the number of calls to getter in progress.
+	activeLoads AtomicInt
+
+	// noSingleflightFn, if non-nil, reports the keys whose loads are not
+	// shared, set with WithNoSingleflightFn.
+	noSingleflightFn func(key string) bool
+
+	// localLoadOnDecodeError is set with WithLocalLoadOnDecodeError.
+	localLoadOnDecodeError bool
+
+	// loadLocallyOnPeerFailure is set with WithLoadLocallyOnPeerFailure.
+	loadLocallyOnPeerFailure bool
+
+	// maxConcurrentRemoves bounds the peers a remove is sent to at once,
+	// set with WithMaxConcurrentRemoves; 0 means no limit.
+	maxConcurrentRemoves int
+
+	// peerLimiter, if non-nil, bounds the rate of the fetches from
+	// peers, set with WithPeerRateLimit.
+	peerLimiter *rateLimiter
+
+	// removeGens count the removes of the keys hashing to each of them,
+	// so that loads that started before a remove of their key do not
+	// cache the value they loaded.
+	removeGens [removeGenStripes]atomic.Uint64
+
+	// deregistered is set by DeregisterGroup.
+	deregistered atomic.Bool
+
+	// cancelOnDisconnect is set with WithCancelOnDisconnect.
+	cancelOnDisconnect bool
+
+	// removeAttempts, removeMinBackoff and removeMaxBackoff are set
+	// with WithRemoveRetries.
+	removeAttempts   int
+	removeMinBackoff time.Duration
+	removeMaxBackoff time.Duration
+
+	// repairAttempts, repairMinBackoff and repairMaxBackoff are set
+	// with WithReadRepair. pendingRepairs counts the pushes in flight.
+	repairAttempts   int
+	repairMinBackoff time.Duration
+	repairMaxBackoff time.Duration
+	pendingRepairs   atomic.Int64
+
+	// maxStale is how long after expiring values may still be served
+	// when reloading them fails, set with WithServeStaleOnError; zero
+	// means never.
+	maxStale time.Duration
 
 	// mainCache is a cache of the keys for which this process
 	// (amongst its peers) is authoritative. That is, this cache
@@ -223,8 +702,10 @@ type Group struct {
 // implementation.
 type flightGroup interface {
 	Do(key string, fn func() (interface{}, error)) (interface{}, error)
+	DoCtx(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error)
 	Count() int64
 	LongestRunningStartTime() time.Time
+	Forget(key string)
 	Lock(fn func())
 }
 
@@ -240,6 +721,21 @@ type Stats struct {
 	LocalLoads               AtomicInt // total good local loads
 	LocalLoadErrs            AtomicInt // total bad local loads
 	ServerRequests           AtomicInt // gets that came over the network from peers
+	ServerRejectedMethods    AtomicInt // requests from the network rejected for their HTTP method
+	OversizedValues          AtomicInt // loaded values larger than the maximum value size
+	ServerShedRequests       AtomicInt // low priority requests from the network rejected under load
+	PrimaryPeerLoads         AtomicInt // remote loads served by the first owner of the key
+	ReplicaPeerLoads         AtomicInt // remote loads served by another owner, with WithReplication
+	OverloadedLoads          AtomicInt // loads rejected because WithMaxFlights loads were in flight
+	PeerNotModified          AtomicInt // remote loads answered with the etag of the expired copy in the hot cache
+	StaleServed              AtomicInt // expired values served because reloading them failed, with WithServeStaleOnError
+	RemoveRetries            AtomicInt // removes retried on a peer after a transient error, with WithRemoveRetries
+	PreviousOwnerHits        AtomicInt // loads served from the cache of the owner before the peers changed
+	PreviousOwnerMisses      AtomicInt // loads the owner before the peers changed did not have cached
+	PeerDecodeErrors         AtomicInt // remote loads whose response could not be decoded
+	PeerRateLimited          AtomicInt // remote loads delayed or rejected by WithPeerRateLimit
+	ReadRepairs              AtomicInt // values pushed back to an owner that failed to load them, with WithReadRepair
+	ReadRepairErrors         AtomicInt // values that could not be pushed back to an owner, with WithReadRepair
 }
 
 // Name returns the name of the group.
@@ -247,23 +743,167 @@ func (g *Group) Name() string {
 	return g.name
 }
 
+// normalizeKey returns key normalized with the KeyNormalizeFn of the
+// group, if any.
+func (g *Group) normalizeKey(key string) string {
+	if g.keyNormalizeFn == nil {
+		return key
+	}
+	return g.keyNormalizeFn(key)
+}
+
 func (g *Group) initPeers() {
 	if g.peers == nil {
 		g.peers = getPeers(g.name)
 	}
 }
 
+// CacheHitSource describes where the value returned by GetWithInfo
+// came from.
+type CacheHitSource int
+
+const (
+	// SourceMainCache is a hit in the cache of the keys owned by this peer.
+	SourceMainCache CacheHitSource = iota + 1
+
+	// SourceHotCache is a hit in the cache of the keys owned by other peers.
+	SourceHotCache
+
+	// SourcePeer is a value fetched from the peer owning the key.
+	SourcePeer
+
+	// SourceLocal is a value loaded by the Getter of the group.
+	SourceLocal
+
+	// SourceStale is an expired value served because reloading it
+	// failed, with WithServeStaleOnError.
+	SourceStale
+)
+
+func (s CacheHitSource) String() string {
+	switch s {
+	case SourceMainCache:
+		return "main cache"
+	case SourceHotCache:
+		return "hot cache"
+	case SourcePeer:
+		return "peer"
+	case SourceLocal:
+		return "local"
+	case SourceStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// Priority is the priority of a request. Under load, peers shed low
+// priority requests, such as background refreshes, before high priority
+// ones, such as interactive requests.
+type Priority int
+
+const (
+	// PriorityHigh is the priority of requests without one.
+	PriorityHigh Priority = iota
+
+	// PriorityLow is the priority of requests that may be dropped first.
+	PriorityLow
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying the priority p, which is
+// sent along with the requests made to peers with ctx.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority carried by ctx, or
+// PriorityHigh if it carries none.
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+type cacheOnlyKey struct{}
+
+// withCacheOnly returns a copy of ctx making the requests to peers only
+// return cached values rather than load them.
+func withCacheOnly(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, cacheOnlyKey{}, true)
+}
+
+// cacheOnlyFromContext returns whether ctx was made by withCacheOnly.
+func cacheOnlyFromContext(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	cacheOnly, _ := ctx.Value(cacheOnlyKey{}).(bool)
+	return cacheOnly
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id, which is
+// sent along with the requests made to peers with ctx, and which peers
+// hand to their Getter and include in their logs. Requests made without
+// one get a random ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, or "" if it
+// carries none.
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
 func (g *Group) Get(ctx context.Context, key string, dest Sink) error {
+	_, err := g.get(ctx, key, nil, dest)
+	return err
+}
+
+// GetHashed is like Get, but if the PeerPicker of the group is a
+// HashedPeerPicker, the owner of key is picked from hash, the hash of key
+// the caller already computed as PickPeerHashed expects it, rather than
+// by hashing key again. The key itself is still used for the caches and
+// the load. Groups created WithReplication pick the owners from the key.
+func (g *Group) GetHashed(ctx context.Context, key string, hash uint64, dest Sink) error {
+	_, err := g.get(ctx, key, &hash, dest)
+	return err
+}
+
+// GetWithInfo is like Get but also returns where the value came from.
+// Callers whose load was deduplicated with a concurrent one get the
+// source of that load.
+func (g *Group) GetWithInfo(ctx context.Context, key string, dest Sink) (CacheHitSource, error) {
+	return g.get(ctx, key, nil, dest)
+}
+
+// get implements GetWithInfo and GetHashed; hash, if non-nil, is the
+// precomputed hash of key.
+func (g *Group) get(ctx context.Context, key string, hash *uint64, dest Sink) (CacheHitSource, error) {
 	g.peersOnce.Do(g.initPeers)
 	g.Stats.Gets.Add(1)
 	if dest == nil {
-		return errors.New("groupcache: nil dest Sink")
+		return 0, errors.New("groupcache: nil dest Sink")
 	}
-	value, cacheHit := g.lookupCache(key)
+	if g.deregistered.Load() {
+		return 0, ErrGroupDeregistered
+	}
+	key = g.normalizeKey(key)
+	value, source, cacheHit := g.lookupCache(key)
 
 	if cacheHit {
 		g.Stats.CacheHits.Add(1)
-		return setSinkView(dest, value)
+		return source, setSinkView(dest, value)
 	}
 
 	// Optimization to avoid double unmarshalling or copying: keep
@@ -271,69 +911,270 @@ func (g *Group) Get(ctx context.Context, key string, dest Sink) error {
 	// (if local) will set this; the losers will not. The common
 	// case will likely be one caller.
 	destPopulated := false
-	value, destPopulated, err := g.load(ctx, key, dest)
+	value, source, destPopulated, err := g.load(ctx, key, hash, dest)
 	if err != nil {
-		return err
+		if stale, ok := g.lookupStale(key); ok {
+			g.Stats.StaleServed.Add(1)
+			g.log().Warn("serving stale value after load error", "group", g.name, "key", key, "err", err)
+			return SourceStale, setSinkView(dest, stale)
+		}
+		return 0, err
 	}
 	if destPopulated {
-		return nil
+		return source, nil
+	}
+	return source, setSinkView(dest, value)
+}
+
+// Refresh loads key with the Getter of the group, bypassing the caches,
+// stores the value in place of any cached one and sets it in dest.
+// Concurrent refreshes of the same key share a single load. Unlike a
+// Remove followed by a Get, no other Get can observe the key missing in
+// between. The copies of the key cached by other peers are left alone.
+func (g *Group) Refresh(ctx context.Context, key string, dest Sink) error {
+	g.peersOnce.Do(g.initPeers)
+	if g.deregistered.Load() {
+		return ErrGroupDeregistered
+	}
+	key = g.normalizeKey(key)
+	destPopulated := false
+	resi, err := g.loadGroup.DoCtx(ctx, refreshFlightPrefix+key, func() (interface{}, error) {
+		gen := g.removeGen(key).Load()
+		value, err := g.getLocally(ctx, key, dest)
+		if err != nil {
+			g.Stats.LocalLoadErrs.Add(1)
+			return nil, err
+		}
+		g.Stats.LocalLoads.Add(1)
+		destPopulated = true // only one caller gets this return value
+		cacheable, err := g.checkValueSize(key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep the new value in the cache the key belongs in, and
+		// drop any copy in the other. Both happen at once, as add
+		// replaces the old value in place, so that Gets never miss.
+		target, other := &g.hotCache, &g.mainCache
+		if _, self := g.owners(key, nil); self {
+			target, other = &g.mainCache, &g.hotCache
+		}
+		value = withETag(value)
+		added := false
+		g.loadGroup.Lock(func() {
+			other.remove(key, "")
+			if !cacheable || g.cacheBytes <= 0 || g.removeGen(key).Load() != gen {
+				target.remove(key, "")
+				return
+			}
+			target.add(key, value)
+			added = true
+		})
+		if added {
+			g.evictOverflow()
+		}
+		return value, nil
+	})
+	if err != nil || destPopulated {
+		return g.checkOverloaded(err)
+	}
+	return setSinkView(dest, resi.(ByteView))
+}
+
+// refreshFlightPrefix keeps the flights of Refresh apart from those of
+// Get, which may be satisfied by the cache.
+const refreshFlightPrefix = "\x00refresh:"
+
+// CacheEntry is an entry of the cache of a group, as exported by Export.
+type CacheEntry struct {
+	Key     string
+	Value   []byte
+	Expire  time.Time // zero if the entry does not expire
+	Version string
+}
+
+// Export returns the entries of the main cache of the group that have not
+// expired, from the least to the most recently used, e.g. to persist them
+// before shutting down and Import them on start.
+func (g *Group) Export() []CacheEntry {
+	return g.mainCache.export(time.Now())
+}
+
+// Import adds entries to the main cache of the group without calling its
+// Getter, in order, so that the last entries are the most recently used.
+// Expired entries, and those too large to be cached, are skipped. The
+// cache size limit applies, so entries may evict older ones.
+func (g *Group) Import(entries []CacheEntry) {
+	now := time.Now()
+	for _, e := range entries {
+		if !e.Expire.IsZero() && !e.Expire.After(now) {
+			continue
+		}
+		key := g.normalizeKey(e.Key)
+		value := ByteView{b: cloneBytes(e.Value), e: e.Expire, version: e.Version}
+		if cacheable, _ := g.checkValueSize(key, value); !cacheable {
+			continue
+		}
+		g.populateCache(key, value, &g.mainCache)
 	}
-	return setSinkView(dest, value)
 }
 
 // Remove clears the key from our cache then forwards the remove
 // request to all peers.
 func (g *Group) Remove(ctx context.Context, key string) error {
-	g.peersOnce.Do(g.initPeers)
+	return g.remove(ctx, key, "")
+}
 
-	_, err := g.removeGroup.Do(key, func() (interface{}, error) {
+// RemoveVersion is like Remove, but each peer only clears the key if the
+// value it holds has the given version, as set by the Getter with
+// SetVersion. This keeps a remove that arrives after a newer value was
+// loaded from dropping that value. RemoveVersion returns
+// ErrVersionMismatch if the owner of the key holds another version.
+func (g *Group) RemoveVersion(ctx context.Context, key, version string) error {
+	if version == "" {
+		return errors.New("groupcache: RemoveVersion called with an empty version")
+	}
+	return g.remove(ctx, key, version)
+}
 
-		// Remove from key owner first
-		owner, ok := g.peers.PickPeer(key)
-		if ok {
-			if err := g.removeFromPeer(ctx, owner, key); err != nil {
-				return nil, err
+// A Namespace is a view of a Group whose keys are prefixed with its
+// prefix, so that several logical caches may share the memory and the
+// peers of one group without their keys colliding. The Getter of the
+// group receives the prefixed keys, e.g. to route them by prefix.
+type Namespace struct {
+	group  *Group
+	prefix string
+}
+
+// Namespace returns a view of g whose keys are prefixed with prefix.
+// No prefix of a namespace should be a prefix of another one of g, as
+// they are with a separator, e.g. "users:" and "orders:".
+func (g *Group) Namespace(prefix string) *Namespace {
+	return &Namespace{group: g, prefix: prefix}
+}
+
+// Group returns the group of the namespace.
+func (n *Namespace) Group() *Group {
+	return n.group
+}
+
+// Prefix returns the prefix of the keys of the namespace.
+func (n *Namespace) Prefix() string {
+	return n.prefix
+}
+
+// Get is like Group.Get for the key prefixed with the prefix of n.
+func (n *Namespace) Get(ctx context.Context, key string, dest Sink) error {
+	return n.group.Get(ctx, n.prefix+key, dest)
+}
+
+// Remove is like Group.Remove for the key prefixed with the prefix of n.
+func (n *Namespace) Remove(ctx context.Context, key string) error {
+	return n.group.Remove(ctx, n.prefix+key)
+}
+
+// remove removes key from all peers, only where its value has the given
+// version unless version is empty.
+func (g *Group) remove(ctx context.Context, key, version string) error {
+	g.peersOnce.Do(g.initPeers)
+	if g.deregistered.Load() {
+		return ErrGroupDeregistered
+	}
+	key = g.normalizeKey(key)
+
+	flightKey := key
+	if version != "" {
+		// Removes of different versions must not be deduplicated.
+		flightKey = key + "\x00" + version
+	}
+	_, err := g.removeGroup.Do(flightKey, func() (interface{}, error) {
+
+		// Remove from key owners first. An owner failing does not keep
+		// the key from being cleared everywhere else.
+		owners, self := g.owners(key, nil)
+		var mismatch error
+		failed := make(map[string]error)
+		for _, owner := range owners {
+			err := g.removeFromPeerWithRetries(ctx, owner, key, version)
+			switch {
+			case errors.Is(err, ErrVersionMismatch):
+				mismatch = err
+			case err != nil:
+				failed[owner.GetURL()] = err
 			}
 		}
 		// Remove from our cache next
-		g.localRemove(key)
-		wg := sync.WaitGroup{}
-		errs := make(chan error)
+		if !g.localRemove(key, version) && self {
+			mismatch = ErrVersionMismatch
+		}
 
-		// Asynchronously clear the key from all hot and main caches of peers
+		// Concurrently clear the key from all hot and main caches of
+		// peers, with at most maxConcurrentRemoves workers.
+		var others []ProtoGetter
 		for _, peer := range g.peers.GetAll() {
-			// avoid deleting from owner a second time
-			if peer == owner {
-				continue
+			// avoid deleting from owners a second time
+			if !containsPeer(owners, peer) {
+				others = append(others, peer)
 			}
-
+		}
+		workers := len(others)
+		if g.maxConcurrentRemoves > 0 && g.maxConcurrentRemoves < workers {
+			workers = g.maxConcurrentRemoves
+		}
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			queue = make(chan ProtoGetter, len(others))
+		)
+		for _, peer := range others {
+			queue <- peer
+		}
+		close(queue)
+		for i := 0; i < workers; i++ {
 			wg.Add(1)
-			go func(peer ProtoGetter) {
-				errs <- g.removeFromPeer(ctx, peer, key)
-				wg.Done()
-			}(peer)
+			go func() {
+				defer wg.Done()
+				for peer := range queue {
+					err := g.removeFromPeerWithRetries(ctx, peer, key, version)
+					// Other peers holding another version is expected.
+					if err != nil && !errors.Is(err, ErrVersionMismatch) {
+						mu.Lock()
+						failed[peer.GetURL()] = err
+						mu.Unlock()
+					}
+				}
+			}()
 		}
-		go func() {
-			wg.Wait()
-			close(errs)
-		}()
+		wg.Wait()
 
-		// TODO(thrawn01): Should we report all errors? Reporting context
-		//  cancelled error for each peer doesn't make much sense.
-		var err error
-		for e := range errs {
-			err = e
+		if len(failed) > 0 {
+			return nil, &RemoveError{Group: g.name, Key: key, Peers: failed}
 		}
-
-		return nil, err
+		return nil, mismatch
 	})
 	return err
 }
 
+func containsPeer(peers []ProtoGetter, peer ProtoGetter) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// loadResult is the result of a load shared by deduplicated callers.
+type loadResult struct {
+	value  ByteView
+	source CacheHitSource
+}
+
 // load loads key either by invoking the getter locally or by sending it to another machine.
-func (g *Group) load(ctx context.Context, key string, dest Sink) (value ByteView, destPopulated bool, err error) {
+// hash, if non-nil, is the precomputed hash of key.
+func (g *Group) load(ctx context.Context, key string, hash *uint64, dest Sink) (value ByteView, source CacheHitSource, destPopulated bool, err error) {
 	g.Stats.Loads.Add(1)
-	viewi, err := g.loadGroup.Do(key, func() (interface{}, error) {
+	load := func() (interface{}, error) {
 		// Check the cache again because singleflight can only dedup calls
 		// that overlap concurrently.  It's possible for 2 concurrent
 		// requests to miss the cache, resulting in 2 load() calls.  An
@@ -355,20 +1196,31 @@ func (g *Group) load(ctx context.Context, key string, dest Sink) (value ByteView
 		// 1: fn()
 		// 2: loadGroup.Do("key", fn)
 		// 2: fn()
-		if value, cacheHit := g.lookupCache(key); cacheHit {
+		gen := g.removeGen(key).Load()
+		if value, source, cacheHit := g.lookupCache(key); cacheHit {
 			g.Stats.CacheHits.Add(1)
-			return value, nil
+			return loadResult{value, source}, nil
 		}
 		g.Stats.LoadsDeduped.Add(1)
 		var value ByteView
 		var err error
-		if peer, ok := g.peers.PickPeer(key); ok {
-
+		owners, self := g.owners(key, hash)
+		if self {
+			// An owner loads the key itself, unless the peers are
+			// changing and the previous owner still has it.
+			owners = nil
+			if value, ok := g.getFromPreviousOwner(ctx, key, gen); ok {
+				return loadResult{value, SourcePeer}, nil
+			}
+		}
+		var peerErr error        // the failure of the last owner tried
+		var failed []ProtoGetter // the owners that failed
+		for i, peer := range owners {
 			// metrics duration start
 			start := time.Now()
 
 			// get value from peers
-			value, err = g.getFromPeer(ctx, peer, key)
+			value, err = g.getFromPeer(ctx, peer, key, &g.hotCache, gen)
 
 			// metrics duration compute
 			duration := int64(time.Since(start)) / int64(time.Millisecond)
@@ -380,9 +1232,29 @@ func (g *Group) load(ctx context.Context, key string, dest Sink) (value ByteView
 
 			if err == nil {
 				g.Stats.PeerLoads.Add(1)
-				return value, nil
+				if i == 0 {
+					g.Stats.PrimaryPeerLoads.Add(1)
+				} else {
+					g.Stats.ReplicaPeerLoads.Add(1)
+				}
+				return loadResult{value, SourcePeer}, nil
+			}
+			// A throttled fetch fails rather than move the load
+			// to another owner or the backend.
+			if errors.Is(err, ErrValueTooLarge) || errors.Is(err, ErrPeerRateLimited) {
+				return nil, err
+			}
+			if errors.Is(err, ErrUndecodableResponse) {
+				g.Stats.PeerDecodeErrors.Add(1)
+				if g.localLoadOnDecodeError {
+					g.log().Warn("undecodable response from peer, which may run another release", "group", g.name, "key", key, "peer", peer.GetURL(), "error", err)
+					continue
+				}
 			}
 
+			// Move on to the next owner, if any, then to a local load.
+			peerErr = err
+			failed = append(failed, peer)
 			if tryLocally, err := g.peerErrorHandler(ctx, g, key, peer.GetURL(), err); !tryLocally {
 				return nil, err
 			}
@@ -392,6 +1264,9 @@ func (g *Group) load(ctx context.Context, key string, dest Sink) (value ByteView
 			// probably boring (normal task movement), so not
 			// worth logging I imagine.
 		}
+		if isPeerFailure(peerErr) && !g.loadLocallyOnPeerFailure {
+			return nil, peerErr
+		}
 
 		value, err = g.getLocally(ctx, key, dest)
 		if err != nil {
@@ -400,16 +1275,84 @@ func (g *Group) load(ctx context.Context, key string, dest Sink) (value ByteView
 		}
 		g.Stats.LocalLoads.Add(1)
 		destPopulated = true // only one caller of load gets this return value
-		g.populateCache(key, value, &g.mainCache)
-		return value, nil
-	})
+		cacheable, err := g.checkValueSize(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if cacheable {
+			g.populateCacheSince(key, value, &g.mainCache, gen)
+			g.readRepair(ctx, failed, key, value)
+		}
+		return loadResult{value, SourceLocal}, nil
+	}
+	var resi interface{}
+	if g.noSingleflightFn != nil && g.noSingleflightFn(key) {
+		resi, err = load()
+	} else {
+		// A caller whose context is done stops waiting for the load of
+		// another.
+		resi, err = g.loadGroup.DoCtx(ctx, key, load)
+	}
 	if err == nil {
-		value = viewi.(ByteView)
+		res := resi.(loadResult)
+		value, source = res.value, res.source
 	}
+	err = g.checkOverloaded(err)
 	return
 }
 
+// checkOverloaded translates the error of loadGroup when too many loads
+// are in flight into ErrOverloaded.
+func (g *Group) checkOverloaded(err error) error {
+	if !errors.Is(err, singleflight.ErrOverloaded) {
+		return err
+	}
+	g.Stats.OverloadedLoads.Add(1)
+	return fmt.Errorf("%w: group %q", ErrOverloaded, g.name)
+}
+
+// owners returns the peers owning key, in order of preference, and
+// whether the current peer owns it too, in which case it loads the key
+// itself. hash, if non-nil, is the precomputed hash of key.
+func (g *Group) owners(key string, hash *uint64) (peers []ProtoGetter, self bool) {
+	if mp, ok := g.peers.(MultiPeerPicker); ok && g.replicas > 1 {
+		for _, peer := range mp.PickPeers(key, g.replicas) {
+			if peer == nil {
+				self = true
+			} else {
+				peers = append(peers, peer)
+			}
+		}
+		return peers, self || len(peers) == 0
+	}
+	if hp, ok := g.peers.(HashedPeerPicker); ok && hash != nil {
+		if peer, ok := hp.PickPeerHashed(*hash); ok {
+			return []ProtoGetter{peer}, false
+		}
+		return nil, true
+	}
+	if peer, ok := g.peers.PickPeer(key); ok {
+		return []ProtoGetter{peer}, false
+	}
+	return nil, true
+}
+
 func (g *Group) getLocally(ctx context.Context, key string, dest Sink) (ByteView, error) {
+	if g.loadSem != nil {
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		select {
+		case g.loadSem <- struct{}{}:
+		case <-done:
+			return ByteView{}, ctx.Err()
+		}
+		defer func() { <-g.loadSem }()
+	}
+	g.activeLoads.Add(1)
+	defer g.activeLoads.Add(-1)
+
 	err := g.getter.Get(ctx, key, dest)
 	if err != nil {
 		return ByteView{}, err
@@ -417,11 +1360,26 @@ func (g *Group) getLocally(ctx context.Context, key string, dest Sink) (ByteView
 	return dest.view()
 }
 
-func (g *Group) getFromPeer(ctx context.Context, peer ProtoGetter, key string) (ByteView, error) {
+// getFromPeer gets key from peer and populates target with it, unless
+// it is too large or was removed since gen was read from removeGen.
+func (g *Group) getFromPeer(ctx context.Context, peer ProtoGetter, key string, target *cache, gen uint64) (ByteView, error) {
 	req := &pb.GetRequest{
 		Group: &g.name,
 		Key:   &key,
 	}
+	if g.peerLimiter != nil {
+		throttled, err := g.peerLimiter.wait(ctx)
+		if throttled {
+			g.Stats.PeerRateLimited.Add(1)
+		}
+		if err != nil {
+			return ByteView{}, err
+		}
+	}
+	stale, hasStale := target.stale(key)
+	if hasStale {
+		req.Etag = &stale.etag
+	}
 	res := &pb.GetResponse{}
 	err := peer.Get(ctx, req, res)
 	if err != nil {
@@ -436,52 +1394,471 @@ func (g *Group) getFromPeer(ctx context.Context, peer ProtoGetter, key string) (
 		}
 	}
 
-	value := ByteView{b: res.Value, e: expire}
+	// A response without a value, e.g. from a peer that left it out
+	// because it was empty, holds an empty value rather than none.
+	value := ByteView{b: res.Value, e: expire, version: res.GetVersion(), etag: res.GetEtag()}
+	if res.GetNotModified() && hasStale {
+		g.Stats.PeerNotModified.Add(1)
+		value.b, value.s, value.etag = stale.b, stale.s, stale.etag
+	}
 
-	// Always populate the hot cache
-	g.populateCache(key, value, &g.hotCache)
+	cacheable, err := g.checkValueSize(key, value)
+	if err != nil {
+		return ByteView{}, err
+	}
+	if hasStale {
+		target.remove(key, "")
+	}
+	if cacheable {
+		g.populateCacheSince(key, value, target, gen)
+	}
 	return value, nil
 }
 
-func (g *Group) removeFromPeer(ctx context.Context, peer ProtoGetter, key string) error {
+// rateLimiter is a token bucket holding up to burst tokens, refilled at
+// rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	block bool // whether to wait for a token rather than fail
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, block bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), block: block, tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, waiting for one if the limiter blocks and ctx is
+// not done before then. It reports whether no token was available right
+// away, and returns ErrPeerRateLimited or the error of ctx if none was
+// taken.
+func (l *rateLimiter) wait(ctx context.Context) (throttled bool, err error) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		l.mu.Unlock()
+		return false, nil
+	}
+	delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if !l.block {
+		l.mu.Unlock()
+		return true, ErrPeerRateLimited
+	}
+	if ctx != nil {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+			l.mu.Unlock()
+			return true, fmt.Errorf("%w: no token before the deadline", ErrPeerRateLimited)
+		}
+	}
+	// Reserve the next token, to be given back if ctx is done first.
+	l.tokens--
+	l.mu.Unlock()
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-done:
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return true, ctx.Err()
+	}
+}
+
+// getFromPreviousOwner gets key from the peer that owned it before the
+// peers changed, if any, only if that peer has it cached, and populates
+// the main cache with it, unless key was removed since gen was read.
+func (g *Group) getFromPreviousOwner(ctx context.Context, key string, gen uint64) (ByteView, bool) {
+	mp, ok := g.peers.(MigratingPeerPicker)
+	if !ok {
+		return ByteView{}, false
+	}
+	peer, ok := mp.PickPreviousPeer(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	value, err := g.getFromPeer(withCacheOnly(ctx), peer, key, &g.mainCache, gen)
+	if err != nil {
+		g.Stats.PreviousOwnerMisses.Add(1)
+		return ByteView{}, false
+	}
+	g.Stats.PreviousOwnerHits.Add(1)
+	return value, true
+}
+
+// checkValueSize reports whether value is small enough to be cached. It
+// returns ErrValueTooLarge if the value must not be served either.
+func (g *Group) checkValueSize(key string, value ByteView) (cacheable bool, err error) {
+	if g.maxValueBytes <= 0 || int64(value.Len()) <= g.maxValueBytes {
+		return true, nil
+	}
+	g.Stats.OversizedValues.Add(1)
+	g.log().Warn("value exceeds the maximum size", "group", g.name, "key", key, "bytes", value.Len(), "maxBytes", g.maxValueBytes)
+	if g.serveOversizedValues {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %d bytes for key %q", ErrValueTooLarge, value.Len(), key)
+}
+
+func (g *Group) removeFromPeer(ctx context.Context, peer ProtoGetter, key, version string) error {
 	req := &pb.GetRequest{
 		Group: &g.name,
 		Key:   &key,
 	}
+	if version != "" {
+		req.Version = &version
+	}
 	return peer.Remove(ctx, req)
 }
 
-func (g *Group) lookupCache(key string) (value ByteView, ok bool) {
+// removeFromPeerWithRetries is like removeFromPeer, but retries transient
+// errors as set with WithRemoveRetries.
+func (g *Group) removeFromPeerWithRetries(ctx context.Context, peer ProtoGetter, key, version string) error {
+	backoff := g.removeMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := g.removeFromPeer(ctx, peer, key, version)
+		if err == nil || attempt >= g.removeAttempts || !isTransientRemoveError(err) {
+			return err
+		}
+		g.Stats.RemoveRetries.Add(1)
+		if !sleepCtx(ctx, retryWait(ctx, err, backoff)) {
+			return fmt.Errorf("%w, after: %w", ctx.Err(), err)
+		}
+		if backoff *= 2; backoff > g.removeMaxBackoff {
+			backoff = g.removeMaxBackoff
+		}
+	}
+}
+
+// readRepair pushes value, loaded locally for key after the owners failed
+// to load it, back to those owners in the background, with WithReadRepair.
+func (g *Group) readRepair(ctx context.Context, owners []ProtoGetter, key string, value ByteView) {
+	if g.repairAttempts <= 0 || len(owners) == 0 {
+		return
+	}
+	// The pushes outlive the load.
+	if ctx == nil {
+		ctx = context.Background()
+	} else {
+		ctx = context.WithoutCancel(ctx)
+	}
+	in := &pb.GetRequest{Group: &g.name, Key: &key}
+	res := &pb.GetResponse{}
+	fillResponse(value, res)
+	for _, peer := range owners {
+		setter, ok := peer.(ProtoSetter)
+		if !ok {
+			continue
+		}
+		if g.pendingRepairs.Add(1) > maxPendingRepairs {
+			g.pendingRepairs.Add(-1)
+			g.Stats.ReadRepairErrors.Add(1)
+			continue
+		}
+		go func() {
+			defer g.pendingRepairs.Add(-1)
+			if err := g.setOnPeerWithRetries(ctx, setter, in, res); err != nil {
+				g.Stats.ReadRepairErrors.Add(1)
+				g.log().Warn("failed to push value back to its owner", "group", g.name, "key", key, "peer", setter.GetURL(), "error", err)
+				return
+			}
+			g.Stats.ReadRepairs.Add(1)
+		}()
+	}
+}
+
+// setOnPeerWithRetries pushes value to peer, retrying it on transient
+// errors as set with WithReadRepair.
+func (g *Group) setOnPeerWithRetries(ctx context.Context, peer ProtoSetter, in *pb.GetRequest, value *pb.GetResponse) error {
+	backoff := g.repairMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := peer.Set(ctx, in, value)
+		if err == nil || attempt >= g.repairAttempts || !isTransientRemoveError(err) {
+			return err
+		}
+		if !sleepCtx(ctx, retryWait(ctx, err, backoff)) {
+			return fmt.Errorf("%w, after: %w", ctx.Err(), err)
+		}
+		if backoff *= 2; backoff > g.repairMaxBackoff {
+			backoff = g.repairMaxBackoff
+		}
+	}
+}
+
+// retryWait returns how long to wait before retrying a call that failed
+// with err: the delay the peer asked for in a Retry-After header, up to
+// the deadline of ctx, or else the jittered backoff.
+func retryWait(ctx context.Context, err error, backoff time.Duration) time.Duration {
+	var remote RemoteLoadError
+	if !errors.As(err, &remote) || remote.RetryAfter <= 0 {
+		return jitter(backoff)
+	}
+	wait := remote.RetryAfter
+	if ctx != nil {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+	}
+	return wait
+}
+
+// jitter returns between half and all of backoff, so that the retries of
+// concurrent calls spread out.
+func jitter(backoff time.Duration) time.Duration {
+	if half := int64(backoff / 2); half > 0 {
+		return time.Duration(half + rand.Int63n(half+1))
+	}
+	return backoff
+}
+
+// sleepCtx waits for d, and returns false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-done:
+		t.Stop()
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// cached returns whether Get would find key in the caches.
+func (g *Group) cached(key string) bool {
+	return g.cacheBytes > 0 && (g.mainCache.contains(key) || g.hotCache.contains(key))
+}
+
+// lookupStale returns the expired value of key that may be served when
+// reloading it failed, with WithServeStaleOnError.
+func (g *Group) lookupStale(key string) (value ByteView, ok bool) {
+	if g.maxStale <= 0 || g.cacheBytes <= 0 {
+		return
+	}
+	if value, ok = g.mainCache.expired(key, g.maxStale); ok {
+		return value, true
+	}
+	return g.hotCache.expired(key, g.maxStale)
+}
+
+// peekCache is like lookupCache, but does not count as a get of the
+// caches nor make the value more recently used.
+func (g *Group) peekCache(key string) (value ByteView, ok bool) {
+	if g.cacheBytes <= 0 {
+		return
+	}
+	if value, ok = g.mainCache.peek(key); ok {
+		return value, true
+	}
+	return g.hotCache.peek(key)
+}
+
+func (g *Group) lookupCache(key string) (value ByteView, source CacheHitSource, ok bool) {
 	if g.cacheBytes <= 0 {
 		return
 	}
 	value, ok = g.mainCache.get(key)
 	if ok {
-		return
+		return value, SourceMainCache, true
 	}
 	value, ok = g.hotCache.get(key)
-	return
+	return value, SourceHotCache, ok
 }
 
-func (g *Group) localRemove(key string) {
+// localRemove clears key from our local cache, only if its value has the
+// given version unless version is empty. It returns false if a value with
+// another version was kept.
+func (g *Group) localRemove(key, version string) bool {
+	// Gets after the remove must not be satisfied by a load, possibly of
+	// the removed value, that started before it, nor find its value
+	// cached once it completes.
+	g.removeGen(key).Add(1)
+	g.loadGroup.Forget(key)
+	g.loadGroup.Forget(refreshFlightPrefix + key)
+
 	// Clear key from our local cache
 	if g.cacheBytes <= 0 {
-		return
+		return true
 	}
 
 	// Ensure no requests are in flight
+	removed := true
 	g.loadGroup.Lock(func() {
-		g.hotCache.remove(key)
-		g.mainCache.remove(key)
+		if !g.hotCache.remove(key, version) {
+			removed = false
+		}
+		if !g.mainCache.remove(key, version) {
+			removed = false
+		}
 	})
+	return removed
+}
+
+// ServeGet answers the request of a peer for a key of the group, like
+// HTTPPool does over HTTP, for ProtoGetters that reach their peers by
+// other means.
+func (g *Group) ServeGet(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	g.Stats.ServerRequests.Add(1)
+	var view ByteView
+	if err := g.Get(ctx, in.GetKey(), ByteViewSink(&view)); err != nil {
+		return err
+	}
+	fillResponse(view, out)
+	return nil
+}
+
+// fillResponse sets the value, expiry, etag and version of view in out.
+func fillResponse(view ByteView, out *pb.GetResponse) {
+	b := view.ByteSlice()
+	if b == nil {
+		// An empty value is a value like any other.
+		b = []byte{}
+	}
+	var expire int64
+	if !view.e.IsZero() {
+		expire = view.e.UnixNano()
+	}
+	etag := view.etag
+	if etag == "" {
+		// The value was not cached.
+		etag = valueETag(b)
+	}
+	out.Value, out.Expire, out.Etag = b, &expire, &etag
+	if view.version != "" {
+		version := view.version
+		out.Version = &version
+	}
+}
+
+// ServeSet answers the request of a peer to store value for a key of the
+// group, like HTTPPool does over HTTP, in the caches of this peer. A key
+// already cached keeps its value.
+func (g *Group) ServeSet(ctx context.Context, in *pb.GetRequest, value *pb.GetResponse) error {
+	g.Stats.ServerRequests.Add(1)
+	return g.set(g.normalizeKey(in.GetKey()), value)
+}
+
+// set stores the value res pushed by a peer for key, unless it has
+// expired or key is already cached.
+func (g *Group) set(key string, res *pb.GetResponse) error {
+	var expire time.Time
+	if res.GetExpire() != 0 {
+		expire = time.Unix(0, res.GetExpire())
+		if time.Now().After(expire) {
+			return nil
+		}
+	}
+	gen := g.removeGen(key).Load()
+	if g.cached(key) {
+		return nil
+	}
+	value := ByteView{b: res.Value, e: expire, version: res.GetVersion()}
+	cacheable, err := g.checkValueSize(key, value)
+	if err != nil || !cacheable {
+		return err
+	}
+	g.populateCacheSince(key, value, &g.mainCache, gen)
+	return nil
+}
+
+// ServeRemove answers the request of a peer to remove a key of the group,
+// like HTTPPool does over HTTP, by removing it from the caches of this
+// peer only. It returns ErrVersionMismatch if the request has a version
+// and a value with another version was kept.
+func (g *Group) ServeRemove(ctx context.Context, in *pb.GetRequest) error {
+	g.Stats.ServerRequests.Add(1)
+	if !g.localRemove(g.normalizeKey(in.GetKey()), in.GetVersion()) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// log returns the Logger of the group.
+func (g *Group) log() Logger {
+	return resolveLogger(g.logger)
 }
 
 func (g *Group) populateCache(key string, value ByteView, cache *cache) {
 	if g.cacheBytes <= 0 {
 		return
 	}
-	cache.add(key, value)
+	cache.add(key, withETag(value))
+	g.evictOverflow()
+}
+
+// populateCacheSince is like populateCache, but drops value if key was
+// removed since gen was read from removeGen, e.g. by a load that started
+// before the remove.
+func (g *Group) populateCacheSince(key string, value ByteView, cache *cache, gen uint64) {
+	if g.cacheBytes <= 0 {
+		return
+	}
+	value = withETag(value)
+	added := false
+	g.loadGroup.Lock(func() {
+		if g.removeGen(key).Load() == gen {
+			cache.add(key, value)
+			added = true
+		}
+	})
+	if added {
+		g.evictOverflow()
+	}
+}
+
+// withETag returns value with its etag, computed from its content if it
+// has none, so that it is computed once for all the requests of peers
+// served from the cache.
+func withETag(value ByteView) ByteView {
+	if value.etag == "" {
+		b := value.b
+		if b == nil {
+			b = []byte(value.s)
+		}
+		value.etag = valueETag(b)
+	}
+	return value
+}
 
+// removeGenStripes is the number of removeGens of a group.
+const removeGenStripes = 64
+
+// removeGen returns the counter of the removes of key, shared with the
+// keys hashing to the same stripe.
+func (g *Group) removeGen(key string) *atomic.Uint64 {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &g.removeGens[h%removeGenStripes]
+}
+
+// evictOverflow evicts the oldest entries of the caches until they fit
+// in cacheBytes.
+func (g *Group) evictOverflow() {
 	// Evict items from cache(s) if necessary.
 	for {
 		mainBytes := g.mainCache.bytes()
@@ -528,6 +1905,7 @@ func (g *Group) CacheStats(which CacheType) CacheStats {
 	}
 
 	// Read group-level instant values
+	stats.ActiveLocalLoads = g.activeLoads.Get()
 	stats.ActiveSingleFlightLoads = g.loadGroup.Count()
 	if oldest := g.loadGroup.LongestRunningStartTime(); !oldest.IsZero() {
 		stats.SingleFlightLoadOldestAge = time.Since(oldest)
@@ -550,6 +1928,36 @@ type cache struct {
 	lru        *lru.Cache
 	nhit, nget int64
 	nevict     int64 // number of evictions
+
+	// evictReason is why the entries removed by the operation in
+	// progress are evicted; c.mu must be held to set it.
+	evictReason     evictionReason
+	sizeEvictions   EvictionStats
+	expiryEvictions EvictionStats
+	removeEvictions EvictionStats
+
+	// keepExpired keeps expired values until replaced or evicted, for
+	// WithServeStaleOnError.
+	keepExpired bool
+
+	// revalidate keeps expired values with an etag until replaced or
+	// evicted, so that the peer they came from may tell they did not
+	// change rather than send them again.
+	revalidate bool
+
+	// closed is set by close, after which nothing is added.
+	closed bool
+
+	// sizeFn optionally computes the size of an entry.
+	// If nil, entrySize uses the length of key and value.
+	sizeFn func(key string, value ByteView) int64
+}
+
+func (c *cache) entrySize(key string, value ByteView) int64 {
+	if c.sizeFn != nil {
+		return c.sizeFn(key, value)
+	}
+	return int64(len(key)) + int64(value.Len())
 }
 
 func (c *cache) stats() CacheStats {
@@ -561,23 +1969,69 @@ func (c *cache) stats() CacheStats {
 		Gets:      c.nget,
 		Hits:      c.nhit,
 		Evictions: c.nevict,
+
+		SizeEvictions:   c.sizeEvictions,
+		ExpiryEvictions: c.expiryEvictions,
+		RemoveEvictions: c.removeEvictions,
 	}
 }
 
 func (c *cache) add(key string, value ByteView) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
 	if c.lru == nil {
 		c.lru = &lru.Cache{
 			OnEvicted: func(key lru.Key, value interface{}) {
-				val := value.(ByteView)
-				c.nbytes -= int64(len(key.(string))) + int64(val.Len())
+				c.nbytes -= c.entrySize(key.(string), value.(ByteView))
 				c.nevict++
 			},
+			OnEvictedAge: func(_ lru.Key, _ interface{}, age time.Duration) {
+				switch c.evictReason {
+				case evictedForSize:
+					c.sizeEvictions.add(age)
+				case evictedExpired:
+					c.expiryEvictions.add(age)
+				default:
+					c.removeEvictions.add(age)
+				}
+			},
 		}
 	}
+	// The new value replaces any old one, e.g. an expired one kept for
+	// WithServeStaleOnError, which is not an eviction.
+	if old, _, ok := c.lru.Peek(key); ok {
+		c.nbytes -= c.entrySize(key, old.(ByteView))
+	}
 	c.lru.Add(key, value, value.Expire())
-	c.nbytes += int64(len(key)) + int64(value.Len())
+	c.nbytes += c.entrySize(key, value)
+}
+
+// export returns the entries of the cache that have not expired at now,
+// from the least to the most recently used.
+func (c *cache) export(now time.Time) []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return nil
+	}
+	entries := make([]CacheEntry, 0, c.lru.Len())
+	c.lru.Range(func(key lru.Key, value interface{}, expire time.Time) bool {
+		if !expire.IsZero() && !expire.After(now) {
+			return true
+		}
+		v := value.(ByteView)
+		entries = append(entries, CacheEntry{
+			Key:     key.(string),
+			Value:   v.ByteSlice(),
+			Expire:  v.e,
+			Version: v.version,
+		})
+		return true
+	})
+	return entries
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
@@ -587,6 +2041,12 @@ func (c *cache) get(key string) (value ByteView, ok bool) {
 	if c.lru == nil {
 		return
 	}
+	// Keep expired values with an etag if they may be revalidated, and
+	// any when they may be served stale.
+	if vi, expire, ok := c.lru.Peek(key); ok && ((c.revalidate && vi.(ByteView).etag != "") || c.keepExpired) && !expire.IsZero() && expire.Before(time.Now()) {
+		return ByteView{}, false
+	}
+	c.evictReason = evictedExpired
 	vi, ok := c.lru.Get(key)
 	if !ok {
 		return
@@ -595,19 +2055,94 @@ func (c *cache) get(key string) (value ByteView, ok bool) {
 	return vi.(ByteView), true
 }
 
-func (c *cache) remove(key string) {
+// contains returns whether key has a value that has not expired, without
+// counting as a get.
+func (c *cache) contains(key string) bool {
+	_, ok := c.peek(key)
+	return ok
+}
+
+// peek returns the value of key if it has not expired, without counting
+// as a get nor making it more recently used.
+func (c *cache) peek(key string) (value ByteView, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.lru == nil {
 		return
 	}
+	vi, expire, ok := c.lru.Peek(key)
+	if !ok || (!expire.IsZero() && expire.Before(time.Now())) {
+		return ByteView{}, false
+	}
+	return vi.(ByteView), true
+}
+
+// stale returns the value of key if it has an etag, whether or not it
+// has expired.
+func (c *cache) stale(key string) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return
+	}
+	vi, _, ok := c.lru.Peek(key)
+	if !ok || vi.(ByteView).etag == "" {
+		return ByteView{}, false
+	}
+	return vi.(ByteView), true
+}
+
+// expired returns the value of key if it expired at most maxStale ago.
+func (c *cache) expired(key string, maxStale time.Duration) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return
+	}
+	vi, expire, ok := c.lru.Peek(key)
+	if !ok || expire.IsZero() || time.Since(expire) > maxStale {
+		return ByteView{}, false
+	}
+	return vi.(ByteView), true
+}
+
+// remove removes key, only if its value has the given version
+// unless version is empty. It returns false if a value with another
+// version was kept.
+func (c *cache) remove(key, version string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return true
+	}
+	if version != "" {
+		// Only peek, so that a value kept for another version is not
+		// made more recently used. An expired value is not kept.
+		vi, expire, ok := c.lru.Peek(key)
+		if ok && (expire.IsZero() || !expire.Before(time.Now())) && vi.(ByteView).version != version {
+			return false
+		}
+	}
+	c.evictReason = evictedRemoved
 	c.lru.Remove(key)
+	return true
+}
+
+// close drops all the entries of the cache, which then stays empty. The
+// dropped entries are not evictions.
+func (c *cache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.lru = nil
+	c.nbytes = 0
 }
 
 func (c *cache) removeOldest() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.lru != nil {
+		c.evictReason = evictedForSize
 		c.lru.RemoveOldest()
 	}
 }
@@ -653,6 +2188,37 @@ func (i *AtomicInt) String() string {
 	return strconv.FormatInt(i.Get(), 10)
 }
 
+// evictionReason is why an entry was evicted from a cache.
+type evictionReason int
+
+const (
+	evictedRemoved evictionReason = iota
+	evictedForSize
+	evictedExpired
+)
+
+// EvictionAgeBuckets are the upper bounds of the age buckets of
+// EvictionStats.
+var EvictionAgeBuckets = [...]time.Duration{
+	time.Second, 10 * time.Second, time.Minute, 10 * time.Minute,
+	time.Hour, 6 * time.Hour, 24 * time.Hour,
+}
+
+// EvictionStats count the entries evicted from a cache for a reason.
+type EvictionStats struct {
+	Count int64
+
+	// Ages counts the entries by how long they were cached when evicted:
+	// Ages[i] counts those cached for at most EvictionAgeBuckets[i], and
+	// the last element the older ones.
+	Ages [len(EvictionAgeBuckets) + 1]int64
+}
+
+func (s *EvictionStats) add(age time.Duration) {
+	s.Count++
+	s.Ages[sort.Search(len(EvictionAgeBuckets), func(i int) bool { return age <= EvictionAgeBuckets[i] })]++
+}
+
 // CacheStats are returned by stats accessors on Group.
 type CacheStats struct {
 	// Counters (always increasing)
@@ -662,7 +2228,13 @@ type CacheStats struct {
 	Hits      int64
 	Evictions int64
 
+	// Evictions by reason, with the age of the entries when evicted.
+	SizeEvictions   EvictionStats // evicted to keep the caches under cacheBytes
+	ExpiryEvictions EvictionStats // dropped when found expired
+	RemoveEvictions EvictionStats // dropped by Remove, RemoveVersion or Refresh
+
 	// Instantaneous values
+	ActiveLocalLoads            int64 // calls to the Getter in progress
 	ActiveSingleFlightLoads     int64
 	SingleFlightLoadOldestAge   time.Duration
 	ActiveSingleFlightRemoves   int64
@@ -671,11 +2243,20 @@ type CacheStats struct {
 
 type PeerErrorHandler func(ctx context.Context, group *Group, key string, peerURL string, peerError error) (tryLocally bool, err error)
 
+// DefaultPeerErrorHandler logs the error of the peer and moves on to the
+// next owner of the key, or to a local load, unless ctx is done or the
+// peer answered with a 4xx error, which another load would get as well.
+// Once all the owners failed, a local load after a RemoteLoadError that
+// is not a 4xx also requires WithLoadLocallyOnPeerFailure.
 func DefaultPeerErrorHandler(ctx context.Context, group *Group, key string, peerURL string, err error) (tryLocally bool, e error) {
 
-	if logger != nil {
-		logger.WithError(err).WithField("key", key).Errorf("error retrieving key from peer %q", peerURL)
+	requestID := RequestIDFromContext(ctx)
+	var rerr RemoteLoadError
+	isRemote := errors.As(err, &rerr)
+	if isRemote && rerr.RequestID != "" {
+		requestID = rerr.RequestID
 	}
+	group.log().Error("error retrieving key from peer", "group", group.name, "key", key, "peer", peerURL, "requestID", requestID, "error", err)
 
 	group.Stats.PeerErrors.Add(1)
 	if ctx != nil && ctx.Err() != nil {
@@ -683,6 +2264,21 @@ func DefaultPeerErrorHandler(ctx context.Context, group *Group, key string, peer
 		// since the context is no longer valid
 		return false, err
 	}
+	if isRemote && rerr.StatusCode >= 400 && rerr.StatusCode < 500 {
+		// The peer answered for the key.
+		return false, err
+	}
 
 	return true, nil
 }
+
+// isPeerFailure returns whether err is the failure of a peer to answer:
+// a RemoteLoadError of a request that got no response, e.g. because the
+// peer is down or timed out, or a 5xx response.
+func isPeerFailure(err error) bool {
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) {
+		return false
+	}
+	return rerr.StatusCode == 0 || rerr.StatusCode >= 500
+}
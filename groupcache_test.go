@@ -20,11 +20,17 @@ package groupcache
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"math"
+	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -249,6 +255,76 @@ func TestCacheEviction(t *testing.T) {
 	}
 }
 
+func TestSizeFn(t *testing.T) {
+	const cacheBytes = 1 << 10
+	fill := func(g *Group) {
+		for i := 0; i < 10; i++ {
+			var s string
+			if err := g.Get(dummyCtx, fmt.Sprintf("key-%d", i), StringSink(&s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("value", time.Time{})
+	})
+
+	plain := newGroup("TestSizeFn-plain", cacheBytes, getter, NoPeers{})
+	fill(plain)
+	if n := plain.mainCache.stats().Evictions; n != 0 {
+		t.Errorf("plain group evicted %d entries; want 0", n)
+	}
+
+	// Each entry accounts for a quarter of the cache.
+	inflated := NewGroup("TestSizeFn-inflated", cacheBytes, getter, WithPeerPicker(NoPeers{}),
+		WithSizeFn(func(key string, value ByteView) int64 {
+			return cacheBytes / 4
+		}))
+	fill(inflated)
+	if n := inflated.mainCache.stats().Evictions; n != 6 {
+		t.Errorf("inflated group evicted %d entries; want 6", n)
+	}
+	if n := inflated.mainCache.bytes(); n != cacheBytes {
+		t.Errorf("inflated group cache has %d bytes; want %d", n, cacheBytes)
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	loads := 0
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetString(key+"-oversized-value", time.Time{})
+	})
+
+	rejecting := NewGroup("TestMaxValueBytes-rejecting", cacheSize, getter,
+		WithPeerPicker(NoPeers{}), WithMaxValueBytes(8, false))
+	var s string
+	if err := rejecting.Get(dummyCtx, "key", StringSink(&s)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Get of oversized value = %v; want ErrValueTooLarge", err)
+	}
+	if n := rejecting.mainCache.items(); n != 0 {
+		t.Errorf("cache has %d items; want 0", n)
+	}
+	if n := rejecting.Stats.OversizedValues.Get(); n != 1 {
+		t.Errorf("OversizedValues = %d; want 1", n)
+	}
+
+	serving := NewGroup("TestMaxValueBytes-serving", cacheSize, getter,
+		WithPeerPicker(NoPeers{}), WithMaxValueBytes(8, true))
+	loads = 0
+	for i := 0; i < 2; i++ {
+		if err := serving.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if want := "key-oversized-value"; s != want {
+			t.Errorf("Get = %q; want %q", s, want)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("getter called %d times; want 2 as the value is not cached", loads)
+	}
+}
+
 type fakePeer struct {
 	hits int
 	fail bool
@@ -289,6 +365,209 @@ func (p fakePeers) GetAll() []ProtoGetter {
 	return p
 }
 
+// recordingLogger records the events it receives as "level: msg".
+type recordingLogger struct {
+	mu      sync.Mutex
+	events  []string
+	keyvals [][]interface{}
+}
+
+func (l *recordingLogger) record(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, level+": "+msg)
+	l.keyvals = append(l.keyvals, keyvals)
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.record("debug", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.record("error", msg, keyvals) }
+
+func TestLoggerReceivesRemoteLoadErrors(t *testing.T) {
+	rec := &recordingLogger{}
+	peerList := fakePeers([]ProtoGetter{&fakePeer{fail: true}})
+	g := NewGroup("TestLoggerReceivesRemoteLoadErrors-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(peerList), WithLogger(rec))
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.events) != 1 || rec.events[0] != "error: error retrieving key from peer" {
+		t.Fatalf("logged events %q; want one remote load error", rec.events)
+	}
+	fields := map[interface{}]interface{}{}
+	for i := 0; i+1 < len(rec.keyvals[0]); i += 2 {
+		fields[rec.keyvals[0][i]] = rec.keyvals[0][i+1]
+	}
+	if fields["key"] != "key" || fields["peer"] != "fakePeer" || fields["error"] == nil {
+		t.Errorf("remote load error logged with %v; want the key, peer and error", rec.keyvals[0])
+	}
+}
+
+// orderedPeers is a MultiPeerPicker nominating its peers in order for
+// every key; a nil peer stands for the current peer.
+type orderedPeers []ProtoGetter
+
+func (p orderedPeers) PickPeer(key string) (ProtoGetter, bool) { return p[0], p[0] != nil }
+func (p orderedPeers) GetAll() []ProtoGetter                   { return p }
+
+func (p orderedPeers) PickPeers(key string, n int) []ProtoGetter {
+	if n > len(p) {
+		n = len(p)
+	}
+	return p[:n]
+}
+
+func TestReplication(t *testing.T) {
+	primary, replica, other := &fakePeer{fail: true}, &fakePeer{}, &fakePeer{}
+	localLoads := 0
+	g := NewGroup("TestReplication-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		localLoads++
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(orderedPeers{primary, replica, other}), WithReplication(2))
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "got:key" || localLoads != 0 {
+		t.Errorf("Get with a failing primary = %q after %d local loads; want the replica's value", s, localLoads)
+	}
+	if primary.hits != 1 || replica.hits != 1 || other.hits != 0 {
+		t.Errorf("peer hits = %d %d %d; want 1 1 0", primary.hits, replica.hits, other.hits)
+	}
+	if p, r := g.Stats.PrimaryPeerLoads.Get(), g.Stats.ReplicaPeerLoads.Get(); p != 0 || r != 1 {
+		t.Errorf("PrimaryPeerLoads, ReplicaPeerLoads = %d, %d; want 0, 1", p, r)
+	}
+
+	// Remove reaches every owner, then the other peers.
+	primary.fail = false
+	if err := g.Remove(dummyCtx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if primary.hits != 2 || replica.hits != 2 || other.hits != 1 {
+		t.Errorf("peer hits after Remove = %d %d %d; want 2 2 1", primary.hits, replica.hits, other.hits)
+	}
+
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if p := g.Stats.PrimaryPeerLoads.Get(); p != 1 {
+		t.Errorf("PrimaryPeerLoads = %d; want 1", p)
+	}
+
+	// An owner failing to remove the key does not keep it from being
+	// removed from the other owners, the local cache and the other peers.
+	primary.fail = true
+	var removeErr *RemoveError
+	if err := g.Remove(dummyCtx, "key"); !errors.As(err, &removeErr) || removeErr.Peers[primary.GetURL()] == nil {
+		t.Errorf("Remove with a failing primary = %v; want a RemoveError naming it", err)
+	}
+	if primary.hits != 4 || replica.hits != 3 || other.hits != 2 {
+		t.Errorf("peer hits after Remove with a failing primary = %d %d %d; want 4 3 2", primary.hits, replica.hits, other.hits)
+	}
+	if _, _, ok := g.lookupCache("key"); ok {
+		t.Error("key still cached after Remove with a failing primary")
+	}
+
+	// An owner loads the key itself.
+	self := NewGroup("TestReplication-self", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		localLoads++
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(orderedPeers{other, nil}), WithReplication(2))
+	defer DeregisterGroup(self.Name())
+	if err := self.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "local:key" || other.hits != 2 {
+		t.Errorf("Get on a replica owner = %q with %d hits on the primary; want a local load", s, other.hits-2)
+	}
+}
+
+// hashedPeers is a HashedPeerPicker picking peers from hashes by their
+// remainder, and from keys by the remainder of their length.
+type hashedPeers []ProtoGetter
+
+func (p hashedPeers) PickPeer(key string) (ProtoGetter, bool) {
+	peer := p[len(key)%len(p)]
+	return peer, peer != nil
+}
+
+func (p hashedPeers) PickPeerHashed(hash uint64) (ProtoGetter, bool) {
+	peer := p[hash%uint64(len(p))]
+	return peer, peer != nil
+}
+
+func (p hashedPeers) GetAll() []ProtoGetter { return p }
+
+func TestGetHashed(t *testing.T) {
+	peer0, peer1 := &fakePeer{}, &fakePeer{}
+	localLoads := 0
+	g := NewGroup("TestGetHashed-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		localLoads++
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(hashedPeers{peer0, peer1, nil}))
+	defer DeregisterGroup(g.Name())
+
+	// "key" is 3 bytes long, which PickPeer maps to self.
+	var s string
+	if err := g.GetHashed(dummyCtx, "key", 1, StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "got:key" || peer1.hits != 1 || peer0.hits != 0 {
+		t.Errorf("GetHashed(key, 1) = %q with peer hits %d %d; want the value of peer 1", s, peer0.hits, peer1.hits)
+	}
+	if err := g.GetHashed(dummyCtx, "other", 2, StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "local:other" || localLoads != 1 {
+		t.Errorf("GetHashed(other, 2) = %q after %d local loads; want a local load", s, localLoads)
+	}
+	// The key is still used for the caches.
+	if err := g.GetHashed(dummyCtx, "key", 0, StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "got:key" || peer0.hits != 0 {
+		t.Errorf("GetHashed of a cached key = %q with %d hits on peer 0; want the cached value", s, peer0.hits)
+	}
+}
+
+func TestReplicationSinglePeerPicker(t *testing.T) {
+	// A PeerPicker that is not a MultiPeerPicker nominates a single owner.
+	primary, failing := &fakePeer{}, &fakePeer{fail: true}
+	g := NewGroup("TestReplicationSinglePeerPicker-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(fakePeers{primary}), WithReplication(3))
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "got:key" || primary.hits != 1 {
+		t.Errorf("Get = %q with %d peer hits; want the value of the single owner", s, primary.hits)
+	}
+	if r := g.Stats.ReplicaPeerLoads.Get(); r != 0 {
+		t.Errorf("ReplicaPeerLoads = %d; want 0", r)
+	}
+
+	// Without replicas to fall back to, a failing owner makes a local load.
+	g2 := NewGroup("TestReplicationSinglePeerPicker-failing", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), WithPeerPicker(fakePeers{failing}), WithReplication(3))
+	defer DeregisterGroup(g2.Name())
+	if err := g2.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "local:key" || failing.hits != 1 {
+		t.Errorf("Get with a failing owner = %q after %d peer hits; want a local load after 1", s, failing.hits)
+	}
+}
+
 // tests that peers (virtual, in-process) are hit, and how much.
 func TestPeers(t *testing.T) {
 	once.Do(testSetup)
@@ -334,7 +613,7 @@ func TestPeers(t *testing.T) {
 		g := testGroup
 		g.cacheBytes = maxBytes
 		g.mainCache = cache{}
-		g.hotCache = cache{}
+		g.hotCache = cache{revalidate: true}
 	}
 
 	// Base case; peers all up, with no problems.
@@ -360,6 +639,389 @@ func TestPeers(t *testing.T) {
 	run("peer0_failing", 200, "localHits = 100, peers = 51 49 51")
 }
 
+func TestGetWithInfo(t *testing.T) {
+	peer := &fakePeer{}
+	peerList := fakePeers([]ProtoGetter{peer, nil})
+	g := newGroup("TestGetWithInfo-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("got:"+key, time.Time{})
+	}), peerList)
+
+	var localKey, peerKey string
+	for i := 0; localKey == "" || peerKey == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, ok := peerList.PickPeer(key); ok {
+			peerKey = key
+		} else {
+			localKey = key
+		}
+	}
+
+	for _, tt := range []struct {
+		key  string
+		want CacheHitSource
+	}{
+		{localKey, SourceLocal},
+		{localKey, SourceMainCache},
+		{peerKey, SourcePeer},
+		{peerKey, SourceHotCache},
+	} {
+		var s string
+		source, err := g.GetWithInfo(dummyCtx, tt.key, StringSink(&s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != tt.want {
+			t.Errorf("GetWithInfo(%q) source = %v; want %v", tt.key, source, tt.want)
+		}
+		if want := "got:" + tt.key; s != want {
+			t.Errorf("GetWithInfo(%q) = %q; want %q", tt.key, s, want)
+		}
+	}
+}
+
+func TestRemoveVersion(t *testing.T) {
+	loads, version := 0, "v2"
+	g := newGroup("TestRemoveVersion-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		if err := dest.SetString("value@"+version, time.Time{}); err != nil {
+			return err
+		}
+		SetVersion(dest, version)
+		return nil
+	}), NoPeers{})
+	defer DeregisterGroup(g.name)
+
+	var v ByteView
+	if err := g.Get(dummyCtx, "key", ByteViewSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version() != "v2" {
+		t.Errorf("Version() = %q; want v2", v.Version())
+	}
+
+	// The remove for v1 arrives after v2 was loaded and must keep it.
+	if err := g.RemoveVersion(dummyCtx, "key", "v1"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("RemoveVersion(v1) = %v; want ErrVersionMismatch", err)
+	}
+	if err := g.Get(dummyCtx, "key", ByteViewSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 {
+		t.Errorf("loads = %d after an out-of-order remove; want 1", loads)
+	}
+
+	version = "v3"
+	if err := g.RemoveVersion(dummyCtx, "key", "v2"); err != nil {
+		t.Errorf("RemoveVersion(v2) = %v; want nil", err)
+	}
+	if err := g.Get(dummyCtx, "key", ByteViewSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 || v.String() != "value@v3" {
+		t.Errorf("after RemoveVersion(v2), Get = %q with %d loads; want value@v3 with 2", v.String(), loads)
+	}
+
+	// Removing an absent key is not a mismatch.
+	if err := g.RemoveVersion(dummyCtx, "absent", "v1"); err != nil {
+		t.Errorf("RemoveVersion of an absent key = %v; want nil", err)
+	}
+
+	// A value kept for its version stays as recently used as it was.
+	var c cache
+	c.add("old", ByteView{s: "old", version: "v2"})
+	c.add("new", ByteView{s: "new", version: "v2"})
+	if c.remove("old", "v1") {
+		t.Error("remove of another version removed the value")
+	}
+	c.removeOldest()
+	if c.contains("old") || !c.contains("new") {
+		t.Errorf("after a mismatched remove of old, removeOldest kept old %v and new %v; want new only", c.contains("old"), c.contains("new"))
+	}
+}
+
+func TestEmptyValueIsAHit(t *testing.T) {
+	loads := 0
+	g := newGroup("TestEmptyValueIsAHit-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetBytes(nil, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.name)
+
+	for i, want := range []CacheHitSource{SourceLocal, SourceMainCache} {
+		var b []byte
+		source, err := g.GetWithInfo(dummyCtx, "empty", AllocatingByteSliceSink(&b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == nil || len(b) != 0 {
+			t.Errorf("Get %d of an empty value = %#v; want a non-nil empty slice", i, b)
+		}
+		if source != want {
+			t.Errorf("Get %d of an empty value came from %v; want %v", i, source, want)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("empty value loaded %d times; want 1", loads)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var mu sync.Mutex
+	loads := 0
+	unblock := make(chan struct{})
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "slow" {
+			<-unblock
+		}
+		mu.Lock()
+		loads++
+		n := loads
+		mu.Unlock()
+		return dest.SetString(fmt.Sprintf("%s@%d", key, n), time.Time{})
+	})
+	g := newGroup("TestRefresh-group", cacheSize, getter, NoPeers{})
+	defer DeregisterGroup(g.name)
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Refresh(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "key@2" {
+		t.Errorf("Refresh = %q; want key@2 from a new load", s)
+	}
+	source, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "key@2" || source != SourceMainCache {
+		t.Errorf("Get after Refresh = %q from %v; want key@2 from the main cache", s, source)
+	}
+	if n := g.mainCache.items(); n != 1 {
+		t.Errorf("main cache has %d items after Refresh; want 1", n)
+	}
+
+	// Concurrent refreshes share a load.
+	results := make(chan string)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var s string
+			if err := g.Refresh(dummyCtx, "slow", StringSink(&s)); err != nil {
+				t.Error(err)
+			}
+			results <- s
+		}()
+	}
+	for g.loadGroup.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	if a, b := <-results, <-results; a != "slow@3" || b != "slow@3" {
+		t.Errorf("concurrent Refreshes = %q, %q; want slow@3 from a single load", a, b)
+	}
+
+	// A key owned by a peer is refreshed in the hot cache.
+	peer := &fakePeer{}
+	hot := newGroup("TestRefresh-hot", cacheSize, getter, fakePeers{peer})
+	defer DeregisterGroup(hot.name)
+	if err := hot.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := hot.Refresh(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if source, err := hot.GetWithInfo(dummyCtx, "key", StringSink(&s)); err != nil || s != "key@4" || source != SourceHotCache {
+		t.Errorf("Get after Refresh of a peer's key = %q from %v, %v; want key@4 from the hot cache", s, source, err)
+	}
+	if peer.hits != 1 {
+		t.Errorf("peer hit %d times; want 1", peer.hits)
+	}
+}
+
+// lockHookFlightGroup calls afterLock each time Lock returns.
+type lockHookFlightGroup struct {
+	flightGroup
+	afterLock func()
+}
+
+func (g *lockHookFlightGroup) Lock(fn func()) {
+	g.flightGroup.Lock(fn)
+	g.afterLock()
+}
+
+func TestRefreshNeverMisses(t *testing.T) {
+	var loads int32
+	g := newGroup("TestRefreshNeverMisses-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(fmt.Sprintf("%s@%d", key, atomic.AddInt32(&loads, 1)), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.name)
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	// A Get between the steps of Refresh finds the old or the new value.
+	misses := 0
+	g.loadGroup = &lockHookFlightGroup{flightGroup: g.loadGroup, afterLock: func() {
+		if _, _, ok := g.lookupCache("key"); !ok {
+			misses++
+		}
+	}}
+	for i := 0; i < 3; i++ {
+		if err := g.Refresh(dummyCtx, "key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if misses != 0 {
+		t.Errorf("key missing from the cache %d times during Refresh; want 0", misses)
+	}
+	if s != "key@4" {
+		t.Errorf("Refresh = %q; want key@4", s)
+	}
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	var running, maxRunning int32
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	g := NewGroup("TestMaxConcurrentLoads-group", cacheSize, getter, WithPeerPicker(NoPeers{}), WithMaxConcurrentLoads(2))
+	defer DeregisterGroup(g.Name())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var s string
+			if err := g.Get(dummyCtx, fmt.Sprintf("key-%d", i), StringSink(&s)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for g.CacheStats(MainCache).ActiveLocalLoads != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A queued load gives up once its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	var s string
+	if err := g.Get(ctx, "late", StringSink(&s)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("queued Get = %v; want context.DeadlineExceeded", err)
+	}
+
+	wg.Wait()
+	if maxRunning != 2 {
+		t.Errorf("at most %d loads ran at once; want 2", maxRunning)
+	}
+	if n := g.CacheStats(MainCache).ActiveLocalLoads; n != 0 {
+		t.Errorf("ActiveLocalLoads = %d after the loads; want 0", n)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Round(0)
+	src := newGroup("TestExportImport-src", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		e := time.Time{}
+		if key == "expiring" {
+			e = expire
+		}
+		if err := dest.SetString("value:"+key, e); err != nil {
+			return err
+		}
+		SetVersion(dest, "v:"+key)
+		return nil
+	}), NoPeers{})
+	defer DeregisterGroup(src.name)
+	keys := []string{"a", "expiring", "b"}
+	for _, key := range keys {
+		var s string
+		if err := src.Get(dummyCtx, key, StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := src.Export()
+	if len(entries) != len(keys) {
+		t.Fatalf("Export returned %d entries; want %d", len(entries), len(keys))
+	}
+	for i, e := range entries {
+		if e.Key != keys[i] || string(e.Value) != "value:"+keys[i] || e.Version != "v:"+keys[i] {
+			t.Errorf("entry %d = %+v; want key %q with its value and version", i, e, keys[i])
+		}
+	}
+	if !entries[1].Expire.Equal(expire) {
+		t.Errorf("expire of exported entry = %v; want %v", entries[1].Expire, expire)
+	}
+
+	loads := 0
+	dst := newGroup("TestExportImport-dst", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetString("loaded", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(dst.name)
+	dst.Import(append(entries, CacheEntry{Key: "expired", Value: []byte("x"), Expire: time.Now().Add(-time.Second)}))
+	for _, key := range keys {
+		var v ByteView
+		source, err := dst.GetWithInfo(dummyCtx, key, ByteViewSink(&v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != SourceMainCache || v.String() != "value:"+key || v.Version() != "v:"+key {
+			t.Errorf("Get(%q) after Import = %q version %q from %v; want the imported value from the main cache", key, v.String(), v.Version(), source)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("Gets of imported keys called the Getter %d times; want 0", loads)
+	}
+	if _, ok := dst.mainCache.get("expired"); ok {
+		t.Error("Import added an expired entry")
+	}
+
+	// Importing a cached key replaces its value without evicting it.
+	before := dst.CacheStats(MainCache)
+	dst.Import([]CacheEntry{{Key: "a", Value: []byte("value:A"), Version: "v:a"}})
+	after := dst.CacheStats(MainCache)
+	if after.Evictions != before.Evictions || after.RemoveEvictions.Count != before.RemoveEvictions.Count || after.Items != before.Items || after.Bytes != before.Bytes {
+		t.Errorf("reimporting a key moved evictions %d -> %d, remove evictions %d -> %d, items %d -> %d, bytes %d -> %d; want them unchanged",
+			before.Evictions, after.Evictions, before.RemoveEvictions.Count, after.RemoveEvictions.Count, before.Items, after.Items, before.Bytes, after.Bytes)
+	}
+	if v, ok := dst.mainCache.get("a"); !ok || v.String() != "value:A" {
+		t.Errorf("value of a reimported key = %q, %v; want value:A", v.String(), ok)
+	}
+
+	// Importing honors the cache size, keeping the last entries.
+	const small = 40
+	tiny := newGroup("TestExportImport-tiny", small, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("loaded", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(tiny.name)
+	var many []CacheEntry
+	for i := 0; i < 10; i++ {
+		many = append(many, CacheEntry{Key: fmt.Sprintf("key-%d", i), Value: []byte("0123456789")})
+	}
+	tiny.Import(many)
+	if n := tiny.mainCache.bytes(); n > small {
+		t.Errorf("main cache holds %d bytes after Import; want at most %d", n, small)
+	}
+	if _, ok := tiny.mainCache.get("key-9"); !ok {
+		t.Error("Import evicted the last entry")
+	}
+}
+
 func TestTruncatingByteSliceTarget(t *testing.T) {
 	var buf [100]byte
 	s := buf[:]
@@ -403,6 +1065,74 @@ func TestAllocatingByteSliceTarget(t *testing.T) {
 	}
 }
 
+func TestProtoSinkRoundTrip(t *testing.T) {
+	once.Do(testSetup)
+	want := &testpb.TestMessage{
+		Name: proto.String("ECHO:TestProtoSinkRoundTrip-key"),
+		City: proto.String("SOME-CITY"),
+	}
+	// The first Get loads through the getter, the second is served
+	// from the cache.
+	for i := 0; i < 2; i++ {
+		tm := new(testpb.TestMessage)
+		sink := ProtoSink(tm)
+		if err := protoGroup.Get(dummyCtx, "TestProtoSinkRoundTrip-key", sink); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(tm, want) {
+			t.Errorf("Get #%d: got %v; want %v", i+1, proto.CompactTextString(tm), proto.CompactTextString(want))
+		}
+		v, err := sink.view()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(testpb.TestMessage)
+		if err := proto.Unmarshal(v.ByteSlice(), decoded); err != nil || !proto.Equal(decoded, want) {
+			t.Errorf("Get #%d: view does not hold the serialized message: %v, %v", i+1, decoded, err)
+		}
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	g := newGroup("TestJSONSink-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "malformed" {
+			return dest.SetString(`{"name": `, time.Time{})
+		}
+		return dest.SetBytes([]byte(`{"name": "`+key+`", "age": 40}`), time.Time{})
+	}), NoPeers{})
+
+	type user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	// The first Get loads through the getter, the second is served
+	// from the cache.
+	for i := 0; i < 2; i++ {
+		var u user
+		if err := g.Get(dummyCtx, "john", JSONSink(&u)); err != nil {
+			t.Fatal(err)
+		}
+		if want := (user{Name: "john", Age: 40}); u != want {
+			t.Errorf("Get #%d into struct: got %+v; want %+v", i+1, u, want)
+		}
+	}
+
+	var m map[string]interface{}
+	if err := g.Get(dummyCtx, "jane", JSONSink(&m)); err != nil {
+		t.Fatal(err)
+	}
+	if m["name"] != "jane" || m["age"] != float64(40) {
+		t.Errorf("Get into map: got %v", m)
+	}
+
+	var u user
+	err := g.Get(dummyCtx, "malformed", JSONSink(&u))
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("Get of malformed JSON = %v; want a *json.SyntaxError", err)
+	}
+}
+
 // orderedFlightGroup allows the caller to force the schedule of when
 // orig.Do will be called.  This is useful to serialize calls such
 // that singleflight cannot dedup them.
@@ -414,11 +1144,15 @@ type orderedFlightGroup struct {
 }
 
 func (g *orderedFlightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.DoCtx(context.Background(), key, fn)
+}
+
+func (g *orderedFlightGroup) DoCtx(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
 	<-g.stage1
 	<-g.stage2
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	return g.orig.Do(key, fn)
+	return g.orig.DoCtx(ctx, key, fn)
 }
 
 func (g *orderedFlightGroup) Lock(fn func()) {
@@ -433,6 +1167,10 @@ func (g *orderedFlightGroup) Count() int64 {
 	return 0
 }
 
+func (g *orderedFlightGroup) Forget(key string) {
+	g.orig.Forget(key)
+}
+
 // TestNoDedup tests invariants on the cache size when singleflight is
 // unable to dedup calls.
 func TestNoDedup(t *testing.T) {
@@ -535,3 +1273,896 @@ func TestContextDeadlineOnPeer(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxFlights(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	g := NewGroup("TestMaxFlights-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		started <- struct{}{}
+		<-release
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(NoPeers{}), WithMaxFlights(1))
+	defer DeregisterGroup(g.Name())
+
+	stuck := make(chan error)
+	go func() {
+		var s string
+		stuck <- g.Get(context.Background(), "stuck", StringSink(&s))
+	}()
+	<-started
+
+	var s string
+	if err := g.Get(context.Background(), "other", StringSink(&s)); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Get with the flight cap reached = %v; want ErrOverloaded", err)
+	}
+	if n := g.Stats.OverloadedLoads.Get(); n != 1 {
+		t.Errorf("OverloadedLoads = %d; want 1", n)
+	}
+
+	close(release)
+	if err := <-stuck; err != nil {
+		t.Fatal(err)
+	}
+	go func() { <-started }()
+	if err := g.Get(context.Background(), "other", StringSink(&s)); err != nil || s != "other" {
+		t.Errorf("Get once the flight completed = %q, %v; want other, nil", s, err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	})
+	names := []string{"groups-c", "groups-a", "groups-b"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			NewGroup(name, cacheSize, getter, WithPeerPicker(NoPeers{}))
+		}(name)
+		defer DeregisterGroup(name)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				Groups()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	list := Groups()
+	seen := make(map[string]bool)
+	for i, g := range list {
+		if i > 0 && list[i-1].Name() >= g.Name() {
+			t.Errorf("Groups not sorted: %q before %q", list[i-1].Name(), g.Name())
+		}
+		if GetGroup(g.Name()) != g {
+			t.Errorf("Groups returned %q, which GetGroup doesn't know", g.Name())
+		}
+		seen[g.Name()] = true
+	}
+	for _, name := range names {
+		if !seen[name] {
+			t.Errorf("Groups is missing %q", name)
+		}
+	}
+
+	DeregisterGroup("groups-b")
+	for _, g := range Groups() {
+		if g.Name() == "groups-b" {
+			t.Error("Groups still returns a deregistered group")
+		}
+	}
+}
+
+func TestDuplicateGroup(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	})
+	const name = "duplicate-group"
+	g, err := TryNewGroup(name, cacheSize, getter, WithPeerPicker(NoPeers{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeregisterGroup(name)
+	if g.Name() != name {
+		t.Errorf("Name() = %q; want %q", g.Name(), name)
+	}
+
+	dup, err := TryNewGroup(name, cacheSize, getter)
+	if dup != nil || !errors.Is(err, ErrDuplicateGroup) {
+		t.Fatalf("TryNewGroup with a taken name = %v, %v; want nil, ErrDuplicateGroup", dup, err)
+	}
+	// The error points at the first registration.
+	if !strings.Contains(err.Error(), name) || !strings.Contains(err.Error(), "groupcache_test.go") {
+		t.Errorf("error %q doesn't name the group and its first registration", err)
+	}
+	if GetGroup(name) != g {
+		t.Error("the failed registration replaced the first group")
+	}
+
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, ErrDuplicateGroup) {
+				t.Errorf("NewGroup with a taken name panicked with %v; want ErrDuplicateGroup", err)
+			}
+		}()
+		NewGroup(name, cacheSize, getter)
+	}()
+
+	if _, err := TryNewGroup("nil-getter-group", cacheSize, nil); err == nil {
+		t.Error("TryNewGroup with a nil Getter succeeded")
+	}
+}
+
+func TestReusingByteSliceSink(t *testing.T) {
+	g := newGroup("TestReusingByteSliceSink-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetBytes([]byte("value-"+key), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	buf := make([]byte, 0, 64)
+	for i := 0; i < 2; i++ { // a load, then a cache hit
+		if err := g.Get(dummyCtx, "key", ReusingByteSliceSink(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "value-key" {
+			t.Fatalf("Get = %q; want value-key", buf)
+		}
+		if cap(buf) != 64 {
+			t.Errorf("Get reallocated the buffer to cap %d; want it reused", cap(buf))
+		}
+		// Overwriting the buffer must not change the cached value.
+		copy(buf, "XXXXX")
+	}
+	if err := g.Get(dummyCtx, "other", ReusingByteSliceSink(&buf)); err != nil || string(buf) != "value-other" {
+		t.Errorf("Get(other) = %q, %v; want value-other, nil", buf, err)
+	}
+}
+
+func BenchmarkByteSliceSinks(b *testing.B) {
+	g := newGroup("BenchmarkByteSliceSinks-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetBytes(make([]byte, 1024), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	for _, bm := range []struct {
+		name string
+		sink func(*[]byte) Sink
+	}{
+		{"Allocating", AllocatingByteSliceSink},
+		{"Reusing", ReusingByteSliceSink},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var buf []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := g.Get(dummyCtx, "key", bm.sink(&buf)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	const maxStale = time.Minute
+	var (
+		fail   error
+		expire time.Time
+		loads  int
+	)
+	g := NewGroup("TestServeStaleOnError-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		if fail != nil {
+			return fail
+		}
+		return dest.SetString(fmt.Sprintf("%s-%d", key, loads), expire)
+	}), WithPeerPicker(NoPeers{}), WithServeStaleOnError(maxStale))
+	defer DeregisterGroup(g.Name())
+
+	// Values that already expired are reloaded by every Get.
+	expire = time.Now().Add(-time.Second)
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil || s != "key-1" {
+		t.Fatalf("Get = %q, %v; want key-1, nil", s, err)
+	}
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil || s != "key-2" {
+		t.Fatalf("Get of an expired value = %q, %v; want key-2, nil", s, err)
+	}
+
+	// The reloaded value replaced the expired one.
+	if stats := g.CacheStats(MainCache); stats.Items != 1 || stats.Bytes != int64(len("key")+len("key-2")) {
+		t.Errorf("cache holds %d items of %d bytes; want 1 of %d", stats.Items, stats.Bytes, len("key")+len("key-2"))
+	}
+
+	fail = errors.New("backend down")
+	source, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s))
+	if err != nil || s != "key-2" || source != SourceStale {
+		t.Errorf("GetWithInfo with a failing Getter = %v, %q, %v; want stale, key-2, nil", source, s, err)
+	}
+	if n := g.Stats.StaleServed.Get(); n != 1 {
+		t.Errorf("StaleServed = %d; want 1", n)
+	}
+
+	// Keys without a value still fail.
+	if err := g.Get(dummyCtx, "other", StringSink(&s)); !errors.Is(err, fail) {
+		t.Errorf("Get of a key never loaded = %v; want %v", err, fail)
+	}
+
+	// Values that expired more than maxStale ago are not served.
+	fail = nil
+	expire = time.Now().Add(-2 * maxStale)
+	if err := g.Get(dummyCtx, "old", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	fail = errors.New("backend down")
+	if err := g.Get(dummyCtx, "old", StringSink(&s)); !errors.Is(err, fail) {
+		t.Errorf("Get of a value expired past maxStale = %v; want %v", err, fail)
+	}
+}
+
+func TestServeStaleReplaceExpired(t *testing.T) {
+	var (
+		expire time.Time
+		loads  int
+	)
+	g := NewGroup("TestServeStaleReplaceExpired-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetString(fmt.Sprintf("%s-%d", key, loads), expire)
+	}), WithPeerPicker(NoPeers{}), WithServeStaleOnError(time.Minute))
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	expire = time.Now().Add(-time.Second)
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value replacing the kept expired one takes its expiry and size.
+	expire = time.Now().Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil || s != "key-2" {
+			t.Fatalf("Get %d after the reload = %q, %v; want the cached key-2", i, s, err)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("Getter called %d times; want 2", loads)
+	}
+	if stats := g.CacheStats(MainCache); stats.Items != 1 || stats.Bytes != int64(len("key")+len("key-2")) {
+		t.Errorf("cache holds %d items of %d bytes; want 1 of %d", stats.Items, stats.Bytes, len("key")+len("key-2"))
+	}
+}
+
+// flakyPeer answers its first fails Removes with status, or 503 if zero.
+type flakyPeer struct {
+	url     string
+	fails   int32
+	status  int
+	removes int32
+}
+
+func (p *flakyPeer) Get(context.Context, *pb.GetRequest, *pb.GetResponse) error {
+	return errors.New("not implemented")
+}
+
+func (p *flakyPeer) Remove(context.Context, *pb.GetRequest) error {
+	if atomic.AddInt32(&p.removes, 1) > p.fails {
+		return nil
+	}
+	status := p.status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	return RemoteLoadError{StatusCode: status, Err: fmt.Errorf("simulated %d response", status)}
+}
+
+func (p *flakyPeer) GetURL() string {
+	return p.url
+}
+
+// ownerlessPeers owns no key but lists peers to remove keys from.
+type ownerlessPeers []ProtoGetter
+
+func (ownerlessPeers) PickPeer(string) (ProtoGetter, bool) { return nil, false }
+func (p ownerlessPeers) GetAll() []ProtoGetter             { return p }
+
+func TestRemoveRetries(t *testing.T) {
+	flaky := &flakyPeer{url: "http://flaky", fails: 2}
+	dead := &flakyPeer{url: "http://dead", fails: math.MaxInt32}
+	rejecting := &flakyPeer{url: "http://rejecting", fails: math.MaxInt32, status: http.StatusBadRequest}
+	healthy := &flakyPeer{url: "http://healthy"}
+	g := NewGroup("TestRemoveRetries-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(ownerlessPeers{flaky, dead, rejecting, healthy}), WithRemoveRetries(3, time.Millisecond, 4*time.Millisecond))
+	defer DeregisterGroup(g.Name())
+
+	err := g.Remove(dummyCtx, "key")
+	var removeErr *RemoveError
+	if !errors.As(err, &removeErr) {
+		t.Fatalf("Remove with failing peers = %v; want a RemoveError", err)
+	}
+	if len(removeErr.Peers) != 2 || removeErr.Peers[dead.url] == nil || removeErr.Peers[rejecting.url] == nil {
+		t.Errorf("RemoveError lists peers %v; want %s and %s", removeErr.Peers, dead.url, rejecting.url)
+	}
+	if !strings.Contains(err.Error(), dead.url) {
+		t.Errorf("error %q doesn't name the dead peer", err)
+	}
+	// The flaky peer succeeds on its last attempt, while the 400 of the
+	// rejecting peer is not retried.
+	for _, tt := range []struct {
+		peer *flakyPeer
+		want int32
+	}{{flaky, 3}, {dead, 3}, {rejecting, 1}, {healthy, 1}} {
+		if n := atomic.LoadInt32(&tt.peer.removes); n != tt.want {
+			t.Errorf("%s got %d removes; want %d", tt.peer.url, n, tt.want)
+		}
+	}
+	if n := g.Stats.RemoveRetries.Get(); n != 4 {
+		t.Errorf("RemoveRetries = %d; want 4", n)
+	}
+
+	// Giving up on a context done during the backoff tells both why.
+	dead = &flakyPeer{url: "http://dead", fails: math.MaxInt32}
+	slow := NewGroup("TestRemoveRetries-slow", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(ownerlessPeers{dead}), WithRemoveRetries(3, time.Hour, time.Hour))
+	defer DeregisterGroup(slow.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = slow.Remove(ctx, "key")
+	var rerr RemoteLoadError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &rerr) || rerr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Remove canceled while backing off = %v; want context.Canceled and the 503 of the peer", err)
+	}
+
+	// Retries without a backoff still wait.
+	var noBackoff Group
+	WithRemoveRetries(3, 0, 0)(&noBackoff)
+	if noBackoff.removeMinBackoff != minRemoveBackoff || noBackoff.removeMaxBackoff != minRemoveBackoff {
+		t.Errorf("WithRemoveRetries(3, 0, 0) backs off from %v up to %v; want %v", noBackoff.removeMinBackoff, noBackoff.removeMaxBackoff, minRemoveBackoff)
+	}
+}
+
+// countingPeer records the removes it serves and how many of all the
+// countingPeers serve one at once.
+type countingPeer struct {
+	url     string
+	removes int32
+	active  *int32
+	max     *int32
+}
+
+func (p *countingPeer) Get(context.Context, *pb.GetRequest, *pb.GetResponse) error {
+	return errors.New("not implemented")
+}
+
+func (p *countingPeer) Remove(context.Context, *pb.GetRequest) error {
+	n := atomic.AddInt32(p.active, 1)
+	defer atomic.AddInt32(p.active, -1)
+	for {
+		max := atomic.LoadInt32(p.max)
+		if n <= max || atomic.CompareAndSwapInt32(p.max, max, n) {
+			break
+		}
+	}
+	atomic.AddInt32(&p.removes, 1)
+	time.Sleep(time.Millisecond)
+	if strings.HasSuffix(p.url, "7") {
+		return errors.New("simulated error from peer")
+	}
+	return nil
+}
+
+func (p *countingPeer) GetURL() string {
+	return p.url
+}
+
+func TestMaxConcurrentRemoves(t *testing.T) {
+	const limit = 8
+	var active, max int32
+	var peers ownerlessPeers
+	for i := 0; i < 200; i++ {
+		peers = append(peers, &countingPeer{url: fmt.Sprintf("http://peer-%d", i), active: &active, max: &max})
+	}
+	g := NewGroup("TestMaxConcurrentRemoves-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(peers), WithMaxConcurrentRemoves(limit))
+	defer DeregisterGroup(g.Name())
+
+	err := g.Remove(dummyCtx, "key")
+	var removeErr *RemoveError
+	if !errors.As(err, &removeErr) {
+		t.Fatalf("Remove with failing peers = %v; want a RemoveError", err)
+	}
+	if len(removeErr.Peers) != 20 {
+		t.Errorf("RemoveError lists %d peers; want the 20 failing ones", len(removeErr.Peers))
+	}
+	for _, peer := range peers {
+		if n := atomic.LoadInt32(&peer.(*countingPeer).removes); n != 1 {
+			t.Errorf("%s got %d removes; want 1", peer.GetURL(), n)
+		}
+	}
+	if max > limit {
+		t.Errorf("%d removes ran at once; want at most %d", max, limit)
+	}
+	if max < 2 {
+		t.Errorf("%d removes ran at once; want them concurrent", max)
+	}
+}
+
+func TestRemoveForgetsLoadInFlight(t *testing.T) {
+	release := make(chan struct{})
+	var loads int32
+	g := newGroup("TestRemoveForgetsLoadInFlight-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			<-release
+			return dest.SetString("stale", time.Time{})
+		}
+		return dest.SetString("fresh", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	stale := make(chan string)
+	go func() {
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+			t.Error(err)
+		}
+		stale <- s
+	}()
+	for g.loadGroup.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := g.Remove(dummyCtx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "fresh" {
+		t.Errorf("Get after Remove = %q; want a new load rather than the one in flight", s)
+	}
+	close(release)
+	if s := <-stale; s != "stale" {
+		t.Errorf("Get started before Remove = %q; want stale", s)
+	}
+
+	// The load that started before Remove did not cache its value.
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "fresh" {
+		t.Errorf("Get after the stale load completed = %q; want fresh", s)
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Errorf("Getter called %d times; want 2", n)
+	}
+}
+
+func TestNoSingleflightFn(t *testing.T) {
+	const n = 4
+	var loads, active int32
+	allActive := make(chan struct{})
+	g := NewGroup("TestNoSingleflightFn-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		load := atomic.AddInt32(&loads, 1)
+		if atomic.AddInt32(&active, 1) == n {
+			close(allActive)
+		}
+		select {
+		case <-allActive:
+		case <-time.After(100 * time.Millisecond):
+		}
+		return dest.SetString(fmt.Sprintf("%s@%d", key, load), time.Time{})
+	}), WithPeerPicker(NoPeers{}), WithNoSingleflightFn(func(key string) bool {
+		return strings.HasPrefix(key, "live:")
+	}))
+	defer DeregisterGroup(g.Name())
+
+	getAll := func(key string) map[string]bool {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		values := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var s string
+				if err := g.Get(dummyCtx, key, StringSink(&s)); err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				values[s] = true
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return values
+	}
+
+	// The n Gets each load the key, all at once.
+	if values := getAll("live:x"); len(values) != n || loads != n {
+		t.Errorf("concurrent Gets of a key without singleflight got %d values from %d loads; want %d from %d", len(values), loads, n, n)
+	}
+	select {
+	case <-allActive:
+	default:
+		t.Error("the loads of a key without singleflight did not run concurrently")
+	}
+	// Its value is still cached.
+	if !g.cached("live:x") {
+		t.Error("value of a key without singleflight not cached")
+	}
+
+	// Other keys share a load.
+	loads = 0
+	if values := getAll("shared"); len(values) != 1 || loads != 1 {
+		t.Errorf("concurrent Gets of a key with singleflight got %d values from %d loads; want 1 from 1", len(values), loads)
+	}
+}
+
+func TestGetDeadlineDuringSharedLoad(t *testing.T) {
+	release := make(chan struct{})
+	g := newGroup("TestGetDeadlineDuringSharedLoad-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		<-release
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	leader := make(chan string)
+	go func() {
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+			t.Error(err)
+		}
+		leader <- s
+	}()
+	for g.loadGroup.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var s string
+	if err := g.Get(ctx, "key", StringSink(&s)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get past its deadline while another load hangs = %v; want context.DeadlineExceeded", err)
+	}
+	close(release)
+	if s := <-leader; s != "value" {
+		t.Errorf("Get leading the load = %q; want value", s)
+	}
+}
+
+// keyPeers is a PeerPicker whose peers own the keys they are listed by.
+type keyPeers map[string]ProtoGetter
+
+func (p keyPeers) PickPeer(key string) (ProtoGetter, bool) {
+	peer, ok := p[key]
+	return peer, ok
+}
+
+func (p keyPeers) GetAll() []ProtoGetter {
+	var peers []ProtoGetter
+	for _, peer := range p {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func TestZeroCacheBytes(t *testing.T) {
+	release := make(chan struct{})
+	var loads int32
+	peer := &fakePeer{}
+	g := newGroup("TestZeroCacheBytes-group", 0, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "slow" {
+			<-release
+		}
+		return dest.SetString(fmt.Sprintf("%s@%d", key, atomic.AddInt32(&loads, 1)), time.Time{})
+	}), keyPeers{"remote": peer})
+	defer DeregisterGroup(g.Name())
+
+	// Every Get loads its key, locally or from its owner.
+	var s string
+	for i := 1; i <= 3; i++ {
+		if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("key@%d", i); s != want {
+			t.Errorf("Get %d = %q; want %q", i, s, want)
+		}
+		if err := g.Get(dummyCtx, "remote", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peer.hits != 3 {
+		t.Errorf("peer hits = %d; want 3", peer.hits)
+	}
+	if n := g.Stats.CacheHits.Get(); n != 0 {
+		t.Errorf("CacheHits = %d; want 0", n)
+	}
+	for _, ct := range []CacheType{MainCache, HotCache} {
+		if stats := g.CacheStats(ct); stats.Items != 0 || stats.Bytes != 0 || stats.Evictions != 0 {
+			t.Errorf("CacheStats(%v) = %+v; want no items, bytes or evictions", ct, stats)
+		}
+	}
+
+	// Concurrent Gets still share a load.
+	loads = 0
+	results := make(chan string)
+	for i := 0; i < 3; i++ {
+		go func() {
+			var s string
+			if err := g.Get(dummyCtx, "slow", StringSink(&s)); err != nil {
+				t.Error(err)
+			}
+			results <- s
+		}()
+	}
+	for g.loadGroup.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // let the other Gets join the load
+	close(release)
+	for i := 0; i < 3; i++ {
+		if s := <-results; s != "slow@1" {
+			t.Errorf("concurrent Get = %q; want slow@1 from a single load", s)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	var loaded []string
+	g := newGroup("TestNamespace-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loaded = append(loaded, key)
+		return dest.SetString("value of "+key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	users, orders := g.Namespace("users:"), g.Namespace("orders:")
+	if users.Group() != g || users.Prefix() != "users:" {
+		t.Errorf("Group, Prefix = %v, %q; want the group, users:", users.Group(), users.Prefix())
+	}
+
+	var s string
+	if err := users.Get(dummyCtx, "42", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "value of users:42" {
+		t.Errorf("users.Get(42) = %q; want %q", s, "value of users:42")
+	}
+	if err := orders.Get(dummyCtx, "42", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "value of orders:42" {
+		t.Errorf("orders.Get(42) = %q; want %q", s, "value of orders:42")
+	}
+	if want := []string{"users:42", "orders:42"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded keys = %q; want %q", loaded, want)
+	}
+
+	// Removing a key of one namespace leaves the other alone.
+	if err := users.Remove(dummyCtx, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if !g.cached("orders:42") || g.cached("users:42") {
+		t.Errorf("after users.Remove(42): cached orders:42, users:42 = %t, %t; want true, false", g.cached("orders:42"), g.cached("users:42"))
+	}
+	if err := g.Get(dummyCtx, "orders:42", StringSink(&s)); err != nil || s != "value of orders:42" || len(loaded) != 2 {
+		t.Errorf("Get(orders:42) on the group = %q, %v after %d loads; want the cached value", s, err, len(loaded))
+	}
+}
+
+func TestEvictionStats(t *testing.T) {
+	expire := time.Time{}
+	g := newGroup("TestEvictionStats-group", 1<<10, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(strings.Repeat("x", 100), expire)
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	for i := 0; i < 50; i++ {
+		if err := g.Get(dummyCtx, fmt.Sprintf("key-%d", i), StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := g.CacheStats(MainCache)
+	if stats.SizeEvictions.Count == 0 {
+		t.Fatal("filling the cache made no size eviction")
+	}
+	var counted int64
+	for _, n := range stats.SizeEvictions.Ages {
+		counted += n
+	}
+	if counted != stats.SizeEvictions.Count {
+		t.Errorf("SizeEvictions.Ages count %d entries; want %d", counted, stats.SizeEvictions.Count)
+	}
+	// The test ran for less than a second.
+	if stats.SizeEvictions.Ages[0] != stats.SizeEvictions.Count {
+		t.Errorf("SizeEvictions.Ages = %v; want all in the first bucket", stats.SizeEvictions.Ages)
+	}
+
+	if err := g.Remove(dummyCtx, "key-49"); err != nil {
+		t.Fatal(err)
+	}
+	expire = time.Now().Add(-time.Second)
+	if err := g.Get(dummyCtx, "expired", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get(dummyCtx, "expired", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = g.CacheStats(MainCache)
+	if stats.RemoveEvictions.Count != 1 || stats.ExpiryEvictions.Count != 1 {
+		t.Errorf("RemoveEvictions, ExpiryEvictions = %d, %d; want 1, 1", stats.RemoveEvictions.Count, stats.ExpiryEvictions.Count)
+	}
+	if total := stats.SizeEvictions.Count + stats.RemoveEvictions.Count + stats.ExpiryEvictions.Count; total != stats.Evictions {
+		t.Errorf("evictions by reason sum to %d; want Evictions = %d", total, stats.Evictions)
+	}
+}
+
+func TestKeyNormalizeFn(t *testing.T) {
+	var loaded []string
+	g := NewGroup("TestKeyNormalizeFn-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loaded = append(loaded, key)
+		return dest.SetString("value of "+key, time.Time{})
+	}), WithPeerPicker(NoPeers{}), WithKeyNormalizeFn(func(key string) string {
+		return strings.ToLower(strings.TrimSpace(key))
+	}))
+	defer DeregisterGroup(g.Name())
+
+	for _, key := range []string{"Key", "key ", " KEY"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if s != "value of key" {
+			t.Errorf("Get(%q) = %q; want %q", key, s, "value of key")
+		}
+	}
+	if !reflect.DeepEqual(loaded, []string{"key"}) {
+		t.Errorf("loaded keys %q; want [\"key\"]", loaded)
+	}
+	if items := g.CacheStats(MainCache).Items; items != 1 {
+		t.Errorf("cache holds %d items; want 1", items)
+	}
+
+	if err := g.Remove(dummyCtx, "KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if items := g.CacheStats(MainCache).Items; items != 0 {
+		t.Errorf("cache holds %d items after Remove; want 0", items)
+	}
+}
+
+func TestDeregisterGroup(t *testing.T) {
+	const name = "TestDeregisterGroup-group"
+	release := make(chan struct{})
+	g := NewGroup(name, cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "slow" {
+			<-release
+		}
+		return dest.SetString(strings.Repeat("x", 1000), time.Time{})
+	}), WithPeerPicker(NoPeers{}))
+	defer DeregisterGroup(name)
+
+	for i := 0; i < 100; i++ {
+		var s string
+		if err := g.Get(dummyCtx, strconv.Itoa(i), StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := g.CacheStats(MainCache); stats.Items != 100 {
+		t.Fatalf("cache holds %d items; want 100", stats.Items)
+	}
+
+	// A Get in progress completes, without caching its value.
+	slow := make(chan error)
+	go func() {
+		var s string
+		slow <- g.Get(dummyCtx, "slow", StringSink(&s))
+	}()
+	for g.activeLoads.Get() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	DeregisterGroup(name)
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("Get in progress during DeregisterGroup = %v; want nil", err)
+	}
+	if stats := g.CacheStats(MainCache); stats.Items != 0 || stats.Bytes != 0 || stats.Evictions != 0 {
+		t.Errorf("deregistered group caches %d items of %d bytes after %d evictions; want none",
+			stats.Items, stats.Bytes, stats.Evictions)
+	}
+	if GetGroup(name) != nil {
+		t.Error("GetGroup returns a deregistered group")
+	}
+
+	var s string
+	if err := g.Get(dummyCtx, "1", StringSink(&s)); !errors.Is(err, ErrGroupDeregistered) {
+		t.Errorf("Get on a deregistered group = %v; want ErrGroupDeregistered", err)
+	}
+	if err := g.Remove(dummyCtx, "1"); !errors.Is(err, ErrGroupDeregistered) {
+		t.Errorf("Remove on a deregistered group = %v; want ErrGroupDeregistered", err)
+	}
+
+	// The name may be taken again.
+	again := NewGroup(name, cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(NoPeers{}))
+	if err := again.Get(dummyCtx, "1", StringSink(&s)); err != nil || s != "1" {
+		t.Errorf("Get on a group of a deregistered name = %q, %v; want \"1\", nil", s, err)
+	}
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	peer := &fakePeer{}
+	g := NewGroup("TestPeerRateLimit-group", 0, getter,
+		WithPeerPicker(keyPeers{"remote": peer}), WithPeerRateLimit(1, 2, false))
+	defer DeregisterGroup(g.Name())
+
+	// The burst is served, then fetches fail until the rate allows them,
+	// without loading the key locally.
+	var s string
+	for i := 0; i < 2; i++ {
+		if err := g.Get(dummyCtx, "remote", StringSink(&s)); err != nil {
+			t.Fatalf("Get %d within the burst: %v", i, err)
+		}
+	}
+	if err := g.Get(dummyCtx, "remote", StringSink(&s)); !errors.Is(err, ErrPeerRateLimited) {
+		t.Errorf("Get beyond the burst = %v; want ErrPeerRateLimited", err)
+	}
+	if peer.hits != 2 {
+		t.Errorf("peer got %d fetches; want 2", peer.hits)
+	}
+	if n := g.Stats.PeerRateLimited.Get(); n != 1 {
+		t.Errorf("Stats.PeerRateLimited = %d; want 1", n)
+	}
+	if n := g.Stats.LocalLoads.Get(); n != 0 {
+		t.Errorf("Stats.LocalLoads = %d; want 0", n)
+	}
+	// Keys owned locally are not limited.
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil || s != "local:key" {
+		t.Errorf("Get of a local key = %q, %v; want local:key", s, err)
+	}
+
+	// A waiting limiter delays fetches, unless their deadline comes first.
+	peer = &fakePeer{}
+	g2 := NewGroup("TestPeerRateLimit-group-wait", 0, getter,
+		WithPeerPicker(keyPeers{"remote": peer}), WithPeerRateLimit(10, 1, true))
+	defer DeregisterGroup(g2.Name())
+	if err := g2.Get(dummyCtx, "remote", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g2.Get(ctx, "remote", StringSink(&s)); !errors.Is(err, ErrPeerRateLimited) {
+		t.Errorf("Get with a deadline before the next token = %v; want ErrPeerRateLimited", err)
+	}
+	start := time.Now()
+	if err := g2.Get(context.Background(), "remote", StringSink(&s)); err != nil {
+		t.Fatalf("waiting Get: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waiting Get took %v; want it to wait for the next token", elapsed)
+	}
+	if peer.hits != 2 {
+		t.Errorf("peer got %d fetches; want 2", peer.hits)
+	}
+	if n := g2.Stats.PeerRateLimited.Get(); n != 2 {
+		t.Errorf("Stats.PeerRateLimited = %d; want 2", n)
+	}
+}
@@ -31,6 +31,8 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 type GetRequest struct {
 	Group            *string `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	Key              *string `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
+	Version          *string `protobuf:"bytes,3,opt,name=version" json:"version,omitempty"`
+	Etag             *string `protobuf:"bytes,4,opt,name=etag" json:"etag,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -53,10 +55,31 @@ func (m *GetRequest) GetKey() string {
 	return ""
 }
 
+func (m *GetRequest) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
+func (m *GetRequest) GetEtag() string {
+	if m != nil && m.Etag != nil {
+		return *m.Etag
+	}
+	return ""
+}
+
 type GetResponse struct {
 	Value            []byte   `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
 	MinuteQps        *float64 `protobuf:"fixed64,2,opt,name=minute_qps,json=minuteQps" json:"minute_qps,omitempty"`
 	Expire           *int64   `protobuf:"varint,3,opt,name=expire" json:"expire,omitempty"`
+	Checksum         *uint32  `protobuf:"fixed32,4,opt,name=checksum" json:"checksum,omitempty"`
+	Version          *string  `protobuf:"bytes,5,opt,name=version" json:"version,omitempty"`
+	Etag             *string  `protobuf:"bytes,6,opt,name=etag" json:"etag,omitempty"`
+	NotModified      *bool    `protobuf:"varint,7,opt,name=not_modified,json=notModified" json:"not_modified,omitempty"`
+	TotalSize        *int64   `protobuf:"varint,8,opt,name=total_size,json=totalSize" json:"total_size,omitempty"`
+	Offset           *int64   `protobuf:"varint,9,opt,name=offset" json:"offset,omitempty"`
+	Nonce            []byte   `protobuf:"bytes,10,opt,name=nonce" json:"nonce,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -86,6 +109,55 @@ func (m *GetResponse) GetExpire() int64 {
 	return 0
 }
 
+func (m *GetResponse) GetChecksum() uint32 {
+	if m != nil && m.Checksum != nil {
+		return *m.Checksum
+	}
+	return 0
+}
+
+func (m *GetResponse) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
+func (m *GetResponse) GetEtag() string {
+	if m != nil && m.Etag != nil {
+		return *m.Etag
+	}
+	return ""
+}
+
+func (m *GetResponse) GetNotModified() bool {
+	if m != nil && m.NotModified != nil {
+		return *m.NotModified
+	}
+	return false
+}
+
+func (m *GetResponse) GetTotalSize() int64 {
+	if m != nil && m.TotalSize != nil {
+		return *m.TotalSize
+	}
+	return 0
+}
+
+func (m *GetResponse) GetOffset() int64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+func (m *GetResponse) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*GetRequest)(nil), "groupcachepb.GetRequest")
 	proto.RegisterType((*GetResponse)(nil), "groupcachepb.GetResponse")
@@ -94,18 +166,25 @@ func init() {
 func init() { proto.RegisterFile("groupcache.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 197 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x48, 0x2f, 0xca, 0x2f,
-	0x2d, 0x48, 0x4e, 0x4c, 0xce, 0x48, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x41, 0x88,
-	0x14, 0x24, 0x29, 0x99, 0x70, 0x71, 0xb9, 0xa7, 0x96, 0x04, 0xa5, 0x16, 0x96, 0xa6, 0x16, 0x97,
-	0x08, 0x89, 0x70, 0xb1, 0x82, 0x65, 0x25, 0x18, 0x15, 0x98, 0x34, 0x38, 0x83, 0x20, 0x1c, 0x21,
-	0x01, 0x2e, 0xe6, 0xec, 0xd4, 0x4a, 0x09, 0x26, 0xb0, 0x18, 0x88, 0xa9, 0x14, 0xc5, 0xc5, 0x0d,
-	0xd6, 0x55, 0x5c, 0x90, 0x9f, 0x57, 0x9c, 0x0a, 0xd2, 0x56, 0x96, 0x98, 0x53, 0x9a, 0x2a, 0xc1,
-	0xa8, 0xc0, 0xa8, 0xc1, 0x13, 0x04, 0xe1, 0x08, 0xc9, 0x72, 0x71, 0xe5, 0x66, 0xe6, 0x95, 0x96,
-	0xa4, 0xc6, 0x17, 0x16, 0x14, 0x4b, 0x30, 0x29, 0x30, 0x6a, 0x30, 0x06, 0x71, 0x42, 0x44, 0x02,
-	0x0b, 0x8a, 0x85, 0xc4, 0xb8, 0xd8, 0x52, 0x2b, 0x0a, 0x32, 0x8b, 0x52, 0x25, 0x98, 0x15, 0x18,
-	0x35, 0x98, 0x83, 0xa0, 0x3c, 0x23, 0x2f, 0x2e, 0x2e, 0x77, 0x90, 0xb5, 0xce, 0x20, 0x17, 0x0a,
-	0xd9, 0x70, 0x31, 0xbb, 0xa7, 0x96, 0x08, 0x49, 0xe8, 0x21, 0xbb, 0x5a, 0x0f, 0xe1, 0x64, 0x29,
-	0x49, 0x2c, 0x32, 0x10, 0x67, 0x29, 0x31, 0x00, 0x02, 0x00, 0x00, 0xff, 0xff, 0xd4, 0x73, 0xe1,
-	0xb8, 0xfe, 0x00, 0x00, 0x00,
+	// 306 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0x3f, 0x6f, 0xf2, 0x30,
+	0x10, 0xc6, 0x5f, 0x27, 0xfc, 0xcb, 0xc1, 0x80, 0xac, 0x57, 0xd5, 0x15, 0xa9, 0x52, 0xca, 0x94,
+	0x89, 0xa1, 0x73, 0xb7, 0x0e, 0x48, 0x95, 0x3a, 0xd4, 0xfd, 0x00, 0x28, 0x84, 0x03, 0x2c, 0xc0,
+	0x36, 0xb1, 0x83, 0x5a, 0x3e, 0x47, 0x3f, 0x70, 0x65, 0x9b, 0x36, 0x0c, 0x6c, 0xfe, 0x3d, 0x1e,
+	0x9e, 0xdf, 0xdd, 0xc1, 0x78, 0x53, 0xeb, 0xc6, 0x54, 0x65, 0xb5, 0xa5, 0x99, 0xa9, 0xb5, 0xd3,
+	0x7c, 0xd4, 0x26, 0x66, 0x39, 0x5d, 0x02, 0xcc, 0xc9, 0x09, 0x3a, 0x36, 0x64, 0x1d, 0xff, 0x0f,
+	0xdd, 0xf0, 0x8b, 0x2c, 0x4f, 0x8a, 0x4c, 0x44, 0xe0, 0x63, 0x48, 0x77, 0xf4, 0x85, 0x49, 0xc8,
+	0xfc, 0x93, 0x23, 0xf4, 0x4f, 0x54, 0x5b, 0xa9, 0x15, 0xa6, 0x39, 0x2b, 0x32, 0xf1, 0x8b, 0x9c,
+	0x43, 0x87, 0x5c, 0xb9, 0xc1, 0x4e, 0x88, 0xc3, 0x7b, 0xfa, 0x9d, 0xc0, 0x30, 0x94, 0x58, 0xa3,
+	0x95, 0x25, 0xdf, 0x72, 0x2a, 0xf7, 0x0d, 0x21, 0xcb, 0x59, 0x31, 0x12, 0x11, 0xf8, 0x03, 0xc0,
+	0x41, 0xaa, 0xc6, 0xd1, 0xe2, 0x68, 0x2c, 0x26, 0x39, 0x2b, 0x98, 0xc8, 0x62, 0xf2, 0x6e, 0x2c,
+	0xbf, 0x83, 0x1e, 0x7d, 0x1a, 0x59, 0x53, 0x68, 0x4c, 0xc5, 0x85, 0xf8, 0x04, 0x06, 0xd5, 0x96,
+	0xaa, 0x9d, 0x6d, 0x0e, 0xa1, 0xb4, 0x2f, 0xfe, 0xf8, 0x5a, 0xb3, 0x7b, 0x5b, 0xb3, 0xd7, 0x6a,
+	0xf2, 0x47, 0x18, 0x29, 0xed, 0x16, 0x07, 0xbd, 0x92, 0x6b, 0x49, 0x2b, 0xec, 0xe7, 0xac, 0x18,
+	0x88, 0xa1, 0xd2, 0xee, 0xed, 0x12, 0x79, 0x47, 0xa7, 0x5d, 0xb9, 0x5f, 0x58, 0x79, 0x26, 0x1c,
+	0x04, 0x91, 0x2c, 0x24, 0x1f, 0xf2, 0x4c, 0xde, 0x51, 0xaf, 0xd7, 0x96, 0x1c, 0x66, 0xd1, 0x31,
+	0x92, 0x1f, 0x58, 0x69, 0x55, 0x11, 0x42, 0x1c, 0x38, 0xc0, 0xd3, 0x2b, 0xc0, 0xdc, 0xef, 0xf7,
+	0xc5, 0x9f, 0x82, 0x3f, 0x43, 0x3a, 0x27, 0xc7, 0x71, 0x76, 0x7d, 0x9e, 0x59, 0x7b, 0x9b, 0xc9,
+	0xfd, 0x8d, 0x9f, 0xb8, 0xd0, 0xe9, 0xbf, 0x9f, 0x01, 0x00, 0x0a, 0xa8, 0x26, 0xdc, 0xe7, 0x01,
+	0x00, 0x00,
 }
@@ -0,0 +1,38 @@
+package groupcachetest_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"accedo.io/groupcache/v2"
+	"accedo.io/groupcache/v2/groupcachetest"
+)
+
+func Example() {
+	cluster := groupcachetest.NewCluster("peer1", "peer2", "peer3")
+	defer cluster.Close()
+
+	err := cluster.NewGroup("users", 64<<20, groupcache.GetterFunc(
+		func(ctx context.Context, key string, dest groupcache.Sink) error {
+			return dest.SetString("user "+key, time.Time{})
+		}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Get a key owned by another peer from peer1.
+	key := "12"
+	owner := cluster.Owner(key)
+	var user string
+	source, err := cluster.Peer("peer1").Group("users").GetWithInfo(context.Background(), key, groupcache.StringSink(&user))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%q owned by %s: %q from %v\n", key, owner.URL(), user, source)
+	fmt.Println("loads by the owner:", owner.Group("users").Stats.LocalLoads.Get())
+	// Output:
+	// "12" owned by peer3: "user 12" from peer
+	// loads by the owner: 1
+}
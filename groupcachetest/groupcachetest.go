@@ -0,0 +1,279 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package groupcachetest provides in-process peers for testing groups
+// spread over several peers without HTTP servers: the peers of a Cluster
+// call the groups of one another directly, with the latency and failures
+// set on them.
+package groupcachetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"accedo.io/groupcache/v2"
+	"accedo.io/groupcache/v2/consistenthash"
+	pb "accedo.io/groupcache/v2/groupcachepb"
+)
+
+// replicas is the number of replicas of each peer on the ring, the
+// default of HTTPPool.
+const replicas = 50
+
+// ErrPeerDown is an error to pass to Peer.SetError, for peers that are
+// down.
+var ErrPeerDown = errors.New("groupcachetest: peer down")
+
+// A Cluster is a set of in-process peers, each with its own groups,
+// owning keys as an HTTPPool with default options would.
+type Cluster struct {
+	peers map[string]*Peer
+	urls  []string // sorted
+	ring  *consistenthash.Map
+
+	mu     sync.Mutex
+	groups map[string]string // names of the groups of the peers, by the name of their group
+}
+
+// NewCluster returns a cluster of peers of the given URLs, which only
+// name the peers, e.g. "peer1".
+func NewCluster(urls ...string) *Cluster {
+	c := &Cluster{
+		peers:  make(map[string]*Peer, len(urls)),
+		ring:   consistenthash.New(replicas, nil),
+		groups: make(map[string]string),
+	}
+	for _, url := range urls {
+		if _, ok := c.peers[url]; ok {
+			continue
+		}
+		c.peers[url] = &Peer{cluster: c, url: url, groups: make(map[string]*groupcache.Group)}
+		c.urls = append(c.urls, url)
+	}
+	sort.Strings(c.urls)
+	c.ring.Add(c.urls...)
+	return c
+}
+
+// Peer returns the peer of the given URL, or nil if there is none.
+func (c *Cluster) Peer(url string) *Peer {
+	return c.peers[url]
+}
+
+// Peers returns the peers of the cluster, sorted by URL.
+func (c *Cluster) Peers() []*Peer {
+	peers := make([]*Peer, len(c.urls))
+	for i, url := range c.urls {
+		peers[i] = c.peers[url]
+	}
+	return peers
+}
+
+// Owner returns the peer owning key.
+func (c *Cluster) Owner(key string) *Peer {
+	return c.peers[c.ring.Get(key)]
+}
+
+// NewGroup creates a group of the given name on each peer, which loads
+// keys with getter. The groups are registered as "name@url", as groups
+// of the same name cannot coexist in a process; Peer.Group returns them
+// by name. opts may not include WithPeerPicker.
+func (c *Cluster) NewGroup(name string, cacheBytes int64, getter groupcache.Getter, opts ...groupcache.GroupOption) error {
+	for _, url := range c.urls {
+		peer := c.peers[url]
+		groupOpts := append(append([]groupcache.GroupOption(nil), opts...), groupcache.WithPeerPicker(newPicker(peer)))
+		g, err := groupcache.TryNewGroup(name+"@"+url, cacheBytes, getter, groupOpts...)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.groups[g.Name()] = name
+		peer.groups[name] = g
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Close deregisters the groups of the peers.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.groups {
+		groupcache.DeregisterGroup(name)
+	}
+	c.groups = make(map[string]string)
+	for _, peer := range c.peers {
+		peer.groups = make(map[string]*groupcache.Group)
+	}
+}
+
+// A Peer is an in-process peer of a Cluster.
+type Peer struct {
+	cluster *Cluster
+	url     string
+	groups  map[string]*groupcache.Group // guarded by cluster.mu
+
+	mu      sync.Mutex
+	latency time.Duration
+	err     error
+}
+
+// URL returns the URL of the peer.
+func (p *Peer) URL() string {
+	return p.url
+}
+
+// Group returns the group of the given name of the peer, as created by
+// Cluster.NewGroup, or nil if there is none.
+func (p *Peer) Group(name string) *groupcache.Group {
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+	return p.groups[name]
+}
+
+// SetLatency delays the requests of the other peers to this one by d,
+// unless their context is done first.
+func (p *Peer) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	p.latency = d
+	p.mu.Unlock()
+}
+
+// SetError makes the requests of the other peers to this one fail with
+// err, as if it were down. A nil err makes them succeed again.
+func (p *Peer) SetError(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+// serve waits for the latency of the peer, and returns the group the
+// request of another peer is for.
+func (p *Peer) serve(ctx context.Context, in *pb.GetRequest) (*groupcache.Group, error) {
+	p.mu.Lock()
+	latency, err := p.latency, p.err
+	p.mu.Unlock()
+
+	if latency > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+	g := p.groups[p.cluster.groups[in.GetGroup()]]
+	if g == nil {
+		return nil, fmt.Errorf("groupcachetest: peer %s has no group %q", p.url, in.GetGroup())
+	}
+	return g, nil
+}
+
+// getter is a ProtoGetter calling a peer directly.
+type getter struct {
+	peer *Peer
+}
+
+func (g getter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	group, err := g.peer.serve(ctx, in)
+	if err != nil {
+		return err
+	}
+	return group.ServeGet(ctx, in, out)
+}
+
+func (g getter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	group, err := g.peer.serve(ctx, in)
+	if err != nil {
+		return err
+	}
+	return group.ServeRemove(ctx, in)
+}
+
+func (g getter) Set(ctx context.Context, in *pb.GetRequest, value *pb.GetResponse) error {
+	group, err := g.peer.serve(ctx, in)
+	if err != nil {
+		return err
+	}
+	return group.ServeSet(ctx, in, value)
+}
+
+func (g getter) GetURL() string {
+	return g.peer.url
+}
+
+// picker is the PeerPicker of the groups of a peer.
+type picker struct {
+	cluster *Cluster
+	self    string
+	getters map[string]groupcache.ProtoGetter // of the other peers
+}
+
+func newPicker(self *Peer) *picker {
+	p := &picker{
+		cluster: self.cluster,
+		self:    self.url,
+		getters: make(map[string]groupcache.ProtoGetter),
+	}
+	for url, peer := range self.cluster.peers {
+		if url != self.url {
+			p.getters[url] = getter{peer}
+		}
+	}
+	return p
+}
+
+func (p *picker) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	owner := p.cluster.ring.Get(key)
+	if owner == p.self {
+		return nil, false
+	}
+	g, ok := p.getters[owner]
+	return g, ok
+}
+
+func (p *picker) PickPeers(key string, n int) []groupcache.ProtoGetter {
+	owners := p.cluster.ring.GetN(key, n)
+	peers := make([]groupcache.ProtoGetter, len(owners))
+	for i, owner := range owners {
+		peers[i] = p.getters[owner] // nil for self
+	}
+	return peers
+}
+
+func (p *picker) GetAll() []groupcache.ProtoGetter {
+	peers := make([]groupcache.ProtoGetter, 0, len(p.getters))
+	for _, url := range p.cluster.urls {
+		if g, ok := p.getters[url]; ok {
+			peers = append(peers, g)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcachetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"accedo.io/groupcache/v2"
+)
+
+func newTestCluster(t *testing.T, name string, opts ...groupcache.GroupOption) *Cluster {
+	c := NewCluster("peer1", "peer2", "peer3")
+	t.Cleanup(c.Close)
+	err := c.NewGroup(name, 1<<20, groupcache.GetterFunc(func(_ context.Context, key string, dest groupcache.Sink) error {
+		return dest.SetString("value of "+key, time.Time{})
+	}), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// remoteKey returns a key that from is not the owner of.
+func remoteKey(c *Cluster, from *Peer) string {
+	for i := 0; ; i++ {
+		if key := strconv.Itoa(i); c.Owner(key) != from {
+			return key
+		}
+	}
+}
+
+func TestClusterGet(t *testing.T) {
+	c := newTestCluster(t, "TestClusterGet")
+	from := c.Peer("peer1")
+	key := remoteKey(c, from)
+	owner := c.Owner(key).Group("TestClusterGet")
+
+	for _, want := range []groupcache.CacheHitSource{groupcache.SourcePeer, groupcache.SourceHotCache} {
+		var s string
+		source, err := from.Group("TestClusterGet").GetWithInfo(context.Background(), key, groupcache.StringSink(&s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != "value of "+key || source != want {
+			t.Errorf("GetWithInfo = %q from %v; want %q from %v", s, source, "value of "+key, want)
+		}
+	}
+	if n := owner.Stats.LocalLoads.Get(); n != 1 {
+		t.Errorf("owner loaded the key %d times; want 1", n)
+	}
+
+	// Removing the key clears it from the owner too.
+	if err := from.Group("TestClusterGet").Remove(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if n := owner.CacheStats(groupcache.MainCache).Items; n != 0 {
+		t.Errorf("owner has %d items after Remove; want 0", n)
+	}
+}
+
+func TestPeerSetError(t *testing.T) {
+	c := newTestCluster(t, "TestPeerSetError")
+	from := c.Peer("peer1")
+	key := remoteKey(c, from)
+	c.Owner(key).SetError(ErrPeerDown)
+
+	// The key is loaded locally when its owner is down.
+	var s string
+	source, err := from.Group("TestPeerSetError").GetWithInfo(context.Background(), key, groupcache.StringSink(&s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != groupcache.SourceLocal {
+		t.Errorf("GetWithInfo with the owner down = %v; want %v", source, groupcache.SourceLocal)
+	}
+	if n := from.Group("TestPeerSetError").Stats.PeerErrors.Get(); n != 1 {
+		t.Errorf("PeerErrors = %d; want 1", n)
+	}
+
+	err = from.Group("TestPeerSetError").Remove(context.Background(), key)
+	if !errors.Is(err, ErrPeerDown) {
+		t.Errorf("Remove with the owner down = %v; want %v", err, ErrPeerDown)
+	}
+}
+
+func TestPeerSetLatency(t *testing.T) {
+	c := newTestCluster(t, "TestPeerSetLatency")
+	from := c.Peer("peer1")
+	key := remoteKey(c, from)
+	c.Owner(key).SetLatency(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var s string
+	if err := from.Group("TestPeerSetLatency").Get(ctx, key, groupcache.StringSink(&s)); err == nil {
+		t.Error("Get from a slow owner succeeded before its deadline")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Get from a slow owner took %v despite its deadline", d)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	c := newTestCluster(t, "TestReadRepair", groupcache.WithReadRepair(100, time.Millisecond, 10*time.Millisecond))
+	from := c.Peer("peer1")
+	key := remoteKey(c, from)
+	owner := c.Owner(key)
+	owner.SetError(ErrPeerDown)
+
+	var s string
+	if err := from.Group("TestReadRepair").Get(context.Background(), key, groupcache.StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the owner recovers, the value is pushed back to it.
+	owner.SetError(nil)
+	stats := &from.Group("TestReadRepair").Stats
+	for deadline := time.Now().Add(5 * time.Second); stats.ReadRepairs.Get() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("value not pushed back to the owner; ReadRepairErrors = %d", stats.ReadRepairErrors.Get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := owner.Group("TestReadRepair").CacheStats(groupcache.MainCache).Items; n != 1 {
+		t.Errorf("owner has %d items after the read repair; want 1", n)
+	}
+	if err := owner.Group("TestReadRepair").Get(context.Background(), key, groupcache.StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "value of "+key {
+		t.Errorf("owner Get = %q; want %q", s, "value of "+key)
+	}
+	if n := owner.Group("TestReadRepair").Stats.LocalLoads.Get(); n != 0 {
+		t.Errorf("owner loaded the key %d times; want 0", n)
+	}
+}
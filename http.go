@@ -17,14 +17,27 @@ limitations under the License.
 package groupcache
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -41,6 +54,22 @@ type GroupNotFoundError struct {
 	group string
 }
 
+type MethodNotAllowedError struct {
+	method string
+}
+
+type UnexpectedPathError struct {
+	path string
+}
+
+// LoadTimeoutError is passed to ServerErrorHandler when loading a value
+// takes longer than MaxLoadDuration.
+type LoadTimeoutError struct {
+	Group   string
+	Key     string
+	Timeout time.Duration
+}
+
 type RemoteLoadError struct {
 	Group string
 	Key   string
@@ -49,12 +78,153 @@ type RemoteLoadError struct {
 	Status     string
 	Body       []byte
 	Err        error
+
+	// RequestID is the ID of the request sent to the peer, which the peer
+	// includes in its logs.
+	RequestID string
+
+	// RetryAfter is how long the peer asked to wait before retrying, from
+	// the Retry-After header of a 429 or 503 response. It is zero if the
+	// peer did not ask, or the header could not be parsed.
+	RetryAfter time.Duration
+}
+
+// ErrPeerSaturated is returned when a request to a peer cannot be made
+// because MaxConcurrentPerPeer requests are already in flight and
+// FailFastWhenSaturated is set.
+var ErrPeerSaturated = errors.New("groupcache: peer saturated")
+
+// ErrChecksumMismatch is returned when a peer response does not match its
+// checksum, e.g. because it was corrupted in transit, and neither does
+// the response to the request retried once.
+var ErrChecksumMismatch = errors.New("groupcache: checksum mismatch")
+
+// ErrResponseTooLarge is returned when the response of a peer is larger
+// than MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("groupcache: peer response too large")
+
+// ErrServerOverloaded is passed to ServerErrorHandler when a request is
+// shed because MaxServerConcurrency or MaxConcurrentLoads was reached.
+// DefaultServerErrorHandler answers it with 429 Too Many Requests.
+var ErrServerOverloaded = errors.New("groupcache: server overloaded")
+
+// ErrUndecodableResponse is returned when the response of a peer cannot
+// be decoded, e.g. because it runs a release with another wire format
+// during a rolling deploy.
+var ErrUndecodableResponse = errors.New("groupcache: undecodable peer response")
+
+// undecodableError is an ErrUndecodableResponse caused by err, while
+// decoding what.
+type undecodableError struct {
+	what string
+	err  error
+}
+
+func (e undecodableError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrUndecodableResponse, e.what, e.err)
+}
+
+func (e undecodableError) Is(target error) bool {
+	return target == ErrUndecodableResponse
+}
+
+func (e undecodableError) Unwrap() error {
+	return e.err
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Capabilities is a bitmask of the protocol features supported by a peer.
+// Peers exchange their capabilities in the X-Groupcache-Capabilities header
+// of every request and response, and only use the features supported by
+// both sides. Unknown capabilities are ignored.
+type Capabilities uint64
+
+const (
+	// CapChecksum indicates support for the checksum of values.
+	CapChecksum Capabilities = 1 << iota
+
+	// CapChunked indicates support for large values sent in chunks.
+	CapChunked
+)
+
+// supportedCapabilities are the capabilities of this version.
+const supportedCapabilities = CapChecksum | CapChunked
+
+const capabilitiesHeader = "X-Groupcache-Capabilities"
+
+// priorityHeader carries the priority of requests that are not
+// PriorityHigh, e.g. "low".
+const priorityHeader = "X-Groupcache-Priority"
+
+// cacheOnlyHeader makes peers answer GET requests for values they do not
+// have cached with 404 Not Found rather than load them.
+const cacheOnlyHeader = "X-Groupcache-Cache-Only"
+
+// notFoundHeader tells what a 404 Not Found answer did not find: "key"
+// for a key that is not cached, as opposed to a missing group or path.
+const notFoundHeader = "X-Groupcache-Not-Found"
+
+// metadataHeaderPrefix prefixes the headers carrying the metadata given
+// by HTTPPoolOptions.ContextToMetadata.
+const metadataHeaderPrefix = "X-Groupcache-Meta-"
+
+// requestIDHeader carries the ID of requests to peers.
+const requestIDHeader = "X-Groupcache-Request-Id"
+
+// expireHeader carries the expiry of the value, in nanoseconds since
+// the epoch, in the responses to GET and HEAD requests for a value that
+// expires, including 304 Not Modified ones, which have no body.
+const expireHeader = "X-Groupcache-Expire"
+
+// versionHeader carries the version of the value to remove in DELETE
+// requests. Peers that predate it remove the value regardless.
+const versionHeader = "X-Groupcache-Version"
+
+// Has returns whether c includes all the capabilities in o.
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+// parseCapabilities parses the capabilities header value v. Peers that
+// predate capabilities, or send a malformed value, support none.
+func parseCapabilities(v string) Capabilities {
+	c, err := strconv.ParseUint(v, 16, 64)
+	if err != nil {
+		return 0
+	}
+	return Capabilities(c)
+}
+
+func (c Capabilities) String() string {
+	return strconv.FormatUint(uint64(c), 16)
 }
 
 const defaultBasePath = "/_groupcache/"
 
 const defaultReplicas = 50
 
+// allowedMethods lists the HTTP methods served by HTTPPool, as reported
+// in the Allow header of 405 responses.
+const allowedMethods = "GET, HEAD, PUT, DELETE"
+
+const defaultMaxPooledBufferBytes = 64 << 10
+
+const defaultChunkBytes = 1 << 20
+
+const defaultMaxResponseBytes = 1 << 30
+
+// chunkedContentType is the content type of responses holding a value
+// in chunks: a sequence of GetResponse messages, each preceded by its
+// length as a uvarint.
+const chunkedContentType = "application/x-groupcache-chunked"
+
+// rebalanceChurnSamples is the number of keys sampled to estimate the
+// churn reported to HTTPPoolOptions.OnRebalance.
+const rebalanceChurnSamples = 10000
+
+var defaultRemoveStatusCodes = []int{http.StatusOK, http.StatusNoContent, http.StatusNotFound}
+
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
@@ -63,14 +233,61 @@ type HTTPPool struct {
 	// opts specifies the options.
 	opts HTTPPoolOptions
 
-	mu          sync.Mutex // guards peers and httpGetters
-	peers       *consistenthash.Map
-	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	mu      sync.RWMutex // guards peers and getters
+	peers   *consistenthash.Map
+	getters map[string]ProtoGetter // keyed by e.g. "http://10.0.0.2:8008"
+
+	// picks is the frozen ring and getters that PickPeer, PickPeerHashed
+	// and PickPeers read without locking, published whenever they change.
+	picks atomic.Pointer[peerPicks]
+
+	unexpectedPathOnce sync.Once
+
+	// serverSem holds a token for each GET request being served when
+	// MaxServerConcurrency is set; nil means no limit.
+	serverSem chan struct{}
+
+	// loadSem holds a token for each load started by ServeHTTP when
+	// MaxConcurrentLoads is set; nil means no limit.
+	loadSem     chan struct{}
+	queuedLoads AtomicInt
+	shedLoads   AtomicInt
+
+	// rejectedMethods counts the requests rejected for their HTTP method
+	// that are for no group, and so counted by none.
+	rejectedMethods AtomicInt
+
+	// cipher encrypts the values served when EncryptionKeys is set.
+	cipher *valueCipher
+
+	// migrating is set between BeginMigration and CompleteMigration, when
+	// prevPeers holds the peers before the migration and prevGetters the
+	// getters of those that are no longer peers.
+	// migrationGen counts the migrations begun, so that the timer of
+	// MigrationWindow only completes its own.
+	migrating      bool
+	prevPeers      *consistenthash.Map
+	prevGetters    map[string]ProtoGetter
+	migrationTimer *time.Timer
+	migrationGen   uint64
+
+	// transport is the transport the pool created to reach peers with
+	// the connection settings of its options, if any.
+	transport *http.Transport
+
+	// selfMissing is set while the peers do not include self, so that
+	// SelfNotInPeers is not called on every Set.
+	selfMissing atomic.Bool
+
+	registered bool // whether the pool is the registered PeerPicker
+	closed     bool
 }
 
 // HTTPPoolOptions are the configurations of a HTTPPool.
 type HTTPPoolOptions struct {
 	// BasePath specifies the HTTP path that will serve groupcache requests.
+	// It is given a single leading and trailing slash, e.g. "_groupcache"
+	// becomes "/_groupcache/".
 	// If blank, it defaults to "/_groupcache/".
 	BasePath string
 
@@ -78,27 +295,358 @@ type HTTPPoolOptions struct {
 	// If blank, it defaults to 50.
 	Replicas int
 
-	// HashFn specifies the hash function of the consistent hash.
-	// If blank, it defaults to crc32.ChecksumIEEE.
+	// HashFn specifies the 64-bit hash function of the consistent hash.
+	// A 32-bit hash function may be used through consistenthash.Hash32.
+	// If blank, it defaults to the 64-bit FNV-1 hash, or to
+	// consistenthash.XXHash64 if XXHash is set. Tests asserting which peer
+	// owns a key may use consistenthash.StableHash, whose placement does
+	// not change between releases, and consistenthash.Ownership.
 	HashFn consistenthash.Hash
 
+	// XXHash makes HashFn default to consistenthash.XXHash64, which spreads
+	// keys more evenly than FNV-1 with many peers and replicas. It moves
+	// most keys to a different owner, so to migrate, enable it on all
+	// peers in the same deploy and expect a burst of misses while caches
+	// refill. While peers disagree on the hash, a key may be loaded by
+	// more than one of them.
+	XXHash bool
+
+	// HashSeed optionally mixes a seed into the consistent hash, so that
+	// the peers own other keys than with another seed, e.g. to keep two
+	// clusters sharing peer names from sharing their placement; see
+	// consistenthash.NewSeeded. All peers must use the same seed. If zero,
+	// the placement is that of an unseeded hash.
+	HashSeed uint64
+
+	// ReplicaKeyFunc optionally makes the data hashed into the points of
+	// the replicas of the peers on the consistent hash, e.g. to place them
+	// like another consistent hash does; see
+	// consistenthash.SetReplicaKeyFunc. If nil, it defaults to
+	// consistenthash.DefaultReplicaKey.
+	ReplicaKeyFunc consistenthash.ReplicaKeyFunc
+
+	// Ketama places keys on the peers like libketama, the consistent hash
+	// of many memcached clients, so that both agree on the owner of each
+	// key, e.g. while migrating from a ketama sharder. The ketama name of
+	// each peer is the "host:port" of its URL, so the peers must be given
+	// as URLs with the host and port the ketama servers are named with,
+	// e.g. "http://10.0.0.1:11211" for the server "10.0.0.1:11211". Each
+	// peer has consistenthash.KetamaPoints points times its share of the
+	// weights given to SetWeighted. Replicas is then unused, and HashFn,
+	// XXHash, HashSeed and ReplicaKeyFunc must not be set.
+	Ketama bool
+
+	// LoadFactor optionally enables consistent hashing with bounded loads:
+	// PickPeer then skips the peers whose requests in flight from this
+	// peer would exceed LoadFactor times the average, for the next one on
+	// the ring, e.g. 1.25. This peer counts as having none, as its loads
+	// are local. It must be greater than 1.
+	// If zero, keys always go to their owner.
+	LoadFactor float64
+
 	// Transport optionally specifies an http.RoundTripper for the client
 	// to use when it makes a request.
 	// If nil, the client uses http.DefaultTransport.
 	Transport func(context.Context) http.RoundTripper
 
+	// PeerTransport optionally specifies a function returning the
+	// http.RoundTripper to reach the peer at peerURL, as normalized by
+	// Set, in place of Transport, e.g. with other timeouts or a proxy for
+	// a peer across a WAN link. It is called once per peer when Set adds
+	// it, and may return nil to use Transport. The idle connections of the
+	// transports it returns are closed when their peer is removed.
+	PeerTransport func(peerURL string) http.RoundTripper
+
+	// MaxIdleConns, MaxIdleConnsPerHost, MaxConnsPerHost and IdleConnTimeout
+	// optionally tune the connections to peers, as the fields of the same
+	// name of http.Transport. When any is set and Transport is nil, the
+	// client uses a copy of http.DefaultTransport with these settings.
+	// They are ignored if Transport is set.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
 	// Context optionally specifies a context for the server to use when it
-	// receives a request.
+	// receives a request. Values are loaded with a context that is not
+	// cancelled along with it, unless the group was made with
+	// WithCancelOnDisconnect.
 	// If nil, uses the http.Request.Context()
 	Context func(*http.Request) context.Context
 
 	// ServerErrorHandler optionally specifies a function that will serialize the error that occurred during the remote load and forward it to the requesting
 	// peer. It may be deserialized on the peer side using a custom PeerErrorHandler if needed.
 	ServerErrorHandler func(context.Context, http.ResponseWriter, *http.Request, error)
+
+	// MaxConcurrentPerPeer optionally limits the number of requests that
+	// may be in flight to a single peer at once.
+	// If zero, there is no limit.
+	MaxConcurrentPerPeer int
+
+	// FailFastWhenSaturated makes requests to a peer that already has
+	// MaxConcurrentPerPeer requests in flight fail with ErrPeerSaturated
+	// instead of waiting for a slot or for the context to be done.
+	FailFastWhenSaturated bool
+
+	// MaxServerConcurrency optionally limits the number of GET requests
+	// from peers that may be served at once. Once reached, high priority
+	// requests wait for a slot, taking it before any low priority one,
+	// and low priority requests are answered with ErrServerOverloaded, a
+	// 429 Too Many Requests by default. If zero, there is no limit.
+	MaxServerConcurrency int
+
+	// MaxLoadDuration optionally limits how long the server may spend
+	// loading a value requested by a peer, whether or not the peer is still
+	// waiting for it. Loads exceeding it are cancelled, and the request is
+	// answered with a LoadTimeoutError, a 504 Gateway Timeout by default.
+	// If zero, there is no limit.
+	MaxLoadDuration time.Duration
+
+	// MaxConcurrentLoads optionally limits the number of values requested
+	// by peers that may be loading at once, whether from the Getter of
+	// the group or from another peer. Requests for cached values do not
+	// count against it. Once reached, requests wait for a load to
+	// complete, or for their context to be done.
+	// If zero, there is no limit.
+	MaxConcurrentLoads int
+
+	// ShedExcessLoads makes requests that would exceed MaxConcurrentLoads
+	// be answered with ErrServerOverloaded, a 429 Too Many Requests by
+	// default, instead of waiting.
+	ShedExcessLoads bool
+
+	// RemoveStatusCodes specifies the response status codes that a peer
+	// may answer a remove request with for it to be considered successful.
+	// If nil, it defaults to 200, 204 and 404. A 404 Not Found is only
+	// successful if the peer tells it did not find the key, rather than
+	// the group, with the X-Groupcache-Not-Found header set to "key".
+	RemoveStatusCodes []int
+
+	// PanicOnUnexpectedPath makes ServeHTTP panic when it receives a request
+	// outside of BasePath instead of answering it with a 404. This may help
+	// catch a misconfigured handler during development.
+	PanicOnUnexpectedPath bool
+
+	// MaxPooledBufferBytes specifies the capacity above which buffers used to
+	// read peer responses are dropped rather than reused, so that a few large
+	// responses do not pin memory.
+	// If zero, it defaults to 64KB.
+	MaxPooledBufferBytes int
+
+	// MaxResponseBytes specifies the size above which the responses of
+	// peers are rejected with ErrResponseTooLarge rather than read, so
+	// that a misbehaving peer cannot exhaust the memory. For values sent
+	// in chunks, it applies to the value. It also bounds the values that
+	// peers push to this one, with WithReadRepair.
+	// If zero, it defaults to 1GB.
+	MaxResponseBytes int64
+
+	// ChunkBytes specifies the size above which values are sent to peers
+	// in chunks of that size, so that neither side holds a copy of the
+	// whole response besides the value. Values are only sent in chunks to
+	// peers advertising CapChunked.
+	// If zero, it defaults to 1MB.
+	ChunkBytes int
+
+	// IsSelf optionally specifies a function reporting whether the peer URL,
+	// as normalized by Set, designates this peer. This allows a peer to have
+	// several addresses, e.g. behind a load balancer or both IPv4 and IPv6.
+	// If nil, only the self URL given to NewHTTPPool designates this peer.
+	IsSelf func(peer string) bool
+
+	// KeyTagFunc optionally maps keys to the part of them that picks their
+	// peer, so that related keys live on the same peer, e.g. HashTag. Keys
+	// are still cached under their full name.
+	// If nil, the whole key picks the peer.
+	KeyTagFunc func(key string) string
+
+	// SelfNotInPeers optionally specifies a function called when the peers
+	// given to Set no longer include self, in which case this peer cannot
+	// recognize the keys it owns. It is called again only once self was
+	// back among the peers. If nil, a warning is logged instead.
+	SelfNotInPeers func(self string, peers []string)
+
+	// VerifyChecksums makes the client verify the checksum of the values
+	// returned by peers, if they send one.
+	VerifyChecksums bool
+
+	// EncryptionKeys optionally makes the pool encrypt the values it
+	// serves to peers with AES-GCM and the first key, independently of
+	// any TLS, and decrypt those it gets from peers with any of the keys,
+	// rejecting those that were not encrypted or were tampered with. Keys
+	// must be 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256,
+	// and all peers must have them. To rotate keys, add the new key last
+	// on all peers, then move it first, then remove the old one.
+	// The etags and checksums of encrypted values are then computed so as
+	// not to reveal anything about the values either.
+	EncryptionKeys [][]byte
+
+	// ContextToMetadata optionally specifies a function returning the
+	// metadata of ctx, such as a tenant ID or trace baggage, to forward
+	// to peers along with the requests made with ctx. Each entry is sent
+	// in an X-Groupcache-Meta-<key> header, so keys must only contain
+	// letters, digits and hyphens, and are not case sensitive; the others
+	// are dropped. Values are escaped and may contain any byte.
+	ContextToMetadata func(ctx context.Context) map[string]string
+
+	// MetadataToContext optionally specifies a function returning a copy
+	// of ctx carrying the metadata forwarded by the peer, with lowercase
+	// keys. The server calls it, whether or not the request carries
+	// metadata, before loading the value with the returned context.
+	MetadataToContext func(ctx context.Context, md map[string]string) context.Context
+
+	// GetterFactory optionally specifies the function Set uses to make
+	// the ProtoGetter of each peer, given its normalized URL without
+	// BasePath, e.g. to reach peers over another transport. The other
+	// client options only apply to the default HTTP getters, and
+	// PeerStats only reports the stats of those.
+	// If nil, peers are reached over HTTP at their URL and BasePath.
+	GetterFactory func(peerURL string) ProtoGetter
+
+	// Logger optionally specifies the Logger receiving the diagnostics of
+	// the pool, also passed to ServerErrorHandler through its context.
+	// If nil, they go to the logger given to SetLogger, if any.
+	Logger Logger
+
+	// OnRebalance optionally specifies a function called when Set replaces
+	// the peers, with the estimated fraction of the keys that changed owner
+	// and whose cached copies are thus cold on their new owner. It is not
+	// called on the first Set.
+	OnRebalance func(churn float64)
+
+	// OnPeersChanged optionally specifies a function called, outside of the
+	// pool's lock, when Set, SetWeighted or BeginMigration changes the
+	// members of the ring, with the sorted peers added and removed. On the
+	// first Set every peer is added. It is not called when the members stay
+	// the same.
+	OnPeersChanged func(added, removed []string)
+
+	// MigrationWindow optionally bounds how long BeginMigration keeps the
+	// previous peers around: CompleteMigration is called once it elapsed.
+	// If zero, the migration lasts until CompleteMigration is called.
+	MigrationWindow time.Duration
+}
+
+// PoolStats are the statistics of the requests served by an HTTPPool.
+type PoolStats struct {
+	ActiveLoads int64 // values requested by peers being loaded
+	QueuedLoads int64 // requests waiting for MaxConcurrentLoads to allow their load
+	ShedLoads   int64 // requests rejected because MaxConcurrentLoads was reached
+
+	// RejectedMethods counts the requests for groups that do not exist
+	// rejected for their HTTP method, those for a group being counted
+	// by its Stats.ServerRejectedMethods.
+	RejectedMethods int64
+}
+
+// PeerStats are per-peer statistics of an HTTPPool.
+type PeerStats struct {
+	InFlight int64 // requests currently in flight to the peer
+
+	// Capabilities last advertised by the peer, zero until it answered
+	// a request.
+	Capabilities Capabilities
+
+	// Latency of the requests to the peer, from sending them to
+	// receiving the response headers. Failed requests are left out.
+	Latency LatencyStats
+}
+
+// RingInfo describes the consistent hash of an HTTPPool, e.g. to check
+// whether keys are skewed towards some peers.
+type RingInfo struct {
+	Members  []string       // peer URLs on the ring, sorted
+	Replicas map[string]int // points of each peer on the ring
+
+	// Distribution is the estimated fraction of the keys owned by each
+	// peer, from the owners of ringInfoSamples pseudo-random keys.
+	Distribution map[string]float64
+}
+
+// RingSnapshot is the state of the consistent hash of an HTTPPool, as
+// returned by RingSnapshot, from which NewHTTPPoolFromSnapshot makes a
+// pool placing keys on the same peers, e.g. to investigate the placement
+// of a running peer in a test. It may be encoded as JSON.
+type RingSnapshot struct {
+	Self     string `json:"self"`
+	BasePath string `json:"basePath"`
+	XXHash   bool   `json:"xxHash,omitempty"`
+
+	// Ring holds the Replicas, HashSeed and Ketama options of the pool,
+	// and the peer URLs on the ring with their replicas.
+	Ring consistenthash.Snapshot `json:"ring"`
+}
+
+// ringInfoSamples is the number of keys sampled by RingInfo.
+const ringInfoSamples = 10000
+
+// latencyBuckets are the upper bounds of the buckets of LatencyStats.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+// LatencyStats is a histogram of request latencies.
+type LatencyStats struct {
+	Count    int64
+	Min, Max time.Duration
+	Total    time.Duration
+
+	// buckets counts the latencies up to each of latencyBuckets, then
+	// the longer ones.
+	buckets [len(latencyBuckets) + 1]int64
+}
+
+// Mean returns the mean latency, or zero if there is none.
+func (s LatencyStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// Percentile returns an upper bound of the latency under which are p
+// percent of the requests, e.g. 99 for the 99th percentile, or zero if
+// there is none. It is accurate to a bucket of the histogram, whose
+// bounds go from 1ms to 10s in 1, 2, 5 steps, and at most Max.
+func (s LatencyStats) Percentile(p float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(s.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range s.buckets[:len(latencyBuckets)] {
+		seen += n
+		if seen >= rank {
+			if latencyBuckets[i] < s.Max {
+				return latencyBuckets[i]
+			}
+			break
+		}
+	}
+	return s.Max
+}
+
+func (s *LatencyStats) add(d time.Duration) {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Total += d
+	s.buckets[sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })]++
 }
 
 // NewHTTPPool initializes an HTTP pool of peers, and registers itself as a PeerPicker.
 // For convenience, it also registers itself as an http.Handler with http.DefaultServeMux.
+// See NewHTTPPoolOpts to make several pools.
 // The self argument should be a valid base URL that points to the current server,
 // for example "http://example.net:8000".
 func NewHTTPPool(self string) *HTTPPool {
@@ -107,241 +655,1909 @@ func NewHTTPPool(self string) *HTTPPool {
 	return p
 }
 
-var httpPoolMade bool
+var (
+	httpPoolsMu sync.Mutex
+	httpPools   = make(map[string]*HTTPPool) // keyed by BasePath
+)
 
 // NewHTTPPoolOpts initializes an HTTP pool of peers with the given options.
 // Unlike NewHTTPPool, this function does not register the created pool as an HTTP handler.
 // The returned *HTTPPool implements http.Handler and must be registered using http.Handle.
+//
+// A process may make several pools with distinct BasePaths, e.g. to be
+// part of several clusters. Only the first one registers itself as the
+// PeerPicker of the groups made without WithPeerPicker, until it is
+// closed and the next pool made takes its place; the groups using
+// another pool must be made WithPeerPicker(pool).
+//
+// Unlike NewHTTPPoolWith, it accepts a BasePath at the root or with a
+// query, and negative sizes, counts and durations, as it always did. It
+// panics if other options are invalid, as reported by NewHTTPPoolWith,
+// or if another pool already serves BasePath.
 func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
-	if httpPoolMade {
-		panic("groupcache: NewHTTPPool must be called only once")
+	var opts HTTPPoolOptions
+	if o != nil {
+		opts = *o
+	}
+	p, err := newHTTPPool(self, opts, true)
+	if err != nil {
+		panic(err)
 	}
-	httpPoolMade = true
+	return p
+}
 
-	p := &HTTPPool{
-		self:        self,
-		httpGetters: make(map[string]*httpGetter),
+// An HTTPPoolOption configures the HTTPPool made by NewHTTPPoolWith.
+type HTTPPoolOption func(*HTTPPoolOptions)
+
+// WithHTTPPoolOptions sets all the options of the pool to o, e.g. to set
+// those that have no HTTPPoolOption of their own. It overrides the
+// options given before it.
+func WithHTTPPoolOptions(o HTTPPoolOptions) HTTPPoolOption {
+	return func(opts *HTTPPoolOptions) {
+		*opts = o
 	}
-	if o != nil {
-		p.opts = *o
+}
+
+// WithBasePath sets HTTPPoolOptions.BasePath.
+func WithBasePath(path string) HTTPPoolOption {
+	return func(opts *HTTPPoolOptions) {
+		opts.BasePath = path
+	}
+}
+
+// WithReplicas sets HTTPPoolOptions.Replicas.
+func WithReplicas(n int) HTTPPoolOption {
+	return func(opts *HTTPPoolOptions) {
+		opts.Replicas = n
+	}
+}
+
+// WithHashFn sets HTTPPoolOptions.HashFn.
+func WithHashFn(fn consistenthash.Hash) HTTPPoolOption {
+	return func(opts *HTTPPoolOptions) {
+		opts.HashFn = fn
+	}
+}
+
+// WithTransport sets HTTPPoolOptions.Transport.
+func WithTransport(fn func(context.Context) http.RoundTripper) HTTPPoolOption {
+	return func(opts *HTTPPoolOptions) {
+		opts.Transport = fn
+	}
+}
+
+// NewHTTPPoolWith is like NewHTTPPoolOpts, with the options given by
+// opts, but returns an error naming the offending option if they are
+// invalid, or if another pool already uses the same BasePath.
+func NewHTTPPoolWith(self string, opts ...HTTPPoolOption) (*HTTPPool, error) {
+	var o HTTPPoolOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return newHTTPPool(self, o, false)
+}
+
+// newHTTPPool implements NewHTTPPoolWith and NewHTTPPoolOpts, validating
+// o leniently for the latter.
+func newHTTPPool(self string, o HTTPPoolOptions, lenient bool) (*HTTPPool, error) {
+	if err := o.validate(lenient); err != nil {
+		return nil, err
+	}
+	p := &HTTPPool{
+		self:    normalizeSelfURL(self),
+		getters: make(map[string]ProtoGetter),
+		opts:    o,
 	}
 	if p.opts.BasePath == "" {
 		p.opts.BasePath = defaultBasePath
 	}
+	p.opts.BasePath = normalizeBasePath(p.opts.BasePath)
 	if p.opts.Replicas == 0 {
 		p.opts.Replicas = defaultReplicas
 	}
-	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+	if p.opts.HashFn == nil && p.opts.XXHash {
+		p.opts.HashFn = consistenthash.XXHash64
+	}
+	p.peers = p.newRing()
+	p.publishPicks()
+	p.cipher, _ = newValueCipher(p.opts.EncryptionKeys)
+	if p.opts.MaxServerConcurrency > 0 {
+		p.serverSem = make(chan struct{}, p.opts.MaxServerConcurrency)
+	}
+	if p.opts.MaxConcurrentLoads > 0 {
+		p.loadSem = make(chan struct{}, p.opts.MaxConcurrentLoads)
+	}
 
 	if p.opts.ServerErrorHandler == nil {
 		p.opts.ServerErrorHandler = DefaultServerErrorHandler
 	}
+	if p.opts.Transport == nil {
+		if tr := newTunedTransport(&p.opts); tr != nil {
+			p.transport = tr
+			p.opts.Transport = func(context.Context) http.RoundTripper { return tr }
+		}
+	}
 
-	RegisterPeerPicker(func() PeerPicker { return p })
-	return p
+	httpPoolsMu.Lock()
+	defer httpPoolsMu.Unlock()
+	if _, dup := httpPools[p.opts.BasePath]; dup {
+		return nil, errors.Errorf("groupcache: an HTTPPool already serves BasePath %q", p.opts.BasePath)
+	}
+	if registerPortPicker(func(string) PeerPicker { return p }) {
+		p.registered = true
+	}
+	httpPools[p.opts.BasePath] = p
+	return p, nil
 }
 
-// Set updates the pool's list of peers.
-// Each peer value should be a valid base URL,
-// for example "http://example.net:8000".
-func (p *HTTPPool) Set(peers ...string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
-	p.peers.Add(peers...)
-	p.httpGetters = make(map[string]*httpGetter, len(peers))
-	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{
-			getTransport: p.opts.Transport,
-			baseURL:      peer + p.opts.BasePath,
+// validate returns an error naming the first invalid option of o. If
+// lenient is set, it accepts the values of BasePath and the sizes, counts
+// and durations that NewHTTPPoolOpts accepted before validating options.
+// The callbacks of o are not called.
+func (o *HTTPPoolOptions) validate(lenient bool) error {
+	invalid := func(option string, value interface{}, reason string) error {
+		return errors.Errorf("groupcache: invalid HTTPPool option %s %v: %s", option, value, reason)
+	}
+	if o.MigrationWindow < 0 {
+		return invalid("MigrationWindow", o.MigrationWindow, "must not be negative")
+	}
+	if o.LoadFactor != 0 && !(o.LoadFactor > 1) {
+		return invalid("LoadFactor", o.LoadFactor, "must be greater than 1")
+	}
+	if o.Ketama && (o.HashFn != nil || o.XXHash || o.HashSeed != 0 || o.ReplicaKeyFunc != nil) {
+		return invalid("Ketama", o.Ketama, "must not be set with HashFn, XXHash, HashSeed or ReplicaKeyFunc")
+	}
+	for i, key := range o.EncryptionKeys {
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return invalid(fmt.Sprintf("EncryptionKeys[%d]", i), fmt.Sprintf("of %d bytes", n), "must be 16, 24 or 32 bytes long")
+		}
+	}
+	if lenient {
+		return nil
+	}
+	if o.BasePath != "" && normalizeBasePath(o.BasePath) == "/" {
+		return invalid("BasePath", strconv.Quote(o.BasePath), "must not be the root path")
+	}
+	if strings.ContainsAny(o.BasePath, "?#") {
+		return invalid("BasePath", strconv.Quote(o.BasePath), "must be a path without query or fragment")
+	}
+	for _, n := range []struct {
+		option string
+		value  int64
+	}{
+		{"Replicas", int64(o.Replicas)},
+		{"MaxIdleConns", int64(o.MaxIdleConns)},
+		{"MaxIdleConnsPerHost", int64(o.MaxIdleConnsPerHost)},
+		{"MaxConnsPerHost", int64(o.MaxConnsPerHost)},
+		{"MaxConcurrentPerPeer", int64(o.MaxConcurrentPerPeer)},
+		{"MaxServerConcurrency", int64(o.MaxServerConcurrency)},
+		{"MaxConcurrentLoads", int64(o.MaxConcurrentLoads)},
+		{"MaxPooledBufferBytes", int64(o.MaxPooledBufferBytes)},
+		{"MaxResponseBytes", o.MaxResponseBytes},
+		{"ChunkBytes", int64(o.ChunkBytes)},
+	} {
+		if n.value < 0 {
+			return invalid(n.option, n.value, "must not be negative")
+		}
+	}
+	for _, d := range []struct {
+		option string
+		value  time.Duration
+	}{
+		{"IdleConnTimeout", o.IdleConnTimeout},
+		{"MaxLoadDuration", o.MaxLoadDuration},
+	} {
+		if d.value < 0 {
+			return invalid(d.option, d.value, "must not be negative")
 		}
 	}
+	return nil
 }
 
-// GetAll returns all the peers in the pool
-func (p *HTTPPool) GetAll() []ProtoGetter {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	var i int
-	res := make([]ProtoGetter, len(p.httpGetters))
-	for _, v := range p.httpGetters {
-		res[i] = v
-		i++
+// newTunedTransport returns a copy of http.DefaultTransport with the
+// connection settings of o, or nil if o does not tune any.
+func newTunedTransport(o *HTTPPoolOptions) *http.Transport {
+	if o.MaxIdleConns == 0 && o.MaxIdleConnsPerHost == 0 && o.MaxConnsPerHost == 0 && o.IdleConnTimeout == 0 {
+		return nil
 	}
-	return res
+	var tr *http.Transport
+	if def, ok := http.DefaultTransport.(*http.Transport); ok {
+		tr = def.Clone()
+	} else {
+		// http.DefaultTransport was replaced, e.g. by a test; start from
+		// the same settings.
+		tr = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+	}
+	if o.MaxIdleConns != 0 {
+		tr.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost != 0 {
+		tr.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost != 0 {
+		tr.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.IdleConnTimeout != 0 {
+		tr.IdleConnTimeout = o.IdleConnTimeout
+	}
+	return tr
 }
 
-func (p *HTTPPool) PickPeer(key string) (ProtoGetter, bool) {
+// Close shuts the pool down. It closes the idle connections of the
+// transport it created to reach peers, if any, leaving those of
+// http.DefaultTransport and of a Transport of the options alone, and
+// unregisters the pool, and the PeerPicker if it was the first pool, so
+// that a new pool may be created with its BasePath. Once closed, the pool
+// no longer picks any peer. Groups that already took the pool as their
+// PeerPicker keep it, and so load every key themselves: they must be
+// created again, or given WithPeerPicker, to use a new pool.
+func (p *HTTPPool) Close() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.peers.IsEmpty() {
-		return nil, false
+	if p.closed {
+		return nil
 	}
-	if peer := p.peers.Get(key); peer != p.self {
-		return p.httpGetters[peer], true
-	}
-	return nil, false
-}
+	p.closed = true
 
-func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
 
-	var ctx context.Context
-	if p.opts.Context != nil {
-		ctx = p.opts.Context(r)
-	} else {
-		ctx = r.Context()
+	for _, getters := range []map[string]ProtoGetter{p.getters, p.prevGetters} {
+		for _, g := range getters {
+			if h, ok := g.(*httpGetter); ok {
+				_ = h.Close()
+			}
+		}
 	}
 
-	// Parse request.
-	if !strings.HasPrefix(r.URL.Path, p.opts.BasePath) {
-		panic("HTTPPool serving unexpected path: " + r.URL.Path)
+	p.peers = p.newRing()
+	p.getters = make(map[string]ProtoGetter)
+	p.publishPicks()
+	p.endMigration()
+
+	httpPoolsMu.Lock()
+	if httpPools[p.opts.BasePath] == p {
+		delete(httpPools, p.opts.BasePath)
 	}
-	parts := strings.SplitN(r.URL.Path[len(p.opts.BasePath):], "/", 2)
-	if len(parts) != 2 {
-		p.opts.ServerErrorHandler(ctx, w, r, BadGroupcacheRequestError{message: "invalid request URL (missing path parts)"})
-		return
+	if p.registered {
+		unregisterPortPicker()
+		p.registered = false
 	}
-	groupName := parts[0]
-	key := parts[1]
+	httpPoolsMu.Unlock()
+	return nil
+}
 
-	// Fetch the value for this group/key.
-	group := GetGroup(groupName)
-	if group == nil {
-		p.opts.ServerErrorHandler(ctx, w, r, GroupNotFoundError{group: groupName})
-		return
+// Set updates the pool's list of peers.
+// Each peer value should be a valid base URL,
+// for example "http://example.net:8000".
+// The peers that were already in the pool keep their getter, and its
+// state such as PeerStats; the getters of the removed peers that
+// implement io.Closer are closed.
+// Set panics if any of the peers is not a valid URL; use SetE to
+// handle the error instead.
+func (p *HTTPPool) Set(peers ...string) {
+	if err := p.SetE(peers...); err != nil {
+		panic(err.Error())
 	}
+}
 
-	group.Stats.ServerRequests.Add(1)
-
-	// Delete the key and return 200
-	if r.Method == http.MethodDelete {
-		group.localRemove(key)
-		return
-	}
+// SetE updates the pool's list of peers like Set, but returns an error
+// listing the offending entries if any of the peers is not a valid URL.
+// The pool is left unchanged on error.
+func (p *HTTPPool) SetE(peers ...string) error {
+	return p.set(peers, nil, false)
+}
 
-	var b []byte
+// newRing returns an empty consistent hash of the peers, as set in the
+// options of the pool.
+// peerPicks is a frozen ring and the getters of its members, which are
+// never changed once published.
+type peerPicks struct {
+	ring    *consistenthash.Frozen
+	getters map[string]ProtoGetter
+}
 
-	value := AllocatingByteSliceSink(&b)
-	err := group.Get(ctx, key, value)
-	if err != nil {
-		p.opts.ServerErrorHandler(ctx, w, r, err)
-		return
-	}
+// publishPicks publishes the current ring and getters for the peers to be
+// picked from; p.mu must be held.
+func (p *HTTPPool) publishPicks() {
+	p.picks.Store(&peerPicks{ring: p.peers.Freeze(), getters: p.getters})
+}
 
-	view, err := value.view()
-	if err != nil {
-		p.opts.ServerErrorHandler(ctx, w, r, err)
-		return
+func (p *HTTPPool) newRing() *consistenthash.Map {
+	if p.opts.Ketama {
+		return consistenthash.NewKetama(ketamaName)
 	}
-	var expireNano int64
-	if !view.e.IsZero() {
-		expireNano = view.Expire().UnixNano()
+	m := consistenthash.NewSeeded(p.opts.Replicas, p.opts.HashFn, p.opts.HashSeed)
+	if p.opts.ReplicaKeyFunc != nil {
+		m.SetReplicaKeyFunc(p.opts.ReplicaKeyFunc)
 	}
+	return m
+}
 
-	// Write the value to the response body as a proto message.
-	body, err := proto.Marshal(&pb.GetResponse{Value: b, Expire: &expireNano})
-	if err != nil {
-		p.opts.ServerErrorHandler(ctx, w, r, err)
-		return
+// ketamaName returns the "host:port" of the URL of peer, by which ketama
+// knows it.
+func ketamaName(peer string) string {
+	if u, err := url.Parse(peer); err == nil && u.Host != "" {
+		return u.Host
 	}
-	w.Header().Set("Content-Type", "application/x-protobuf")
-	_, _ = w.Write(body)
+	return peer
 }
 
-type httpGetter struct {
-	getTransport func(context.Context) http.RoundTripper
-	baseURL      string
+// SetWeighted updates the pool's list of peers like SetE, to the keys of
+// weights, making each peer own a share of the keys proportional to its
+// weight, e.g. to its memory. Weights must be positive. Changing the
+// weight of a peer only moves the keys it gains or loses.
+func (p *HTTPPool) SetWeighted(weights map[string]int) error {
+	peers := make([]string, 0, len(weights))
+	for peer := range weights {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return p.set(peers, weights, false)
 }
 
-// GetURL
-func (p *httpGetter) GetURL() string {
-	return p.baseURL
+// BeginMigration updates the pool's list of peers like SetE, but keeps
+// the previous peers around until CompleteMigration, so that the keys
+// whose owner changed are not loaded again while the previous owner
+// still has them cached: before loading such a key, its new owner asks
+// the previous owner for it, if that one has it cached. Removes also go
+// to the previous peers. Group.Stats.PreviousOwnerHits counts the keys
+// found this way; once it stops growing, the migration may complete.
+// Peers that predate migrations load the keys they are asked for.
+func (p *HTTPPool) BeginMigration(newPeers []string) error {
+	return p.set(newPeers, nil, true)
 }
 
-var bufferPool = sync.Pool{
-	New: func() interface{} { return new(bytes.Buffer) },
+// CompleteMigration ends the migration started by BeginMigration,
+// forgetting the previous peers. It does nothing if there is none.
+func (p *HTTPPool) CompleteMigration() {
+	p.completeMigration(0)
 }
 
-func (h *httpGetter) makeRequest(ctx context.Context, method string, in *pb.GetRequest, out *http.Response) error {
-	u := fmt.Sprintf(
-		"%v%v/%v",
-		h.baseURL,
-		url.PathEscape(in.GetGroup()),
-		url.PathEscape(in.GetKey()),
-	)
-	// Pass along the context to the RoundTripper
-	req, err := http.NewRequestWithContext(ctx, method, u, nil)
-	if err != nil {
-		return err
+// completeMigration is CompleteMigration for the migration of generation
+// gen only, or for any if gen is zero.
+func (p *HTTPPool) completeMigration(gen uint64) {
+	p.mu.Lock()
+	if gen != 0 && gen != p.migrationGen {
+		// The timer fired as its migration ended and another began.
+		p.mu.Unlock()
+		return
 	}
+	getters := p.prevGetters
+	p.endMigration()
+	p.mu.Unlock()
 
-	tr := http.DefaultTransport
-	if h.getTransport != nil {
-		tr = h.getTransport(ctx)
+	for _, g := range getters {
+		if c, ok := g.(io.Closer); ok {
+			_ = c.Close()
+		}
 	}
+}
 
-	res, err := tr.RoundTrip(req)
-	if err != nil {
-		return err
+// endMigration forgets the previous peers; p.mu must be held.
+func (p *HTTPPool) endMigration() {
+	if p.migrationTimer != nil {
+		p.migrationTimer.Stop()
 	}
-	*out = *res
-	return nil
+	p.migrating = false
+	p.prevPeers = nil
+	p.prevGetters = nil
+	p.migrationTimer = nil
 }
 
-func (h *httpGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
-	var res http.Response
-	if err := h.makeRequest(ctx, http.MethodGet, in, &res); err != nil {
-		return newRemoteLoadError(in, err)
+// PickPreviousPeer implements MigratingPeerPicker.
+func (p *HTTPPool) PickPreviousPeer(key string) (ProtoGetter, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.migrating || p.prevPeers == nil || p.peers == nil {
+		return nil, false
 	}
-	defer res.Body.Close()
-
-	b := bufferPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bufferPool.Put(b)
-	_, err := io.Copy(b, res.Body)
-	if res.StatusCode != http.StatusOK {
-		return newRemoteLoadErrorWithResp(in, res, b.Bytes(), errors.Errorf("non-OK response code: %d %s", res.StatusCode, res.Status))
+	tag := p.keyTag(key)
+	prev := p.prevPeers.GetN(tag, 1)
+	if len(prev) == 0 || p.isSelf(prev[0]) {
+		return nil, false
 	}
-	if err != nil {
-		return newRemoteLoadErrorWithResp(in, res, nil, errors.Wrapf(err, "reading response body"))
+	if cur := p.peers.GetN(tag, 1); len(cur) == 1 && cur[0] == prev[0] {
+		return nil, false
 	}
-
-	err = proto.Unmarshal(b.Bytes(), out)
-	if err != nil {
-		return newRemoteLoadErrorWithResp(in, res, b.Bytes(), errors.Wrapf(err, "decoding response body"))
+	if g, ok := p.getters[prev[0]]; ok {
+		return g, true
 	}
-	return nil
+	g, ok := p.prevGetters[prev[0]]
+	return g, ok
 }
 
-func (h *httpGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
-	var res http.Response
-	if err := h.makeRequest(ctx, http.MethodDelete, in, &res); err != nil {
-		return err
+// set implements SetE, SetWeighted and BeginMigration, with nil weights
+// for SetE and migrate set for BeginMigration.
+func (p *HTTPPool) set(peers []string, weights map[string]int, migrate bool) error {
+	normalized := make([]string, 0, len(peers))
+	var normalizedWeights map[string]int
+	if weights != nil {
+		normalizedWeights = make(map[string]int, len(weights))
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(res.Body)
+	var invalid []string
+	for _, peer := range peers {
+		u, err := normalizePeerURL(peer)
+		if err == nil && weights != nil && weights[peer] <= 0 {
+			err = errors.Errorf("weight %d is not positive", weights[peer])
+		}
 		if err != nil {
-			return fmt.Errorf("while reading body response: %v", res.Status)
+			invalid = append(invalid, fmt.Sprintf("%q: %v", peer, err))
+			continue
+		}
+		normalized = append(normalized, u)
+		if weights != nil {
+			normalizedWeights[u] += weights[peer]
 		}
-		return fmt.Errorf("server returned status %d: %s", res.StatusCode, body)
 	}
-	return nil
-}
-
-func DefaultServerErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
-
-	if logger != nil {
-		logger.WithError(err).Debugf("error while retrieving cache entry for request %q", r.URL)
+	if len(invalid) != 0 {
+		return errors.Errorf("groupcache: invalid peer URLs: %s", strings.Join(invalid, "; "))
 	}
 
-	switch err.(type) {
-	case BadGroupcacheRequestError:
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	case GroupNotFoundError:
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errors.New("groupcache: Set called on closed HTTPPool")
+	}
+	if migrate && p.migrating {
+		p.mu.Unlock()
+		return errors.New("groupcache: BeginMigration called during a migration")
+	}
+	oldPeers := p.peers
+	p.peers = p.newRing()
+	if weights != nil {
+		p.peers.AddWeighted(normalizedWeights)
+	} else {
+		p.peers.Add(normalized...)
+	}
+	newPeers := p.peers
+	if p.opts.LoadFactor > 0 {
+		newPeers.SetLoadReporter(p.inFlightLoad, p.opts.LoadFactor)
+	}
+	// Keep the getters of the peers that remain, along with their state.
+	// The map of the old getters may still be read by PickPeer, so the
+	// getters of the removed peers are gathered in another.
+	oldGetters := p.getters
+	members := newPeers.Members()
+	p.getters = make(map[string]ProtoGetter, len(members))
+	for _, peer := range members {
+		if oldPeers != nil && oldPeers.Contains(peer) {
+			p.getters[peer] = oldGetters[peer]
+		} else if g, ok := p.prevGetters[peer]; ok {
+			p.getters[peer] = g
+			delete(p.prevGetters, peer)
+		} else if p.opts.GetterFactory != nil {
+			p.getters[peer] = p.opts.GetterFactory(peer)
+		} else {
+			h := newHTTPGetter(peer+p.opts.BasePath, &p.opts)
+			if p.opts.PeerTransport != nil {
+				if tr := p.opts.PeerTransport(peer); tr != nil {
+					h.peerTransport = tr
+					h.getTransport = func(context.Context) http.RoundTripper { return tr }
+				}
+			}
+			p.getters[peer] = h
+		}
+	}
+	p.publishPicks()
+	removedGetters := make(map[string]ProtoGetter)
+	for peer, g := range oldGetters {
+		if !newPeers.Contains(peer) {
+			removedGetters[peer] = g
+		}
+	}
+	if migrate {
+		// Keep the getters of the removed peers for the migration.
+		p.migrating = true
+		p.prevPeers = oldPeers
+		p.prevGetters = removedGetters
+		p.migrationGen++
+		removedGetters = nil
+		if p.opts.MigrationWindow > 0 {
+			gen := p.migrationGen
+			p.migrationTimer = time.AfterFunc(p.opts.MigrationWindow, func() { p.completeMigration(gen) })
+		}
+	}
+	p.mu.Unlock()
+
+	// Tear down the getters of the removed peers that need it.
+	for _, g := range removedGetters {
+		if c, ok := g.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+
+	if p.opts.OnRebalance != nil && oldPeers != nil {
+		p.opts.OnRebalance(consistenthash.Churn(oldPeers, newPeers, rebalanceChurnSamples))
+	}
+	if p.opts.OnPeersChanged != nil {
+		added, removed := peersDiff(oldPeers, newPeers)
+		if len(added) != 0 || len(removed) != 0 {
+			p.opts.OnPeersChanged(added, removed)
+		}
+	}
+
+	selfFound := false
+	for _, peer := range normalized {
+		if p.isSelf(peer) {
+			selfFound = true
+			break
+		}
+	}
+
+	if selfFound {
+		p.selfMissing.Store(false)
+	} else if !p.selfMissing.Swap(true) {
+		if p.opts.SelfNotInPeers != nil {
+			p.opts.SelfNotInPeers(p.self, normalized)
+		} else {
+			p.log().Warn("self is not one of the peers; keys it owns will be fetched over the network", "self", p.self, "peers", normalized)
+		}
+	}
+	return nil
+}
+
+// peersDiff returns the sorted members of newPeers missing from oldPeers and
+// those of oldPeers missing from newPeers. oldPeers may be nil.
+func peersDiff(oldPeers, newPeers *consistenthash.Map) (added, removed []string) {
+	for _, peer := range newPeers.Members() {
+		if oldPeers == nil || !oldPeers.Contains(peer) {
+			added = append(added, peer)
+		}
+	}
+	if oldPeers != nil {
+		for _, peer := range oldPeers.Members() {
+			if !newPeers.Contains(peer) {
+				removed = append(removed, peer)
+			}
+		}
+	}
+	return added, removed
+}
+
+// inFlightLoad reports the requests in flight to peer for bounded loads.
+// It is called by PickPeer with mu held.
+func (p *HTTPPool) inFlightLoad(peer string) int64 {
+	picks := p.picks.Load()
+	if picks == nil {
+		return 0
+	}
+	if h, ok := picks.getters[peer].(*httpGetter); ok {
+		return h.inFlight.Get()
+	}
+	return 0
+}
+
+// log returns the Logger of the pool.
+func (p *HTTPPool) log() Logger {
+	return resolveLogger(p.opts.Logger)
+}
+
+// keyTag returns the part of key that picks its peer.
+func (p *HTTPPool) keyTag(key string) string {
+	if p.opts.KeyTagFunc != nil {
+		return p.opts.KeyTagFunc(key)
+	}
+	return key
+}
+
+// HashTag is a KeyTagFunc following the convention of Redis Cluster: if
+// key contains a non-empty segment between the first "{" and the next
+// "}", only that segment picks the peer, so that e.g. "user:{42}:profile"
+// and "user:{42}:settings" share one. Other keys are returned whole.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// isSelf reports whether peer designates this peer.
+func (p *HTTPPool) isSelf(peer string) bool {
+	if p.opts.IsSelf != nil {
+		return p.opts.IsSelf(peer)
+	}
+	return peer == p.self
+}
+
+// normalizePeerURL validates the peer base URL u and returns it with a
+// lowercase scheme and host, and without trailing slashes.
+func normalizePeerURL(u string) (string, error) {
+	if u == "" {
+		return "", errors.New("empty URL")
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme == "" {
+		return "", errors.New("missing scheme")
+	}
+	if parsed.Host == "" {
+		return "", errors.New("missing host")
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+// normalizeBasePath returns path with a single leading and trailing
+// slash, so that it can both prefix the group of requests and be
+// appended to peer URLs, which have no trailing slash.
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "/"
+	}
+	return "/" + path + "/"
+}
+
+// normalizeSelfURL normalizes self like the peers given to Set so that
+// they can be compared. A self that is not a valid peer URL is returned
+// unchanged as it can then never match a peer.
+func normalizeSelfURL(self string) string {
+	if u, err := normalizePeerURL(self); err == nil {
+		return u
+	}
+	return self
+}
+
+// selfHostEnv is the environment variable that overrides the host
+// detected by DetectSelf.
+const selfHostEnv = "GROUPCACHE_SELF_HOST"
+
+// interfaceAddrs is net.InterfaceAddrs, replaced in tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+type detectSelfOptions struct {
+	scheme string
+	host   string
+}
+
+// A DetectSelfOption configures DetectSelf.
+type DetectSelfOption func(*detectSelfOptions)
+
+// WithSelfScheme sets the scheme of the URL returned by DetectSelf.
+// It defaults to "http".
+func WithSelfScheme(scheme string) DetectSelfOption {
+	return func(o *detectSelfOptions) {
+		o.scheme = scheme
+	}
+}
+
+// WithSelfHost makes DetectSelf use host instead of detecting it.
+func WithSelfHost(host string) DetectSelfOption {
+	return func(o *detectSelfOptions) {
+		o.host = host
+	}
+}
+
+// DetectSelf returns the base URL other peers may use to reach the server
+// listening on listenAddr, e.g. ":8080", normalized like the peers given to
+// Set. Unless listenAddr names a specific host, the host is taken from the
+// WithSelfHost option, then the GROUPCACHE_SELF_HOST environment variable,
+// and otherwise is the first IP address of the non-loopback interfaces,
+// IPv4 addresses first.
+func DetectSelf(listenAddr string, opts ...DetectSelfOption) (string, error) {
+	o := detectSelfOptions{scheme: "http"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", errors.Wrapf(err, "groupcache: invalid listen address %q", listenAddr)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = o.host
+		if host == "" {
+			host = os.Getenv(selfHostEnv)
+		}
+		if host == "" {
+			if host, err = detectHost(); err != nil {
+				return "", err
+			}
+		}
+	}
+	return normalizePeerURL(o.scheme + "://" + net.JoinHostPort(host, port))
+}
+
+// detectHost returns the first IP address of the non-loopback interfaces,
+// IPv4 addresses first.
+func detectHost() (string, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", errors.Wrap(err, "groupcache: listing interface addresses")
+	}
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 == nil {
+		return "", errors.New("groupcache: no non-loopback interface address found")
+	}
+	return v6.String(), nil
+}
+
+// Stats returns the statistics of the requests served by the pool.
+func (p *HTTPPool) Stats() PoolStats {
+	return PoolStats{
+		ActiveLoads: int64(len(p.loadSem)),
+		QueuedLoads: p.queuedLoads.Get(),
+		ShedLoads:   p.shedLoads.Get(),
+
+		RejectedMethods: p.rejectedMethods.Get(),
+	}
+}
+
+// PeerStats returns the statistics of each peer in the pool, keyed by
+// the peer URL given to Set.
+func (p *HTTPPool) PeerStats() map[string]PeerStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	res := make(map[string]PeerStats, len(p.getters))
+	for peer, g := range p.getters {
+		// Only the getters of this package keep stats.
+		var stats PeerStats
+		if h, ok := g.(*httpGetter); ok {
+			stats.InFlight = h.inFlight.Get()
+			stats.Capabilities = Capabilities(h.capabilities.Get())
+			h.latencyMu.Lock()
+			stats.Latency = h.latency
+			h.latencyMu.Unlock()
+		}
+		res[peer] = stats
+	}
+	return res
+}
+
+// RingInfo returns the members of the consistent hash, with their
+// replicas and share of the keys.
+func (p *HTTPPool) RingInfo() RingInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.peers == nil {
+		return RingInfo{}
+	}
+	info := RingInfo{
+		Members:      p.peers.Members(),
+		Distribution: p.peers.Distribution(ringInfoSamples),
+	}
+	info.Replicas = make(map[string]int, len(info.Members))
+	for _, member := range info.Members {
+		info.Replicas[member] = p.peers.ReplicaCount(member)
+	}
+	return info
+}
+
+// RingSnapshot returns the state of the consistent hash of the pool.
+func (p *HTTPPool) RingSnapshot() RingSnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return RingSnapshot{
+		Self:     p.self,
+		BasePath: p.opts.BasePath,
+		XXHash:   p.opts.XXHash,
+		Ring:     p.peers.Snapshot(),
+	}
+}
+
+// NewHTTPPoolFromSnapshot is like NewHTTPPoolWith, but the pool takes its
+// self URL, BasePath and consistent hash options, and its peers along
+// with their weights, from s. The options that a snapshot cannot hold,
+// such as HashFn, ReplicaKeyFunc and KeyTagFunc, must be given in opts
+// as they were to the pool the snapshot was taken from, along with
+// another BasePath if another pool of this process uses it.
+func NewHTTPPoolFromSnapshot(s RingSnapshot, opts ...HTTPPoolOption) (*HTTPPool, error) {
+	base := func(o *HTTPPoolOptions) {
+		o.BasePath = s.BasePath
+		o.XXHash = s.XXHash
+		o.Ketama = s.Ring.Ketama
+		o.HashSeed = s.Ring.Seed
+		if !s.Ring.Ketama {
+			o.Replicas = s.Ring.Replicas
+		}
+	}
+	weights := make(map[string]int, len(s.Ring.Members))
+	for peer, replicas := range s.Ring.Members {
+		if s.Ring.Replicas <= 0 || replicas <= 0 || replicas%s.Ring.Replicas != 0 {
+			return nil, errors.Errorf("groupcache: snapshot peer %q has %d replicas, not a multiple of %d", peer, replicas, s.Ring.Replicas)
+		}
+		weights[peer] = replicas / s.Ring.Replicas
+	}
+	p, err := NewHTTPPoolWith(s.Self, append([]HTTPPoolOption{base}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(weights) != 0 {
+		if err := p.SetWeighted(weights); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		// Place the replicas of the peers exactly where they were.
+		p.mu.Lock()
+		err = p.peers.Restore(s.Ring)
+		p.publishPicks()
+		p.mu.Unlock()
+		if err != nil {
+			_ = p.Close()
+			return nil, errors.Wrap(err, "groupcache: restoring the ring of the snapshot")
+		}
+	}
+	return p, nil
+}
+
+// PickPeers implements MultiPeerPicker. Bounded loads do not apply.
+func (p *HTTPPool) PickPeers(key string, n int) []ProtoGetter {
+	picks := p.picks.Load()
+	if picks == nil {
+		return nil
+	}
+	var res []ProtoGetter
+	for _, peer := range picks.ring.GetN(p.keyTag(key), n) {
+		if p.isSelf(peer) {
+			res = append(res, nil)
+		} else {
+			res = append(res, picks.getters[peer])
+		}
+	}
+	return res
+}
+
+// GetAll returns the peers in the pool other than self, sorted by URL.
+func (p *HTTPPool) GetAll() []ProtoGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.sortedGetters(false)
+}
+
+// GetAllWithSelf is like GetAll, but also includes self, sorted along with
+// the other peers by its URL. Self is represented by a ProtoGetter calling
+// into the local groups directly rather than over HTTP.
+func (p *HTTPPool) GetAllWithSelf() []ProtoGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.sortedGetters(true)
+}
+
+// sortedGetters returns the getters of the peers sorted by URL, with self
+// replaced by a localGetter if withSelf is set, or left out otherwise.
+// p.mu must be held.
+func (p *HTTPPool) sortedGetters(withSelf bool) []ProtoGetter {
+	getters := p.getters
+	if len(p.prevGetters) > 0 {
+		// The previous peers are included during a migration.
+		getters = make(map[string]ProtoGetter, len(p.getters)+len(p.prevGetters))
+		for peer, g := range p.prevGetters {
+			getters[peer] = g
+		}
+		for peer, g := range p.getters {
+			getters[peer] = g
+		}
+	}
+	peers := make([]string, 0, len(getters))
+	for peer := range getters {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	res := make([]ProtoGetter, 0, len(peers))
+	for _, peer := range peers {
+		switch {
+		case !p.isSelf(peer):
+			res = append(res, getters[peer])
+		case withSelf:
+			res = append(res, localGetter{url: peer})
+		}
+	}
+	return res
+}
+
+func (p *HTTPPool) PickPeer(key string) (ProtoGetter, bool) {
+	picks := p.picks.Load()
+	if picks == nil || picks.ring.IsEmpty() {
+		return nil, false
+	}
+	if peer := picks.ring.Get(p.keyTag(key)); !p.isSelf(peer) {
+		return picks.getters[peer], true
+	}
+	return nil, false
+}
+
+// PickPeerHashed implements HashedPeerPicker. hash is the hash of the key,
+// or of its tag with KeyTagFunc, by the hash function of the pool: HashFn
+// as defaulted, or consistenthash.KetamaHash with Ketama. The HashSeed,
+// if any, is mixed into it like into the hashes of the keys.
+func (p *HTTPPool) PickPeerHashed(hash uint64) (ProtoGetter, bool) {
+	picks := p.picks.Load()
+	if picks == nil || picks.ring.IsEmpty() {
+		return nil, false
+	}
+	if peer := picks.ring.GetHashed(hash); !p.isSelf(peer) {
+		return picks.getters[peer], true
+	}
+	return nil, false
+}
+
+// ServeHTTP serves the requests of peers: GET returns a value, loading it
+// if needed, HEAD returns the headers of a cached value without loading
+// it, or 404 Not Found if it is not cached, and DELETE removes a value
+// from the caches.
+func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	var ctx context.Context
+	if p.opts.Context != nil {
+		ctx = p.opts.Context(r)
+	} else {
+		ctx = r.Context()
+	}
+	if p.opts.Logger != nil {
+		ctx = context.WithValue(ctx, loggerKey{}, p.opts.Logger)
+	}
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		ctx = WithRequestID(ctx, id)
+	}
+	if p.opts.MetadataToContext != nil {
+		ctx = p.opts.MetadataToContext(ctx, decodeMetadata(r.Header))
+	}
+
+	w.Header().Set(capabilitiesHeader, supportedCapabilities.String())
+	caps := supportedCapabilities & parseCapabilities(r.Header.Get(capabilitiesHeader))
+
+	// Parse request. The group and key are escaped by PeerRequestURL,
+	// and may contain slashes.
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, p.opts.BasePath) {
+		if p.opts.PanicOnUnexpectedPath {
+			panic("HTTPPool serving unexpected path: " + r.URL.Path)
+		}
+		p.unexpectedPathOnce.Do(func() {
+			p.log().Warn("HTTPPool serving unexpected path; is it mounted on BasePath?", "path", r.URL.Path, "basePath", p.opts.BasePath)
+		})
+		p.opts.ServerErrorHandler(ctx, w, r, UnexpectedPathError{path: r.URL.Path})
+		return
+	}
+	groupName, key, err := parsePeerPath(path[len(p.opts.BasePath):])
+	if err != nil {
+		p.opts.ServerErrorHandler(ctx, w, r, err)
+		return
+	}
+
+	// Unsupported methods are rejected whether the group exists or not.
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		if group := GetGroup(groupName); group != nil {
+			group.Stats.ServerRejectedMethods.Add(1)
+		} else {
+			p.rejectedMethods.Add(1)
+		}
+		w.Header().Set("Allow", allowedMethods)
+		p.opts.ServerErrorHandler(ctx, w, r, MethodNotAllowedError{method: r.Method})
+		return
+	}
+
+	// Fetch the value for this group/key.
+	group := GetGroup(groupName)
+	if group == nil {
+		p.opts.ServerErrorHandler(ctx, w, r, GroupNotFoundError{group: groupName})
+		return
+	}
+	// Peers that do not normalize the keys they request still share
+	// the entries of normalized ones.
+	reqKey := key
+	key = group.normalizeKey(key)
+
+	group.Stats.ServerRequests.Add(1)
+
+	// Delete the key and return 204, or 412 if another version was kept
+	if r.Method == http.MethodDelete {
+		if !group.localRemove(key, r.Header.Get(versionHeader)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Store the value pushed by a peer and return 204
+	if r.Method == http.MethodPut {
+		res, err := p.readPushedValue(r, groupName, reqKey)
+		if err != nil {
+			p.opts.ServerErrorHandler(ctx, w, r, err)
+			return
+		}
+		if err := group.set(key, res); err != nil {
+			p.opts.ServerErrorHandler(ctx, w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// HEAD tells about the cached value only, without loading one.
+	if r.Method == http.MethodHead {
+		view, ok := group.peekCache(key)
+		if !ok {
+			w.Header().Set(notFoundHeader, "key")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		p.setValueHeaders(w.Header(), view, view.ByteSlice(), groupName, reqKey)
+		if view.version != "" {
+			w.Header().Set(versionHeader, view.version)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Header.Get(cacheOnlyHeader) != "" && !group.cached(key) {
+		w.Header().Set(notFoundHeader, "key")
+		http.Error(w, "groupcache: key not cached", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get(priorityHeader) == "low" {
+		ctx = WithPriority(ctx, PriorityLow)
+	}
+	if p.serverSem != nil {
+		if !p.acquireServerSlot(ctx) {
+			if err := ctx.Err(); err != nil {
+				p.opts.ServerErrorHandler(ctx, w, r, err)
+				return
+			}
+			group.Stats.ServerShedRequests.Add(1)
+			p.opts.ServerErrorHandler(ctx, w, r, errors.Wrap(ErrServerOverloaded, "shedding low priority request"))
+			return
+		}
+		defer func() { <-p.serverSem }()
+	}
+
+	var b []byte
+
+	if p.loadSem != nil && !group.cached(key) {
+		if !p.acquireLoadSlot(ctx) {
+			if err := ctx.Err(); err != nil {
+				p.opts.ServerErrorHandler(ctx, w, r, err)
+				return
+			}
+			p.shedLoads.Add(1)
+			p.opts.ServerErrorHandler(ctx, w, r, errors.Wrap(ErrServerOverloaded, "shedding request over the load limit"))
+			return
+		}
+		defer func() { <-p.loadSem }()
+	}
+
+	value := AllocatingByteSliceSink(&b)
+	loadCtx := ctx
+	if !group.cancelOnDisconnect {
+		// The load may be shared with concurrent requests for the key,
+		// which must not fail because this one went away.
+		loadCtx = context.WithoutCancel(loadCtx)
+	}
+	if p.opts.MaxLoadDuration > 0 {
+		var cancel context.CancelFunc
+		loadCtx, cancel = context.WithTimeoutCause(loadCtx, p.opts.MaxLoadDuration,
+			LoadTimeoutError{Group: groupName, Key: key, Timeout: p.opts.MaxLoadDuration})
+		defer cancel()
+	}
+	err = group.Get(loadCtx, key, value)
+	if err != nil {
+		if terr, ok := context.Cause(loadCtx).(LoadTimeoutError); ok {
+			err = terr
+		}
+		p.opts.ServerErrorHandler(ctx, w, r, err)
+		return
+	}
+
+	view, err := value.view()
+	if err != nil {
+		p.opts.ServerErrorHandler(ctx, w, r, err)
+		return
+	}
+	if b == nil {
+		// A nil value would be left out of the response, while an empty
+		// one is a value like any other.
+		b = []byte{}
+	}
+	var expireNano int64
+	if !view.e.IsZero() {
+		expireNano = view.Expire().UnixNano()
+	}
+
+	etag := p.setValueHeaders(w.Header(), view, b, groupName, reqKey)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		// The peer keeps its copy, only updating its expiry and version.
+		if view.version != "" {
+			w.Header().Set(versionHeader, view.version)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	res := &pb.GetResponse{Value: b, Expire: &expireNano, Etag: &etag}
+	if view.version != "" {
+		res.Version = &view.version
+	}
+	if p.cipher != nil {
+		if err := p.cipher.seal(res, groupName, reqKey); err != nil {
+			p.opts.ServerErrorHandler(ctx, w, r, err)
+			return
+		}
+	}
+	if caps.Has(CapChecksum) {
+		// The checksum of an encrypted value is of the ciphertext, so
+		// as to tell nothing about the value.
+		checksum := crc32.Checksum(res.Value, crc32cTable)
+		res.Checksum = &checksum
+	}
+
+	if chunkBytes := p.opts.ChunkBytes; caps.Has(CapChunked) {
+		if chunkBytes == 0 {
+			chunkBytes = defaultChunkBytes
+		}
+		if len(b) > chunkBytes {
+			writeChunks(w, res, chunkBytes)
+			return
+		}
+	}
+
+	// Write the value to the response body as a proto message.
+	body, err := proto.Marshal(res)
+	if err != nil {
+		p.opts.ServerErrorHandler(ctx, w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, _ = w.Write(body)
+}
+
+// readPushedValue decodes the value pushed by a peer in the body of the
+// PUT request r for the key reqKey of the group, verifying its checksum
+// and decrypting it if values are encrypted.
+func (p *HTTPPool) readPushedValue(r *http.Request, groupName, reqKey string) (*pb.GetResponse, error) {
+	maxBytes := p.opts.MaxResponseBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxResponseBytes
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading request body")
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, BadGroupcacheRequestError{message: "pushed value too large"}
+	}
+	res := &pb.GetResponse{}
+	if err := proto.Unmarshal(body, res); err != nil {
+		return nil, BadGroupcacheRequestError{message: "invalid pushed value: " + err.Error()}
+	}
+	if res.Checksum != nil && crc32.Checksum(res.Value, crc32cTable) != *res.Checksum {
+		return nil, BadGroupcacheRequestError{message: ErrChecksumMismatch.Error()}
+	}
+	if p.cipher != nil {
+		if err := p.cipher.open(res, groupName, reqKey); err != nil {
+			return nil, BadGroupcacheRequestError{message: err.Error()}
+		}
+	}
+	return res, nil
+}
+
+// setValueHeaders sets the caching, ETag and expiry headers of the
+// response serving view, of value b, for the key reqKey of the group,
+// and returns its etag.
+func (p *HTTPPool) setValueHeaders(h http.Header, view ByteView, b []byte, groupName, reqKey string) string {
+	etag := view.etag
+	if etag == "" {
+		// The value was not cached.
+		etag = valueETag(b)
+	}
+	if p.cipher != nil {
+		etag = p.cipher.maskETag(etag, groupName, reqKey)
+	}
+	setCacheHeaders(h, view.e, time.Now())
+	h.Set("ETag", `"`+etag+`"`)
+	if !view.e.IsZero() {
+		h.Set(expireHeader, strconv.FormatInt(view.Expire().UnixNano(), 10))
+	}
+	return etag
+}
+
+// valueETag returns the etag of the value b, a hash of its content.
+func valueETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// etagMatches returns whether the If-None-Match header value v lists etag.
+func etagMatches(v, etag string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == `"`+etag+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheHeaders lets intermediaries such as a CDN cache a response
+// holding a value that expires at expire for its remaining time to live.
+// Values without expiry must be revalidated, since they may be removed
+// at any time.
+func setCacheHeaders(h http.Header, expire, now time.Time) {
+	if expire.IsZero() {
+		h.Set("Cache-Control", "no-cache")
+		return
+	}
+	maxAge := int64(expire.Sub(now) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	h.Set("Cache-Control", "max-age="+strconv.FormatInt(maxAge, 10))
+	h.Set("Expires", expire.UTC().Format(http.TimeFormat))
+}
+
+// writeChunks writes res to w in chunks of the value of at most
+// chunkBytes, as described by chunkedContentType. Errors are those of
+// the connection, and cannot be reported to the peer.
+func writeChunks(w http.ResponseWriter, res *pb.GetResponse, chunkBytes int) {
+	w.Header().Set("Content-Type", chunkedContentType)
+	value := res.Value
+	total := int64(len(value))
+	res.TotalSize = &total
+
+	var frame []byte
+	for off := 0; off < len(value); off += chunkBytes {
+		end := off + chunkBytes
+		if end > len(value) {
+			end = len(value)
+		}
+		if off > 0 {
+			offset := int64(off)
+			res = &pb.GetResponse{Offset: &offset}
+		}
+		res.Value = value[off:end]
+		body, err := proto.Marshal(res)
+		if err != nil {
+			return
+		}
+		frame = binary.AppendUvarint(frame[:0], uint64(len(body)))
+		if _, err := w.Write(frame); err != nil {
+			return
+		}
+		if _, err := w.Write(body); err != nil {
+			return
+		}
+	}
+}
+
+// acquireServerSlot takes a slot in serverSem. Low priority requests only
+// take a free slot, while high priority ones wait for one until ctx is
+// done. A slot freed while high priority requests wait always goes to one
+// of them, since the channel hands it to a blocked sender first.
+func (p *HTTPPool) acquireServerSlot(ctx context.Context) bool {
+	if PriorityFromContext(ctx) == PriorityLow {
+		select {
+		case p.serverSem <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case p.serverSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquireLoadSlot takes a slot in loadSem, waiting for one until ctx is
+// done unless ShedExcessLoads is set.
+func (p *HTTPPool) acquireLoadSlot(ctx context.Context) bool {
+	select {
+	case p.loadSem <- struct{}{}:
+		return true
+	default:
+		if p.opts.ShedExcessLoads {
+			return false
+		}
+	}
+	p.queuedLoads.Add(1)
+	defer p.queuedLoads.Add(-1)
+	select {
+	case p.loadSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// localGetter is the ProtoGetter of self returned by GetAllWithSelf. It
+// calls into the local groups directly.
+type localGetter struct {
+	url string
+}
+
+func (l localGetter) GetURL() string {
+	return l.url
+}
+
+func (l localGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return GroupNotFoundError{group: in.GetGroup()}
+	}
+	return group.ServeGet(ctx, in, out)
+}
+
+func (l localGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return GroupNotFoundError{group: in.GetGroup()}
+	}
+	return group.ServeRemove(ctx, in)
+}
+
+func (l localGetter) Set(ctx context.Context, in *pb.GetRequest, value *pb.GetResponse) error {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return GroupNotFoundError{group: in.GetGroup()}
+	}
+	return group.ServeSet(ctx, in, value)
+}
+
+type httpGetter struct {
+	getTransport func(context.Context) http.RoundTripper
+	baseURL      string
+
+	// peerTransport is the transport given by PeerTransport for this
+	// peer only, if any.
+	peerTransport http.RoundTripper
+
+	// sem holds a token for each request in flight when
+	// MaxConcurrentPerPeer is set; nil means no limit.
+	sem      chan struct{}
+	failFast bool
+	inFlight AtomicInt
+
+	removeStatusCodes    []int
+	maxPooledBufferBytes int
+	maxResponseBytes     int64
+	verifyChecksums      bool
+	cipher               *valueCipher // nil unless values are encrypted
+	contextToMetadata    func(context.Context) map[string]string
+
+	// capabilities last advertised by the peer.
+	capabilities AtomicInt
+
+	latencyMu sync.Mutex
+	latency   LatencyStats
+}
+
+func newHTTPGetter(baseURL string, opts *HTTPPoolOptions) *httpGetter {
+	h := &httpGetter{
+		getTransport: opts.Transport,
+		baseURL:      baseURL,
+		failFast:     opts.FailFastWhenSaturated,
+
+		removeStatusCodes:    opts.RemoveStatusCodes,
+		maxPooledBufferBytes: opts.MaxPooledBufferBytes,
+		maxResponseBytes:     opts.MaxResponseBytes,
+		verifyChecksums:      opts.VerifyChecksums,
+		contextToMetadata:    opts.ContextToMetadata,
+	}
+	h.cipher, _ = newValueCipher(opts.EncryptionKeys)
+	if h.removeStatusCodes == nil {
+		h.removeStatusCodes = defaultRemoveStatusCodes
+	}
+	if h.maxPooledBufferBytes == 0 {
+		h.maxPooledBufferBytes = defaultMaxPooledBufferBytes
+	}
+	if h.maxResponseBytes == 0 {
+		h.maxResponseBytes = defaultMaxResponseBytes
+	}
+	if opts.MaxConcurrentPerPeer > 0 {
+		h.sem = make(chan struct{}, opts.MaxConcurrentPerPeer)
+	}
+	return h
+}
+
+// acquire reserves a request slot for the peer, waiting for one to be
+// released unless failFast is set. Every successful acquire must be
+// paired with a call to release.
+func (h *httpGetter) acquire(ctx context.Context) error {
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+		default:
+			if h.failFast {
+				return ErrPeerSaturated
+			}
+			select {
+			case h.sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	h.inFlight.Add(1)
+	return nil
+}
+
+func (h *httpGetter) release() {
+	h.inFlight.Add(-1)
+	if h.sem != nil {
+		<-h.sem
+	}
+}
+
+// Close closes the idle connections of the transport of the peer, if it
+// has its own.
+func (h *httpGetter) Close() error {
+	if c, ok := h.peerTransport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+	return nil
+}
+
+// GetURL
+func (p *httpGetter) GetURL() string {
+	return p.baseURL
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from bufferPool, grown to hold the
+// body of res when its length is known, as far as the lengths the peer
+// may send and the buffers kept in the pool allow.
+func (h *httpGetter) getBuffer(res *http.Response) *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	n := res.ContentLength
+	if n > h.maxResponseBytes {
+		n = h.maxResponseBytes
+	}
+	if n > int64(h.maxPooledBufferBytes) {
+		n = int64(h.maxPooledBufferBytes)
+	}
+	if n > 0 {
+		b.Grow(int(n))
+	}
+	return b
+}
+
+// putBuffer returns b to bufferPool unless it grew too large to be kept.
+func (h *httpGetter) putBuffer(b *bytes.Buffer) {
+	if b.Cap() > h.maxPooledBufferBytes {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// encodeMetadata sets a header in h for each entry of md whose key is
+// valid, as documented by HTTPPoolOptions.ContextToMetadata.
+func encodeMetadata(h http.Header, md map[string]string) {
+	for k, v := range md {
+		if !validMetadataKey(k) {
+			continue
+		}
+		h.Set(metadataHeaderPrefix+k, url.QueryEscape(v))
+	}
+}
+
+// decodeMetadata returns the metadata carried by the headers h, with
+// lowercase keys. Values that cannot be unescaped are dropped.
+func decodeMetadata(h http.Header) map[string]string {
+	md := make(map[string]string)
+	for k, vs := range h {
+		if len(k) <= len(metadataHeaderPrefix) || !strings.EqualFold(k[:len(metadataHeaderPrefix)], metadataHeaderPrefix) {
+			continue
+		}
+		v, err := url.QueryUnescape(vs[0])
+		if err != nil {
+			continue
+		}
+		md[strings.ToLower(k[len(metadataHeaderPrefix):])] = v
+	}
+	return md
+}
+
+func validMetadataKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureRequestID returns ctx, with a random request ID if it carries
+// none. A nil ctx is taken as context.Background().
+func ensureRequestID(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if RequestIDFromContext(ctx) != "" {
+		return ctx
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return WithRequestID(ctx, hex.EncodeToString(b[:]))
+}
+
+// PeerRequestURL returns the URL at which the peer serving groupcache
+// requests at baseURL, e.g. "http://10.0.0.2:8008/_groupcache/", serves
+// the group and key of in. It lets ProtoGetters made by GetterFactory
+// address HTTPPool peers.
+func PeerRequestURL(baseURL string, in *pb.GetRequest) string {
+	return fmt.Sprintf(
+		"%v%v/%v",
+		baseURL,
+		url.PathEscape(in.GetGroup()),
+		url.PathEscape(in.GetKey()),
+	)
+}
+
+// parsePeerPath returns the group and key of the escaped path of a URL
+// made by PeerRequestURL, relative to its base URL. It only allocates to
+// unescape them.
+func parsePeerPath(path string) (group, key string, err error) {
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return "", "", BadGroupcacheRequestError{message: "invalid request URL (missing path parts)"}
+	}
+	if group, err = url.PathUnescape(path[:i]); err != nil {
+		return "", "", BadGroupcacheRequestError{message: "invalid request URL (bad group escaping)"}
+	}
+	if key, err = url.PathUnescape(path[i+1:]); err != nil {
+		return "", "", BadGroupcacheRequestError{message: "invalid request URL (bad key escaping)"}
+	}
+	return group, key, nil
+}
+
+func (h *httpGetter) makeRequest(ctx context.Context, method string, in *pb.GetRequest, body []byte) (*http.Response, error) {
+	// Pass along the context to the RoundTripper
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, PeerRequestURL(h.baseURL, in), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(capabilitiesHeader, supportedCapabilities.String())
+	req.Header.Set(requestIDHeader, RequestIDFromContext(ctx))
+	if in.GetVersion() != "" {
+		req.Header.Set(versionHeader, in.GetVersion())
+	}
+	if in.GetEtag() != "" {
+		req.Header.Set("If-None-Match", `"`+in.GetEtag()+`"`)
+	}
+	if PriorityFromContext(ctx) == PriorityLow {
+		req.Header.Set(priorityHeader, "low")
+	}
+	if cacheOnlyFromContext(ctx) {
+		req.Header.Set(cacheOnlyHeader, "1")
+	}
+	if h.contextToMetadata != nil {
+		encodeMetadata(req.Header, h.contextToMetadata(ctx))
+	}
+
+	tr := http.DefaultTransport
+	if h.getTransport != nil {
+		tr = h.getTransport(ctx)
+	}
+
+	start := time.Now()
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	h.latencyMu.Lock()
+	h.latency.add(time.Since(start))
+	h.latencyMu.Unlock()
+	h.capabilities.Store(int64(parseCapabilities(res.Header.Get(capabilitiesHeader))))
+	return res, nil
+}
+
+func (h *httpGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	ctx = ensureRequestID(ctx)
+	err := h.get(ctx, in, out)
+	if errors.Is(err, ErrChecksumMismatch) && ctx.Err() == nil {
+		// A corruption in transit is unlikely to happen twice in a row.
+		out.Reset()
+		err = h.get(ctx, in, out)
+	}
+	return err
+}
+
+// get implements Get with a single request.
+func (h *httpGetter) get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	if err := h.acquire(ctx); err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer h.release()
+
+	res, err := h.makeRequest(ctx, http.MethodGet, in, nil)
+	if err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer res.Body.Close()
+
+	// Not every RoundTripper aborts reading the body once ctx is done.
+	stop := context.AfterFunc(ctx, func() { res.Body.Close() })
+	defer stop()
+
+	if res.StatusCode == http.StatusOK && res.Header.Get("Content-Type") == chunkedContentType {
+		if err := readChunks(res.Body, out, h.maxResponseBytes); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			return newRemoteLoadErrorWithResp(ctx, in, res, nil, err)
+		}
+		return h.checkValue(ctx, in, res, out)
+	}
+
+	if res.ContentLength > h.maxResponseBytes {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, errors.Wrapf(ErrResponseTooLarge, "%d bytes", res.ContentLength))
+	}
+	b := h.getBuffer(res)
+	defer h.putBuffer(b)
+	_, err = io.Copy(b, io.LimitReader(res.Body, h.maxResponseBytes+1))
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, ctxErr)
+	}
+	if int64(b.Len()) > h.maxResponseBytes {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, errors.Wrapf(ErrResponseTooLarge, "more than %d bytes", h.maxResponseBytes))
+	}
+	if res.StatusCode == http.StatusNotModified && in.GetEtag() != "" {
+		if err := expireFromHeader(res.Header, out); err != nil {
+			return newRemoteLoadErrorWithResp(ctx, in, res, nil, err)
+		}
+		notModified := true
+		out.NotModified, out.Etag = &notModified, in.Etag
+		if version := res.Header.Get(versionHeader); version != "" {
+			out.Version = &version
+		}
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return newRemoteLoadErrorWithResp(ctx, in, res, cloneBytes(b.Bytes()), errors.Errorf("non-OK response code: %d %s", res.StatusCode, res.Status))
+	}
+	if err != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, errors.Wrapf(err, "reading response body"))
+	}
+
+	err = proto.Unmarshal(b.Bytes(), out)
+	if err != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, cloneBytes(b.Bytes()), undecodableError{what: "decoding response body", err: err})
+	}
+	if err := expireFromHeader(res.Header, out); err != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, err)
+	}
+	return h.checkValue(ctx, in, res, out)
+}
+
+// checkValue verifies the checksum of the value of out if asked to, then
+// decrypts it if values are encrypted. The checksum of an encrypted
+// value is of the ciphertext.
+func (h *httpGetter) checkValue(ctx context.Context, in *pb.GetRequest, res *http.Response, out *pb.GetResponse) error {
+	if h.verifyChecksums && out.Checksum != nil && crc32.Checksum(out.Value, crc32cTable) != *out.Checksum {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, ErrChecksumMismatch)
+	}
+	if h.cipher != nil {
+		if err := h.cipher.open(out, in.GetGroup(), in.GetKey()); err != nil {
+			return newRemoteLoadErrorWithResp(ctx, in, res, nil, err)
+		}
+	}
+	return nil
+}
+
+func (h *httpGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	ctx = ensureRequestID(ctx)
+	if err := h.acquire(ctx); err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer h.release()
+
+	res, err := h.makeRequest(ctx, http.MethodDelete, in, nil)
+	if err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusPreconditionFailed && in.GetVersion() != "" {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, ErrVersionMismatch)
+	}
+	for _, code := range h.removeStatusCodes {
+		if res.StatusCode == code {
+			if code == http.StatusNotFound && res.Header.Get(notFoundHeader) != "key" {
+				// The group, or the pool itself, was not found.
+				break
+			}
+			return nil
+		}
+	}
+
+	b := h.getBuffer(res)
+	defer h.putBuffer(b)
+	if _, err := io.Copy(b, io.LimitReader(res.Body, h.maxResponseBytes)); err != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, errors.Wrapf(err, "reading response body"))
+	}
+	return newRemoteLoadErrorWithResp(ctx, in, res, cloneBytes(b.Bytes()), errors.Errorf("unexpected response code: %d %s", res.StatusCode, res.Status))
+}
+
+// Set pushes value to the peer, which caches it for the key of in unless
+// it already has one.
+func (h *httpGetter) Set(ctx context.Context, in *pb.GetRequest, value *pb.GetResponse) error {
+	ctx = ensureRequestID(ctx)
+	if err := h.acquire(ctx); err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer h.release()
+
+	req := &pb.GetResponse{Value: value.Value, Expire: value.Expire, Version: value.Version}
+	if h.cipher != nil {
+		if err := h.cipher.seal(req, in.GetGroup(), in.GetKey()); err != nil {
+			return newRemoteLoadError(ctx, in, err)
+		}
+	}
+	checksum := crc32.Checksum(req.Value, crc32cTable)
+	req.Checksum = &checksum
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+
+	res, err := h.makeRequest(ctx, http.MethodPut, in, body)
+	if err != nil {
+		return newRemoteLoadError(ctx, in, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	b := h.getBuffer(res)
+	defer h.putBuffer(b)
+	if _, err := io.Copy(b, io.LimitReader(res.Body, h.maxResponseBytes)); err != nil {
+		return newRemoteLoadErrorWithResp(ctx, in, res, nil, errors.Wrapf(err, "reading response body"))
+	}
+	return newRemoteLoadErrorWithResp(ctx, in, res, cloneBytes(b.Bytes()), errors.Errorf("unexpected response code: %d %s", res.StatusCode, res.Status))
+}
+
+// expireFromHeader sets the expiry of out from the expireHeader of h
+// if out has none.
+func expireFromHeader(h http.Header, out *pb.GetResponse) error {
+	v := h.Get(expireHeader)
+	if out.Expire != nil || v == "" {
+		return nil
+	}
+	expire, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s header", expireHeader)
+	}
+	out.Expire = &expire
+	return nil
+}
+
+// readChunks reads into out a value sent in chunks by writeChunks,
+// copying each chunk into the value as it arrives. The value must not
+// be larger than maxBytes.
+func readChunks(body io.Reader, out *pb.GetResponse, maxBytes int64) error {
+	r := bufio.NewReader(body)
+	var frame []byte
+	var value []byte
+	for first := true; first || len(value) < cap(value); first = false {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errors.Wrap(noEOF(err), "reading chunk length")
+		}
+		if n > uint64(maxBytes) || n > uint64(math.MaxInt32) {
+			return errors.Wrapf(ErrResponseTooLarge, "chunk of %d bytes", n)
+		}
+		if uint64(cap(frame)) < n {
+			frame = make([]byte, n)
+		}
+		frame = frame[:n]
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return errors.Wrap(noEOF(err), "reading chunk")
+		}
+		chunk := out
+		if !first {
+			chunk = &pb.GetResponse{}
+		}
+		if err := proto.Unmarshal(frame, chunk); err != nil {
+			return undecodableError{what: "decoding chunk", err: err}
+		}
+		if first {
+			if chunk.GetTotalSize() < 0 {
+				return errors.Errorf("invalid chunked value size %d", chunk.GetTotalSize())
+			}
+			if chunk.GetTotalSize() > maxBytes || chunk.GetTotalSize() > math.MaxInt32 {
+				return errors.Wrapf(ErrResponseTooLarge, "value of %d bytes", chunk.GetTotalSize())
+			}
+			value = make([]byte, 0, chunk.GetTotalSize())
+		}
+		if chunk.GetOffset() != int64(len(value)) || len(chunk.Value) == 0 || len(chunk.Value) > cap(value)-len(value) {
+			return errors.Errorf("chunk of %d bytes at offset %d does not follow %d of %d bytes", len(chunk.Value), chunk.GetOffset(), len(value), cap(value))
+		}
+		value = append(value, chunk.Value...)
+	}
+	out.Value, out.TotalSize, out.Offset = value, nil, nil
+	return nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, since a chunked response
+// only ends after its last chunk.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func DefaultServerErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+
+	loggerFromContext(ctx).Debug("error while retrieving cache entry", "url", r.URL.String(), "requestID", RequestIDFromContext(ctx), "error", err)
+
+	if errors.Is(err, ErrOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, ErrServerOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	switch err.(type) {
+	case BadGroupcacheRequestError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case GroupNotFoundError:
 		http.Error(w, err.Error(), http.StatusNotFound)
+	case UnexpectedPathError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case MethodNotAllowedError:
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	case LoadTimeoutError:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
 	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -356,16 +2572,29 @@ func (e GroupNotFoundError) Error() string {
 	return fmt.Sprintf("group not found: %q", e.group)
 }
 
-func newRemoteLoadError(get *pb.GetRequest, err error) RemoteLoadError {
+func (e MethodNotAllowedError) Error() string {
+	return fmt.Sprintf("method not allowed: %q", e.method)
+}
+
+func (e UnexpectedPathError) Error() string {
+	return fmt.Sprintf("unexpected path: %q", e.path)
+}
+
+func (e LoadTimeoutError) Error() string {
+	return fmt.Sprintf("loading %q from group %q took longer than %v", e.Key, e.Group, e.Timeout)
+}
+
+func newRemoteLoadError(ctx context.Context, get *pb.GetRequest, err error) RemoteLoadError {
 	return RemoteLoadError{
 		Group: get.GetGroup(),
 		Key:   get.GetKey(),
 
-		Err: err,
+		Err:       err,
+		RequestID: RequestIDFromContext(ctx),
 	}
 }
 
-func newRemoteLoadErrorWithResp(get *pb.GetRequest, resp http.Response, body []byte, err error) RemoteLoadError {
+func newRemoteLoadErrorWithResp(ctx context.Context, get *pb.GetRequest, resp *http.Response, body []byte, err error) RemoteLoadError {
 	return RemoteLoadError{
 		Group: get.GetGroup(),
 		Key:   get.GetKey(),
@@ -374,7 +2603,45 @@ func newRemoteLoadErrorWithResp(get *pb.GetRequest, resp http.Response, body []b
 		Status:     resp.Status,
 		Body:       body,
 		Err:        err,
+		RetryAfter: retryAfter(resp, time.Now()),
+		RequestID:  RequestIDFromContext(ctx),
+	}
+}
+
+// isTransientRemoveError reports whether retrying a remove that failed
+// with err may succeed.
+func isTransientRemoveError(err error) bool {
+	if errors.Is(err, ErrVersionMismatch) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var remote RemoteLoadError
+	if errors.As(err, &remote) && remote.StatusCode != 0 {
+		return remote.StatusCode >= 500 || remote.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// retryAfter returns the delay requested by the Retry-After header of
+// resp, given in seconds or as an HTTP date relative to now, if resp is a
+// 429 or 503 response.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs <= 0 || secs > int64(math.MaxInt64/time.Second) {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
 	}
+	return 0
 }
 
 func (r RemoteLoadError) Error() string {
@@ -17,21 +17,35 @@ limitations under the License.
 package groupcache
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"accedo.io/groupcache/v2/consistenthash"
+	pb "accedo.io/groupcache/v2/groupcachepb"
 )
 
 var (
@@ -92,6 +106,7 @@ func TestHTTPPool(t *testing.T) {
 
 	// Use a dummy self address so that we don't handle gets in-process.
 	p := NewHTTPPool("should-be-ignored")
+	defer p.Close()
 	p.Set(addrToURL(childAddr)...)
 
 	// Dummy getter function. Gets should go to children only.
@@ -219,3 +234,2821 @@ func awaitAddrReady(t *testing.T, addr string, wg *sync.WaitGroup) {
 		time.Sleep(delay)
 	}
 }
+
+func TestHTTPGetterMaxConcurrentPerPeer(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{
+		MaxConcurrentPerPeer:  1,
+		FailFastWhenSaturated: true,
+	})
+
+	group, key := "group", "key"
+	req := &pb.GetRequest{Group: &group, Key: &key}
+	done := make(chan error)
+	go func() {
+		done <- h.Remove(context.Background(), req)
+	}()
+	for h.inFlight.Get() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := h.Get(context.Background(), req, &pb.GetResponse{})
+	if !errors.Is(err, ErrPeerSaturated) {
+		t.Errorf("Get on saturated peer = %v; want ErrPeerSaturated", err)
+	}
+
+	// Without fail fast, the caller waits until its context is done.
+	h.failFast = false
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Get(ctx, req, &pb.GetResponse{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get on saturated peer = %v; want context.DeadlineExceeded", err)
+	}
+
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := h.inFlight.Get(); n != 0 {
+		t.Errorf("inFlight = %d after requests completed; want 0", n)
+	}
+}
+
+func TestHTTPGetterRemoveStatusCodes(t *testing.T) {
+	var status int
+	var notFound string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notFound != "" {
+			w.Header().Set(notFoundHeader, notFound)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group, key := "group", "key"
+	req := &pb.GetRequest{Group: &group, Key: &key}
+
+	for _, status = range []int{http.StatusOK, http.StatusNoContent} {
+		if err := h.Remove(context.Background(), req); err != nil {
+			t.Errorf("Remove with status %d = %v; want nil", status, err)
+		}
+	}
+	status, notFound = http.StatusNotFound, "key"
+	if err := h.Remove(context.Background(), req); err != nil {
+		t.Errorf("Remove with status 404 for a missing key = %v; want nil", err)
+	}
+	notFound = ""
+
+	// A 404 for a group the peer does not have is a failure.
+	p := &HTTPPool{opts: HTTPPoolOptions{BasePath: defaultBasePath, ServerErrorHandler: DefaultServerErrorHandler}}
+	tsPool := httptest.NewServer(p)
+	defer tsPool.Close()
+	missing := newHTTPGetter(tsPool.URL+defaultBasePath, &HTTPPoolOptions{})
+	var gerr RemoteLoadError
+	if err := missing.Remove(context.Background(), req); !errors.As(err, &gerr) || gerr.StatusCode != http.StatusNotFound {
+		t.Errorf("Remove of a key of a missing group = %v; want a 404 RemoteLoadError", err)
+	}
+
+	status = http.StatusInternalServerError
+	err := h.Remove(context.Background(), req)
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Remove with status %d = %v; want RemoteLoadError", status, err)
+	}
+	if rerr.StatusCode != status {
+		t.Errorf("RemoteLoadError.StatusCode = %d; want %d", rerr.StatusCode, status)
+	}
+}
+
+func TestServeHTTPRejectsUnsupportedMethods(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	loads := 0
+	g := newGroup("TestServeHTTPRejectsUnsupportedMethods-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	// Browsers send OPTIONS to preflight cross-origin requests.
+	for _, method := range []string{http.MethodPost, http.MethodPatch, http.MethodOptions} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, defaultBasePath+g.Name()+"/key", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status = %d; want %d", method, rec.Code, http.StatusMethodNotAllowed)
+		}
+		if got := rec.Header().Get("Allow"); got != allowedMethods {
+			t.Errorf("%s: Allow = %q; want %q", method, got, allowedMethods)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("getter called %d times for rejected methods; want 0", loads)
+	}
+	if n := g.Stats.ServerRejectedMethods.Get(); n != 3 {
+		t.Errorf("ServerRejectedMethods = %d; want 3", n)
+	}
+
+	// Methods are rejected before looking the group up, and counted by
+	// the pool when there is none.
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, defaultBasePath+"no-such-group/key", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != allowedMethods {
+		t.Errorf("POST to an unknown group = %d with Allow %q; want %d with %q", rec.Code, rec.Header().Get("Allow"), http.StatusMethodNotAllowed, allowedMethods)
+	}
+	if n := p.Stats().RejectedMethods; n != 1 {
+		t.Errorf("pool RejectedMethods = %d; want 1", n)
+	}
+}
+
+func TestHTTPPoolServesPushedValues(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	loads := 0
+	g := newGroup("TestHTTPPoolServesPushedValues-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetString("loaded", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	push := func(key, value string, expire time.Time) error {
+		name := g.Name()
+		var e int64
+		if !expire.IsZero() {
+			e = expire.UnixNano()
+		}
+		return h.Set(context.Background(), &pb.GetRequest{Group: &name, Key: &key}, &pb.GetResponse{Value: []byte(value), Expire: &e})
+	}
+	if err := push("key", "pushed", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// An expired value is dropped, and a cached one kept.
+	if err := push("expired", "pushed", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := push("key", "again", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s)); err != nil || s != "pushed" {
+		t.Errorf("Get of a pushed key = %q, %v; want %q", s, err, "pushed")
+	}
+	if err := g.Get(dummyCtx, "expired", StringSink(&s)); err != nil || s != "loaded" {
+		t.Errorf("Get of an expired pushed key = %q, %v; want %q", s, err, "loaded")
+	}
+	if loads != 1 {
+		t.Errorf("getter called %d times; want 1", loads)
+	}
+}
+
+func TestServeHTTPUnexpectedPath(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unexpected/group/key", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	p.opts.PanicOnUnexpectedPath = true
+	defer func() {
+		if recover() == nil {
+			t.Error("ServeHTTP did not panic with PanicOnUnexpectedPath")
+		}
+	}()
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unexpected/group/key", nil))
+}
+
+func TestHTTPPoolSetE(t *testing.T) {
+	p := &HTTPPool{
+		self: normalizeSelfURL("http://host:8000"),
+		opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas},
+	}
+
+	err := p.SetE("http://peer:8000", "", "peer:8000", "/path")
+	if err == nil {
+		t.Fatal("SetE with invalid peers succeeded")
+	}
+	for _, invalid := range []string{`""`, `"peer:8000"`, `"/path"`} {
+		if !strings.Contains(err.Error(), invalid) {
+			t.Errorf("SetE error %q does not mention %s", err, invalid)
+		}
+	}
+	if p.peers != nil {
+		t.Error("SetE with invalid peers updated the pool")
+	}
+
+	if err := p.SetE("http://HOST:8000/", "HTTP://Peer:8000//"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"http://host:8000", "http://peer:8000"} {
+		if _, ok := p.getters[want]; !ok {
+			t.Errorf("pool has no getter for %q", want)
+		}
+	}
+	if got := p.getters["http://peer:8000"].GetURL(); got != "http://peer:8000"+defaultBasePath {
+		t.Errorf("GetURL = %q; want no duplicate slashes", got)
+	}
+	for _, key := range testKeys(100) {
+		if peer, ok := p.PickPeer(key); ok && peer == p.getters["http://host:8000"] {
+			t.Fatalf("PickPeer(%q) picked self", key)
+		}
+	}
+}
+
+func TestHTTPPoolSetWeighted(t *testing.T) {
+	p := &HTTPPool{
+		self: normalizeSelfURL("http://10.0.0.1:8000"),
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+		},
+	}
+	if err := p.SetWeighted(map[string]int{"http://10.0.0.1:8000": 1, "http://10.0.0.2:8000": 0}); err == nil || !strings.Contains(err.Error(), "10.0.0.2") {
+		t.Errorf("SetWeighted with a zero weight = %v; want an error naming the peer", err)
+	}
+	if p.peers != nil {
+		t.Error("SetWeighted with invalid weights updated the pool")
+	}
+
+	if err := p.SetWeighted(map[string]int{"http://10.0.0.1:8000/": 1, "http://10.0.0.2:8000": 3}); err != nil {
+		t.Fatal(err)
+	}
+	remote := 0
+	keys := testKeys(4000)
+	for _, key := range keys {
+		if _, ok := p.PickPeer(key); ok {
+			remote++
+		}
+	}
+	if got := float64(remote) / float64(len(keys)); got < 0.65 || got > 0.85 {
+		t.Errorf("peer of weight 3 owns %.2f of the keys; want about 0.75", got)
+	}
+
+	info := p.RingInfo()
+	if want := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"}; !reflect.DeepEqual(info.Members, want) {
+		t.Errorf("RingInfo().Members = %q; want %q", info.Members, want)
+	}
+	if n := info.Replicas["http://10.0.0.2:8000"]; n != 3*defaultReplicas {
+		t.Errorf("RingInfo().Replicas of the peer of weight 3 = %d; want %d", n, 3*defaultReplicas)
+	}
+	if got := info.Distribution["http://10.0.0.2:8000"]; got < 0.65 || got > 0.85 {
+		t.Errorf("RingInfo().Distribution of the peer of weight 3 = %.2f; want about 0.75", got)
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	for _, tt := range []struct{ key, want string }{
+		{"user:42:profile", "user:42:profile"},
+		{"user:{42}:profile", "42"},
+		{"{42}", "42"},
+		{"user:{}:profile", "user:{}:profile"},     // empty tag
+		{"user:{42:profile", "user:{42:profile"},   // unterminated
+		{"user:}42{:profile", "user:}42{:profile"}, // "}" before "{"
+		{"user:{42}:{43}", "42"},                   // first tag only
+		{"user:{{42}}", "{42"},                     // up to the first "}"
+		{"", ""},
+	} {
+		if got := HashTag(tt.key); got != tt.want {
+			t.Errorf("HashTag(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPPoolKeyTagFunc(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath:   defaultBasePath,
+			Replicas:   defaultReplicas,
+			HashFn:     consistenthash.Hash32(crc32.ChecksumIEEE),
+			KeyTagFunc: HashTag,
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000")
+
+	owner := func(key string) string {
+		if peer, ok := p.PickPeer(key); ok {
+			return peer.GetURL()
+		}
+		return "self"
+	}
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user:{%d}", i)
+		if a, b := owner(user+":profile"), owner(user+":settings"); a != b {
+			t.Errorf("%s:profile is owned by %s but %s:settings by %s", user, a, user, b)
+		}
+		if a, b := owner(user+":profile"), owner(strconv.Itoa(i)); a != b {
+			t.Errorf("%s:profile is owned by %s but %d by %s", user, a, i, b)
+		}
+	}
+	// Keys without tags still spread over the peers.
+	owners := make(map[string]bool)
+	for _, key := range testKeys(100) {
+		owners[owner(key)] = true
+	}
+	if len(owners) != 3 {
+		t.Errorf("keys without tags are owned by %d peers; want 3", len(owners))
+	}
+}
+
+func TestHTTPPoolBoundedLoads(t *testing.T) {
+	const loadFactor = 1.25
+	p := &HTTPPool{
+		self: "http://10.0.0.9:8000",
+		opts: HTTPPoolOptions{
+			BasePath:   defaultBasePath,
+			Replicas:   defaultReplicas,
+			LoadFactor: loadFactor,
+		},
+	}
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000", "http://10.0.0.4:8000"}
+	p.Set(peers...)
+
+	// Skewed keyspace whose requests stay in flight.
+	var total int64
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("hot-%d", i%3)
+		if i%5 == 0 {
+			key = fmt.Sprintf("cold-%d", i)
+		}
+		peer, ok := p.PickPeer(key)
+		if !ok {
+			t.Fatalf("PickPeer(%q) picked self, which is not a peer", key)
+		}
+		peer.(*httpGetter).inFlight.Add(1)
+		total++
+
+		bound := int64(math.Ceil(loadFactor * float64(total) / float64(len(peers))))
+		for url, stats := range p.PeerStats() {
+			if stats.InFlight > bound {
+				t.Fatalf("after %d requests, %s has %d in flight; want at most %d", total, url, stats.InFlight, bound)
+			}
+		}
+	}
+
+	if err := (&HTTPPoolOptions{LoadFactor: 0.5}).validate(false); err == nil {
+		t.Error("LoadFactor 0.5 is valid; want an error")
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for _, tt := range []struct {
+		basePath string
+		peer     string
+		want     string
+	}{
+		{"/_groupcache/", "http://peer:8000", "http://peer:8000/_groupcache/"},
+		{"/_groupcache", "http://peer:8000/", "http://peer:8000/_groupcache/"},
+		{"_groupcache/", "http://peer:8000", "http://peer:8000/_groupcache/"},
+		{"//_groupcache//", "http://peer:8000//", "http://peer:8000/_groupcache/"},
+		{"/a/b", "http://peer:8000/", "http://peer:8000/a/b/"},
+		{"/", "http://peer:8000", "http://peer:8000/"},
+		{"//", "http://peer:8000/", "http://peer:8000/"},
+	} {
+		p := &HTTPPool{opts: HTTPPoolOptions{
+			BasePath:           normalizeBasePath(tt.basePath),
+			Replicas:           defaultReplicas,
+			ServerErrorHandler: DefaultServerErrorHandler,
+		}}
+		p.Set(tt.peer)
+		var got string
+		for _, g := range p.getters {
+			got = g.GetURL()
+		}
+		if got != tt.want {
+			t.Errorf("BasePath %q, peer %q: GetURL = %q; want %q", tt.basePath, tt.peer, got, tt.want)
+		}
+
+		// The server finds the group and key of requests to that URL.
+		u, _ := url.Parse(PeerRequestURL(got, &pb.GetRequest{Group: proto.String("group"), Key: proto.String("key")}))
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.Path, nil))
+		if want := (GroupNotFoundError{group: "group"}).Error(); !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("BasePath %q: response to %s = %q; want %q", tt.basePath, u.Path, rec.Body, want)
+		}
+	}
+}
+
+func TestMultipleHTTPPools(t *testing.T) {
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	pools := make(map[string]*HTTPPool)
+	for _, cluster := range []string{"cluster-a", "cluster-b"} {
+		cluster := cluster
+		p, err := NewHTTPPoolWith(ts.URL, WithBasePath(cluster))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		p.Set(ts.URL)
+		mux.Handle(p.opts.BasePath, p)
+		pools[cluster] = p
+
+		g := NewGroup("TestMultipleHTTPPools-"+cluster, cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+			return dest.SetString(cluster+":"+key, time.Time{})
+		}), WithPeerPicker(p))
+		defer DeregisterGroup(g.Name())
+	}
+
+	if _, err := NewHTTPPoolWith(ts.URL, WithBasePath("/cluster-a/")); err == nil || !strings.Contains(err.Error(), "/cluster-a/") {
+		t.Errorf("NewHTTPPoolWith with a BasePath in use = %v; want an error naming it", err)
+	}
+
+	for cluster, p := range pools {
+		// Each pool serves its own group from its BasePath.
+		peer := newHTTPGetter(ts.URL+"/"+cluster+"/", &p.opts)
+		group, key := "TestMultipleHTTPPools-"+cluster, "key"
+		var res pb.GetResponse
+		if err := peer.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, &res); err != nil {
+			t.Fatalf("Get from the pool of %s: %v", cluster, err)
+		}
+		if want := cluster + ":key"; string(res.Value) != want {
+			t.Errorf("Get from the pool of %s = %q; want %q", cluster, res.Value, want)
+		}
+	}
+
+	// Closing a pool frees its BasePath.
+	if err := pools["cluster-b"].Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewHTTPPoolWith(ts.URL, WithBasePath("cluster-b"))
+	if err != nil {
+		t.Fatalf("NewHTTPPoolWith after closing the pool of the BasePath: %v", err)
+	}
+	_ = p.Close()
+}
+
+func TestHTTPPoolDefaultAfterClose(t *testing.T) {
+	defer func(old func(string) PeerPicker) { portPicker = old }(portPicker)
+	portPicker = nil
+
+	first, err := NewHTTPPoolWith("http://self", WithBasePath("/TestHTTPPoolDefaultAfterClose-first/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewHTTPPoolWith("http://self", WithBasePath("/TestHTTPPoolDefaultAfterClose-other/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if got := getPeers("group"); got != first {
+		t.Fatalf("default PeerPicker = %v; want the first pool", got)
+	}
+
+	// Once the default pool is closed, the next pool takes over even
+	// though another one is still open.
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewHTTPPoolWith("http://self", WithBasePath("/TestHTTPPoolDefaultAfterClose-next/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	if got := getPeers("group"); got != next {
+		t.Errorf("default PeerPicker after closing the first pool = %v; want the next pool", got)
+	}
+}
+
+func TestHTTPPoolRegistrationConcurrentWithGroups(t *testing.T) {
+	defer func(old func(string) PeerPicker) { portPicker = old }(portPicker)
+	portPicker = nil
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if pk := getPeers("group"); pk == nil {
+				t.Error("getPeers returned nil")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p, err := NewHTTPPoolWith("http://self", WithBasePath("/TestHTTPPoolRegistrationConcurrentWithGroups/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = p.Close()
+	}
+	<-done
+}
+
+func TestHTTPPoolClose(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	// The pool creates its own transport to tune its connections.
+	p := NewHTTPPoolOpts("http://self", &HTTPPoolOptions{BasePath: "/TestHTTPPoolClose/", MaxIdleConnsPerHost: 1})
+	p.Set(ts.URL)
+
+	// Leave an idle keep-alive connection to the peer behind.
+	group, key := "group", "key"
+	for _, peer := range p.GetAll() {
+		if err := peer.Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if peer, ok := p.PickPeer(key); ok {
+		t.Errorf("PickPeer after Close = %v; want none", peer)
+	}
+	if n := len(p.GetAll()); n != 0 {
+		t.Errorf("GetAll after Close returned %d peers; want 0", n)
+	}
+	if err := p.SetE(ts.URL); err == nil {
+		t.Error("SetE after Close succeeded")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection of the pool still open after Close")
+	}
+
+	// A transport of the options belongs to the caller, and is left
+	// alone.
+	var calls int32
+	tr := &closeIdleCounter{RoundTripper: &http.Transport{}}
+	user := &HTTPPool{
+		self: "http://self",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			Transport: func(context.Context) http.RoundTripper {
+				atomic.AddInt32(&calls, 1)
+				return tr
+			},
+		},
+	}
+	user.Set(ts.URL)
+	if err := user.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("Close called the Transport option %d times; want 0", n)
+	}
+	if n := atomic.LoadInt32(&tr.closes); n != 0 {
+		t.Errorf("Close closed the idle connections of the Transport option %d times; want 0", n)
+	}
+}
+
+// closeIdleCounter counts the calls to its CloseIdleConnections.
+type closeIdleCounter struct {
+	http.RoundTripper
+	closes int32
+}
+
+func (c *closeIdleCounter) CloseIdleConnections() {
+	atomic.AddInt32(&c.closes, 1)
+}
+
+func TestHTTPGetterBoundsBodies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 1<<16))
+	}))
+	defer ts.Close()
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{MaxResponseBytes: 1024, MaxPooledBufferBytes: 512})
+
+	// The error body of a remove is read up to MaxResponseBytes.
+	group, key := "group", "key"
+	err := h.Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key})
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || len(rerr.Body) != 1024 {
+		t.Errorf("Remove = %v with a %d byte body; want a RemoteLoadError with 1024 bytes", err, len(rerr.Body))
+	}
+
+	// Buffers are not grown beyond what the pool keeps for the length
+	// announced by the peer.
+	b := h.getBuffer(&http.Response{ContentLength: 1 << 40})
+	if b.Cap() > 1024 {
+		t.Errorf("getBuffer for a huge ContentLength has capacity %d; want at most 1024", b.Cap())
+	}
+}
+
+func BenchmarkHTTPGetterLargeValues(b *testing.B) {
+	body, err := proto.Marshal(&pb.GetResponse{Value: make([]byte, 4<<20)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	for _, bm := range []struct {
+		name     string
+		maxBytes int
+	}{
+		{"Uncapped", len(body) * 2},
+		{"Capped", defaultMaxPooledBufferBytes},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{MaxPooledBufferBytes: bm.maxBytes})
+			group, key := "group", "key"
+			req := &pb.GetRequest{Group: &group, Key: &key}
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					if err := h.Get(context.Background(), req, &pb.GetResponse{}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			b.ReportMetric(float64(ms.HeapInuse), "heap-inuse-bytes")
+		})
+	}
+}
+
+func TestHTTPPoolPickPeerDuringSet(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas},
+	}
+	if peer, ok := p.PickPeer("key"); ok {
+		t.Fatalf("PickPeer before Set = %v; want none", peer)
+	}
+	sets := [][]string{
+		{"http://10.0.0.1:8000", "http://10.0.0.2:8000"},
+		{"http://10.0.0.1:8000", "http://10.0.0.3:8000", "http://10.0.0.4:8000"},
+	}
+	p.Set(sets[0]...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			p.Set(sets[i%2]...)
+		}
+	}()
+	keys := testKeys(64)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, key := range keys {
+			// A picked peer always comes with its getter.
+			if peer, ok := p.PickPeer(key); ok && peer == nil {
+				t.Fatalf("PickPeer(%q) picked a peer without a getter", key)
+			}
+			for _, peer := range p.PickPeers(key, 2) {
+				if peer != nil && peer.GetURL() == "" {
+					t.Fatalf("PickPeers(%q) picked a peer without a URL", key)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkHTTPPoolPickPeer(b *testing.B) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas},
+	}
+	peers := make([]string, 16)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://10.0.0.%d:8000", i+1)
+	}
+	p.Set(peers...)
+	keys := testKeys(1024)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			p.PickPeer(keys[i%len(keys)])
+		}
+	})
+}
+
+func TestHTTPGetterVerifyChecksums(t *testing.T) {
+	value := []byte("value")
+	checksum := crc32.Checksum(value, crc32cTable)
+	var corrupt, requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		res := &pb.GetResponse{Value: value, Checksum: &checksum}
+		if corrupt > 0 {
+			corrupt--
+			res.Value = []byte("vAlue")
+		}
+		body, _ := proto.Marshal(res)
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	group, key := "group", "key"
+	req := &pb.GetRequest{Group: &group, Key: &key}
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{VerifyChecksums: true})
+	if err := h.Get(context.Background(), req, &pb.GetResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value corrupted once is requested again.
+	corrupt, requests = 1, 0
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), req, out); err != nil || string(out.Value) != "value" || requests != 2 {
+		t.Errorf("Get of a value corrupted once = %q, %v after %d requests; want value after 2", out.Value, err, requests)
+	}
+
+	corrupt, requests = 2, 0
+	err := h.Get(context.Background(), req, &pb.GetResponse{})
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get of corrupted value = %v; want RemoteLoadError wrapping ErrChecksumMismatch", err)
+	}
+	if requests != 2 {
+		t.Errorf("Get of corrupted value made %d requests; want 2", requests)
+	}
+
+	// Verification is opt-in.
+	corrupt = 1
+	h = newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	if err := h.Get(context.Background(), req, &pb.GetResponse{}); err != nil {
+		t.Errorf("Get without verification = %v; want nil", err)
+	}
+}
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	g := newGroup("TestCapabilitiesNegotiation-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	get := func(caps string) (*http.Response, *pb.GetResponse) {
+		req := httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/key", nil)
+		if caps != "" {
+			req.Header.Set(capabilitiesHeader, caps)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		out := &pb.GetResponse{}
+		if err := proto.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result(), out
+	}
+
+	// Peers that predate capabilities get no checksum.
+	res, out := get("")
+	if got := res.Header.Get(capabilitiesHeader); got != supportedCapabilities.String() {
+		t.Errorf("server advertised capabilities %q; want %q", got, supportedCapabilities)
+	}
+	if out.Checksum != nil {
+		t.Error("server sent a checksum to a peer without capabilities")
+	}
+
+	// Unknown capabilities are ignored.
+	if _, out = get("ff00000000000001"); out.Checksum == nil {
+		t.Error("server sent no checksum to a peer supporting it")
+	}
+
+	p.Set(ts.URL)
+	group, key := g.Name(), "key"
+	for _, peer := range p.GetAll() {
+		if err := peer.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for peer, stats := range p.PeerStats() {
+		if !stats.Capabilities.Has(CapChecksum) {
+			t.Errorf("capabilities of %s = %v; want checksum support", peer, stats.Capabilities)
+		}
+	}
+}
+
+func TestDetectSelf(t *testing.T) {
+	defer func(orig func() ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1")},
+			&net.IPNet{IP: net.ParseIP("fe80::1")},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1")},
+			&net.IPNet{IP: net.ParseIP("10.0.0.2")},
+		}, nil
+	}
+	t.Setenv(selfHostEnv, "")
+
+	for _, tt := range []struct {
+		listenAddr string
+		opts       []DetectSelfOption
+		want       string
+	}{
+		{":8080", nil, "http://10.0.0.2:8080"},
+		{"0.0.0.0:8080", []DetectSelfOption{WithSelfScheme("https")}, "https://10.0.0.2:8080"},
+		{"[::]:8080", []DetectSelfOption{WithSelfHost("Peer.Example.net")}, "http://peer.example.net:8080"},
+		{"192.168.1.1:8080", []DetectSelfOption{WithSelfHost("ignored")}, "http://192.168.1.1:8080"},
+	} {
+		got, err := DetectSelf(tt.listenAddr, tt.opts...)
+		if err != nil {
+			t.Errorf("DetectSelf(%q) error: %v", tt.listenAddr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("DetectSelf(%q) = %q; want %q", tt.listenAddr, got, tt.want)
+		}
+	}
+
+	t.Setenv(selfHostEnv, "host.internal")
+	if got, _ := DetectSelf(":8080"); got != "http://host.internal:8080" {
+		t.Errorf("DetectSelf with %s set = %q; want %q", selfHostEnv, got, "http://host.internal:8080")
+	}
+}
+
+func TestHTTPPoolSelfNotInPeers(t *testing.T) {
+	var warned []string
+	p := &HTTPPool{
+		self: normalizeSelfURL("http://localhost:8000"),
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			SelfNotInPeers: func(self string, peers []string) {
+				warned = append(warned, self)
+			},
+		},
+	}
+
+	// A hostname does not match the IP address it resolves to.
+	p.Set("http://127.0.0.1:8000", "http://peer:8000")
+	if len(warned) != 1 || warned[0] != "http://localhost:8000" {
+		t.Errorf("SelfNotInPeers called with %q; want [http://localhost:8000]", warned)
+	}
+
+	// It is not called again while self stays missing.
+	p.Set("http://127.0.0.1:8000", "http://other:8000")
+	if len(warned) != 1 {
+		t.Errorf("SelfNotInPeers called %d times while self stayed missing; want 1", len(warned))
+	}
+
+	warned = nil
+	p.Set("http://LOCALHOST:8000/", "http://peer:8000")
+	if len(warned) != 0 {
+		t.Errorf("SelfNotInPeers called with %q when self is a peer", warned)
+	}
+
+	// Once self was back, it is called when self goes missing again.
+	p.Set("http://peer:8000")
+	if len(warned) != 1 {
+		t.Errorf("SelfNotInPeers called %d times when self went missing again; want 1", len(warned))
+	}
+}
+
+func TestNewTunedTransport(t *testing.T) {
+	if tr := newTunedTransport(&HTTPPoolOptions{}); tr != nil {
+		t.Errorf("newTunedTransport without settings = %v; want nil", tr)
+	}
+
+	tr := newTunedTransport(&HTTPPoolOptions{
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     time.Minute,
+	})
+	if tr == nil {
+		t.Fatal("newTunedTransport with settings = nil")
+	}
+	if tr.MaxIdleConnsPerHost != 64 {
+		t.Errorf("MaxIdleConnsPerHost = %d; want 64", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != time.Minute {
+		t.Errorf("IdleConnTimeout = %v; want %v", tr.IdleConnTimeout, time.Minute)
+	}
+	def := http.DefaultTransport.(*http.Transport)
+	if tr.MaxIdleConns != def.MaxIdleConns || tr.MaxConnsPerHost != def.MaxConnsPerHost {
+		t.Errorf("unset limits = %d, %d; want the defaults %d, %d", tr.MaxIdleConns, tr.MaxConnsPerHost, def.MaxIdleConns, def.MaxConnsPerHost)
+	}
+	if tr == def {
+		t.Error("newTunedTransport modified http.DefaultTransport")
+	}
+
+	// A replaced http.DefaultTransport is not cloned.
+	defer func(old http.RoundTripper) { http.DefaultTransport = old }(http.DefaultTransport)
+	http.DefaultTransport = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("replaced transport")
+	})
+	if tr := newTunedTransport(&HTTPPoolOptions{MaxConnsPerHost: 8}); tr == nil || tr.MaxConnsPerHost != 8 || tr.Proxy == nil {
+		t.Errorf("newTunedTransport with a replaced http.DefaultTransport = %v; want a new transport", tr)
+	}
+}
+
+func TestHTTPPoolIsSelf(t *testing.T) {
+	selves := map[string]bool{"http://10.0.0.1:8000": true, "http://[fd00::1]:8000": true}
+	p := &HTTPPool{
+		self: normalizeSelfURL("http://service-vip:8000"),
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+			IsSelf:   func(peer string) bool { return selves[peer] },
+			SelfNotInPeers: func(self string, peers []string) {
+				t.Errorf("SelfNotInPeers called although IsSelf matches a peer")
+			},
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://[fd00::1]:8000", "http://10.0.0.2:8000")
+
+	other := p.getters["http://10.0.0.2:8000"]
+	var local, remote int
+	for _, key := range testKeys(1000) {
+		peer, ok := p.PickPeer(key)
+		switch {
+		case !ok:
+			local++
+		case peer == other:
+			remote++
+		default:
+			t.Fatalf("PickPeer(%q) picked %s, which is self", key, peer.GetURL())
+		}
+	}
+	if local == 0 || remote == 0 {
+		t.Errorf("PickPeer picked self %d times and the other peer %d times; want both", local, remote)
+	}
+}
+
+// bodyOnlyTransport wraps a RoundTripper and strips the request context
+// from its requests, so that only the caller can abort reading the body.
+type bodyOnlyTransport struct {
+	http.RoundTripper
+}
+
+func (t bodyOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.RoundTripper.RoundTrip(req.WithContext(context.Background()))
+}
+
+func TestHTTPGetterCancelBodyRead(t *testing.T) {
+	value := []byte("value")
+	body, _ := proto.Marshal(&pb.GetResponse{Value: value})
+	stall := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/slow") {
+			_, _ = w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Length", "1048576")
+		_, _ = w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer ts.Close()
+	defer close(stall)
+
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{
+		Transport: func(context.Context) http.RoundTripper { return bodyOnlyTransport{tr} },
+	})
+	group, slow, fast := "group", "slow", "fast"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := h.Get(ctx, &pb.GetRequest{Group: &group, Key: &slow}, &pb.GetResponse{})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Get returned after %v; want it to give up promptly", elapsed)
+	}
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get = %v; want RemoteLoadError wrapping context.DeadlineExceeded", err)
+	}
+
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &fast}, out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != string(value) {
+		t.Errorf("Get after cancelled read = %q; want %q", out.Value, value)
+	}
+}
+
+func TestHTTPPoolOnRebalance(t *testing.T) {
+	var churns []float64
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath:       defaultBasePath,
+			Replicas:       defaultReplicas,
+			HashFn:         consistenthash.Hash32(crc32.ChecksumIEEE),
+			OnRebalance:    func(churn float64) { churns = append(churns, churn) },
+			SelfNotInPeers: func(string, []string) {},
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	if len(churns) != 0 {
+		t.Fatalf("OnRebalance called %d times on the first Set; want 0", len(churns))
+	}
+
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000")
+	if len(churns) != 2 {
+		t.Fatalf("OnRebalance called %d times; want 2", len(churns))
+	}
+	if churns[0] != 0 {
+		t.Errorf("churn for unchanged peers = %v; want 0", churns[0])
+	}
+	if churns[1] <= 0 || churns[1] >= 0.6 {
+		t.Errorf("churn for an added third peer = %v; want about 1/3", churns[1])
+	}
+}
+
+func TestHTTPPoolOnPeersChanged(t *testing.T) {
+	type change struct{ added, removed []string }
+	var changes []change
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+			OnPeersChanged: func(added, removed []string) {
+				changes = append(changes, change{added, removed})
+			},
+			SelfNotInPeers: func(string, []string) {},
+		},
+	}
+	p.Set("http://10.0.0.2:8000", "http://10.0.0.1:8000/")
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.3:8000", "http://10.0.0.4:8000")
+	p.SetWeighted(map[string]int{"http://10.0.0.3:8000": 2, "http://10.0.0.4:8000": 1})
+	p.Set()
+
+	want := []change{
+		{added: []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"}},
+		{added: []string{"http://10.0.0.3:8000", "http://10.0.0.4:8000"}, removed: []string{"http://10.0.0.2:8000"}},
+		{removed: []string{"http://10.0.0.1:8000"}},
+		{removed: []string{"http://10.0.0.3:8000", "http://10.0.0.4:8000"}},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("OnPeersChanged calls = %q; want %q", changes, want)
+	}
+}
+
+func TestRemoveRetriesHonorRetryAfter(t *testing.T) {
+	var removes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&removes, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "busy", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	// The backoff alone would wait for at least half an hour.
+	g := NewGroup("TestRemoveRetriesHonorRetryAfter-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), WithPeerPicker(ownerlessPeers{newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})}), WithRemoveRetries(2, time.Hour, time.Hour))
+	defer DeregisterGroup(g.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := g.Remove(ctx, "key"); err != nil {
+		t.Fatalf("Remove after a 429 = %v; want nil", err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 10*time.Second {
+		t.Errorf("Remove after a 429 with Retry-After: 1 took %v; want about 1s", d)
+	}
+	if n := atomic.LoadInt32(&removes); n != 2 {
+		t.Errorf("peer got %d removes; want 2", n)
+	}
+
+	// A Retry-After past the deadline waits no longer than the deadline.
+	atomic.StoreInt32(&removes, 0)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := g.Remove(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Remove retried past its deadline = %v; want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Remove with a 50ms deadline took %v", d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		status int
+		header string
+		want   time.Duration
+	}{
+		{http.StatusServiceUnavailable, "120", 2 * time.Minute},
+		{http.StatusTooManyRequests, " 3 ", 3 * time.Second},
+		{http.StatusTooManyRequests, now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{http.StatusTooManyRequests, now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{http.StatusTooManyRequests, "-5", 0},
+		{http.StatusTooManyRequests, "soon", 0},
+		{http.StatusTooManyRequests, "99999999999999999", 0},
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusInternalServerError, "120", 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp, now); got != tt.want {
+			t.Errorf("retryAfter(%d, %q) = %v; want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group, key := "group", "key"
+	err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{})
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || rerr.RetryAfter != 7*time.Second {
+		t.Errorf("Get from shedding peer = %#v; want RemoteLoadError with RetryAfter 7s", err)
+	}
+}
+
+func TestHTTPRemoveVersion(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	g := newGroup("TestHTTPRemoveVersion-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if err := dest.SetString("value", time.Time{}); err != nil {
+			return err
+		}
+		SetVersion(dest, "v2")
+		return nil
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group, key := g.Name(), "key"
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetVersion() != "v2" {
+		t.Errorf("GetResponse.Version = %q; want v2", out.GetVersion())
+	}
+
+	stale := "v1"
+	err := h.Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key, Version: &stale})
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Remove of a stale version = %v; want RemoteLoadError wrapping ErrVersionMismatch", err)
+	}
+	if _, ok := g.mainCache.get(key); !ok {
+		t.Error("Remove of a stale version dropped the cached value")
+	}
+
+	current := "v2"
+	if err := h.Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key, Version: &current}); err != nil {
+		t.Errorf("Remove of the current version = %v; want nil", err)
+	}
+	if _, ok := g.mainCache.get(key); ok {
+		t.Error("Remove of the current version kept the cached value")
+	}
+}
+
+func TestServeHTTPShedsLowPriority(t *testing.T) {
+	p := &HTTPPool{
+		opts: HTTPPoolOptions{
+			BasePath:           defaultBasePath,
+			Replicas:           defaultReplicas,
+			ServerErrorHandler: DefaultServerErrorHandler,
+		},
+		serverSem: make(chan struct{}, 1),
+	}
+	unblock := make(chan struct{})
+	g := newGroup("TestServeHTTPShedsLowPriority-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "slow" {
+			<-unblock
+		}
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group := g.Name()
+	get := func(ctx context.Context, key string) error {
+		return h.Get(ctx, &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{})
+	}
+
+	// Take the only slot.
+	slow := make(chan error)
+	go func() { slow <- get(context.Background(), "slow") }()
+	for len(p.serverSem) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := get(WithPriority(context.Background(), PriorityLow), "low")
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || rerr.StatusCode != http.StatusTooManyRequests || rerr.RetryAfter != time.Second {
+		t.Errorf("low priority Get on a busy server = %v; want 429 with RetryAfter 1s", err)
+	}
+	if n := g.Stats.ServerShedRequests.Get(); n != 1 {
+		t.Errorf("ServerShedRequests = %d; want 1", n)
+	}
+
+	// High priority requests wait for the slot instead.
+	high := make(chan error)
+	go func() { high <- get(context.Background(), "high") }()
+	select {
+	case err := <-high:
+		t.Fatalf("high priority Get returned %v while the server was busy; want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := get(WithPriority(context.Background(), PriorityLow), "low"); err == nil {
+		t.Error("low priority Get succeeded while a high priority one waited; want it shed")
+	}
+
+	close(unblock)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-high; err != nil {
+		t.Fatal(err)
+	}
+	if err := get(WithPriority(context.Background(), PriorityLow), "low"); err != nil {
+		t.Errorf("low priority Get on an idle server = %v; want nil", err)
+	}
+}
+
+// namedPeer is a fakePeer with its own URL.
+type namedPeer struct {
+	fakePeer
+	url string
+}
+
+func (p *namedPeer) GetURL() string { return p.url }
+
+func TestHTTPPoolGetterFactory(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+			GetterFactory: func(peerURL string) ProtoGetter {
+				return &namedPeer{url: "rpc+" + peerURL}
+			},
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+
+	var picked ProtoGetter
+	for _, key := range testKeys(100) {
+		if peer, ok := p.PickPeer(key); ok {
+			picked = peer
+			break
+		}
+	}
+	if picked == nil || picked.GetURL() != "rpc+http://10.0.0.2:8000" {
+		t.Fatalf("PickPeer picked %v; want the getter made by GetterFactory", picked)
+	}
+	if stats := p.PeerStats()["http://10.0.0.2:8000"]; stats != (PeerStats{}) {
+		t.Errorf("PeerStats of a custom getter = %+v; want zero", stats)
+	}
+
+	group, key := "my group", "a/b?c"
+	got := PeerRequestURL("http://10.0.0.2:8000"+defaultBasePath, &pb.GetRequest{Group: &group, Key: &key})
+	if want := "http://10.0.0.2:8000/_groupcache/my%20group/a%2Fb%3Fc"; got != want {
+		t.Errorf("PeerRequestURL = %q; want %q", got, want)
+	}
+}
+
+type tenantKey struct{}
+
+func TestHTTPPoolForwardsMetadata(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+		MetadataToContext: func(ctx context.Context, md map[string]string) context.Context {
+			return context.WithValue(ctx, tenantKey{}, md["tenant-id"])
+		},
+	}}
+	g := newGroup("TestHTTPPoolForwardsMetadata-group", 1<<20, GetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return dest.SetString(tenant+":"+key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{
+		ContextToMetadata: func(ctx context.Context) map[string]string {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+			return map[string]string{"Tenant-ID": tenant, "not a header": "dropped"}
+		},
+	})
+	group, key := g.Name(), "key"
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme corp/ü")
+	out := &pb.GetResponse{}
+	if err := h.Get(ctx, &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out.Value), "acme corp/ü:key"; got != want {
+		t.Errorf("server-side Getter loaded %q; want %q", got, want)
+	}
+
+	md := decodeMetadata(http.Header{
+		"X-Groupcache-Meta-Trace": {"a%20b"},
+		"X-Groupcache-Meta-Bad":   {"%zz"},
+		"X-Other":                 {"ignored"},
+	})
+	if len(md) != 1 || md["trace"] != "a b" {
+		t.Errorf("decodeMetadata = %v; want only trace: \"a b\"", md)
+	}
+}
+
+// closingPeer is a fakePeer recording whether it was closed.
+type closingPeer struct {
+	fakePeer
+	closed bool
+}
+
+func (p *closingPeer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestHTTPPoolSetKeepsGetters(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000")
+	before := map[string]ProtoGetter{}
+	for peer, g := range p.getters {
+		before[peer] = g
+	}
+
+	p.Set("http://10.0.0.3:8000", "http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	for peer, g := range p.getters {
+		if g != before[peer] {
+			t.Errorf("getter of %s replaced by a Set with the same peers", peer)
+		}
+	}
+
+	// Duplicate peers share a getter.
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.2:8000/", "http://10.0.0.3:8000")
+	if len(p.getters) != 3 || p.getters["http://10.0.0.2:8000"] != before["http://10.0.0.2:8000"] {
+		t.Errorf("Set with a duplicate peer made %d getters, replacing that of the peer; want 3, kept", len(p.getters))
+	}
+
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.4:8000")
+	if p.getters["http://10.0.0.2:8000"] != before["http://10.0.0.2:8000"] {
+		t.Error("getter of a remaining peer replaced by a Set")
+	}
+	if _, ok := p.getters["http://10.0.0.3:8000"]; ok {
+		t.Error("getter of a removed peer kept by a Set")
+	}
+	if p.getters["http://10.0.0.4:8000"] == nil {
+		t.Error("no getter made for an added peer")
+	}
+
+	closer := &closingPeer{}
+	p.opts.GetterFactory = func(string) ProtoGetter { return closer }
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.5:8000")
+	p.Set("http://10.0.0.1:8000")
+	if !closer.closed {
+		t.Error("getter of a removed peer not closed")
+	}
+}
+
+// renamingPeer sends the requests of any group to the given group of its
+// ProtoGetter, so that a group can use another group of the same process
+// as its peer.
+type renamingPeer struct {
+	ProtoGetter
+	group string
+}
+
+func (p renamingPeer) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	renamed := *in
+	renamed.Group = &p.group
+	return p.ProtoGetter.Get(ctx, &renamed, out)
+}
+
+func TestEmptyValueFromPeerIsAHit(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	owner := newGroup("TestEmptyValueFromPeerIsAHit-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(owner.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group, key := owner.Name(), "empty"
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value == nil {
+		t.Error("GetResponse of an empty value has no value")
+	}
+
+	// A group of another process, for which the owner is the peer.
+	client := newGroup("TestEmptyValueFromPeerIsAHit-client", 1<<20, GetterFunc(func(context.Context, string, Sink) error {
+		return errors.New("loaded locally")
+	}), fakePeers{renamingPeer{h, group}})
+	defer DeregisterGroup(client.Name())
+	for _, want := range []CacheHitSource{SourcePeer, SourceHotCache} {
+		var s string
+		source, err := client.GetWithInfo(context.Background(), key, StringSink(&s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != "" || source != want {
+			t.Errorf("Get of an empty value from a peer = %q from %v; want \"\" from %v", s, source, want)
+		}
+	}
+}
+
+func TestHTTPPoolPickPeers(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+		},
+	}
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000")
+
+	var sawSelf bool
+	for _, key := range testKeys(100) {
+		peers := p.PickPeers(key, 2)
+		if len(peers) != 2 || peers[0] == peers[1] {
+			t.Fatalf("PickPeers(%q, 2) = %v; want 2 distinct peers", key, peers)
+		}
+		if primary, _ := p.PickPeer(key); peers[0] != primary {
+			t.Errorf("PickPeers(%q, 2)[0] = %v; want PickPeer's %v", key, peers[0], primary)
+		}
+		sawSelf = sawSelf || peers[0] == nil || peers[1] == nil
+	}
+	if !sawSelf {
+		t.Error("PickPeers never nominated self")
+	}
+}
+
+func TestHTTPPoolGetAllOrder(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.0.2:8000",
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+		},
+	}
+	p.Set("http://10.0.0.3:8000", "http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.10:8000")
+
+	var urls []string
+	for _, peer := range p.GetAll() {
+		urls = append(urls, peer.GetURL())
+	}
+	// Peers are sorted by URL as strings.
+	want := []string{
+		"http://10.0.0.10:8000" + defaultBasePath,
+		"http://10.0.0.1:8000" + defaultBasePath,
+		"http://10.0.0.3:8000" + defaultBasePath,
+	}
+	if fmt.Sprint(urls) != fmt.Sprint(want) {
+		t.Errorf("GetAll URLs = %q; want %q", urls, want)
+	}
+
+	all := p.GetAllWithSelf()
+	if len(all) != 4 || all[2].GetURL() != "http://10.0.0.2:8000" {
+		t.Fatalf("GetAllWithSelf = %v; want self third of 4 peers", all)
+	}
+
+	// Self is reached in process.
+	g := newGroup("TestHTTPPoolGetAllOrder-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if err := dest.SetString("value:"+key, time.Time{}); err != nil {
+			return err
+		}
+		SetVersion(dest, "v1")
+		return nil
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	group, key := g.Name(), "key"
+	out := &pb.GetResponse{}
+	if err := all[2].Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != "value:key" || out.GetVersion() != "v1" {
+		t.Errorf("local Get = %q version %q; want value:key version v1", out.Value, out.GetVersion())
+	}
+	// It is served like a request of a peer.
+	if out.GetEtag() != valueETag(out.Value) || g.Stats.ServerRequests.Get() != 1 {
+		t.Errorf("local Get etag = %q, server requests = %d; want %q, 1", out.GetEtag(), g.Stats.ServerRequests.Get(), valueETag(out.Value))
+	}
+	stale := "v0"
+	if err := all[2].Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key, Version: &stale}); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("local Remove of a stale version = %v; want ErrVersionMismatch", err)
+	}
+	if err := all[2].Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get(key); ok {
+		t.Error("local Remove kept the cached value")
+	}
+	missing := "missing"
+	if err := all[2].Get(context.Background(), &pb.GetRequest{Group: &missing, Key: &key}, out); !errors.As(err, &GroupNotFoundError{}) {
+		t.Errorf("local Get of a missing group = %v; want GroupNotFoundError", err)
+	}
+}
+
+// countingTransport counts the requests it makes and whether its idle
+// connections were closed.
+type countingTransport struct {
+	requests int
+	closed   bool
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (c *countingTransport) CloseIdleConnections() { c.closed = true }
+
+func TestHTTPPoolPeerTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	wan := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	overrides := map[string]*countingTransport{}
+	p := &HTTPPool{
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			PeerTransport: func(peerURL string) http.RoundTripper {
+				if peerURL != wan {
+					return nil
+				}
+				tr := &countingTransport{}
+				overrides[peerURL] = tr
+				return tr
+			},
+		},
+	}
+	p.Set(ts.URL, wan)
+	group, key := "group", "key"
+	for _, peer := range p.GetAll() {
+		if err := peer.Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := overrides[wan]
+	if tr == nil || tr.requests != 1 {
+		t.Fatalf("override of %s made %v requests; want 1", wan, tr)
+	}
+
+	// The override survives a Set keeping the peer.
+	p.Set(wan, ts.URL)
+	if len(overrides) != 1 {
+		t.Errorf("PeerTransport called %d times; want once for the remaining peer", len(overrides))
+	}
+	if err := p.getters[wan].Remove(context.Background(), &pb.GetRequest{Group: &group, Key: &key}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.requests != 2 {
+		t.Errorf("override made %d requests after Set; want 2", tr.requests)
+	}
+
+	p.Set(ts.URL)
+	if !tr.closed {
+		t.Error("idle connections of a removed peer's transport were not closed")
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	rec := &recordingLogger{}
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+		Logger:             rec,
+	}}
+	var seen []string
+	g := newGroup("TestRequestIDPropagation-group", 1<<20, GetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		seen = append(seen, RequestIDFromContext(ctx))
+		return errors.New("backend down")
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group := g.Name()
+	get := func(ctx context.Context, key string) RemoteLoadError {
+		err := h.Get(ctx, &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{})
+		var rerr RemoteLoadError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("Get = %v; want a RemoteLoadError", err)
+		}
+		return rerr
+	}
+
+	if rerr := get(WithRequestID(context.Background(), "req-1"), "a"); rerr.RequestID != "req-1" {
+		t.Errorf("RemoteLoadError.RequestID = %q; want req-1", rerr.RequestID)
+	}
+	rerr := get(context.Background(), "b")
+	if len(rerr.RequestID) != 16 {
+		t.Errorf("generated request ID = %q; want 16 hex digits", rerr.RequestID)
+	}
+	if want := []string{"req-1", rerr.RequestID}; fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("server-side Getter saw request IDs %q; want %q", seen, want)
+	}
+
+	var logged []interface{}
+	for _, keyvals := range rec.keyvals {
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "requestID" {
+				logged = append(logged, keyvals[i+1])
+			}
+		}
+	}
+	if want := []interface{}{"req-1", rerr.RequestID}; fmt.Sprint(logged) != fmt.Sprint(want) {
+		t.Errorf("server logged request IDs %q; want %q", logged, want)
+	}
+
+	// A nil context gets a request ID too.
+	if rerr := get(dummyCtx, "c"); len(rerr.RequestID) != 16 {
+		t.Errorf("generated request ID with a nil context = %q; want 16 hex digits", rerr.RequestID)
+	}
+	key := "d"
+	if err := h.Remove(dummyCtx, &pb.GetRequest{Group: &group, Key: &key}); err != nil {
+		t.Errorf("Remove with a nil context = %v; want nil", err)
+	}
+}
+
+func TestServeHTTPCacheControl(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	g := newGroup("TestServeHTTPCacheControl-group", 1<<20, GetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		if key == "forever" {
+			return dest.SetString(key, time.Time{})
+		}
+		return dest.SetString(key, time.Now().Add(time.Hour))
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	get := func(key string) http.Header {
+		res, err := http.Get(ts.URL + defaultBasePath + g.Name() + "/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.Header
+	}
+
+	h := get("ttl")
+	var maxAge int
+	if _, err := fmt.Sscanf(h.Get("Cache-Control"), "max-age=%d", &maxAge); err != nil || maxAge < 3590 || maxAge > 3600 {
+		t.Errorf("Cache-Control = %q; want max-age close to 3600", h.Get("Cache-Control"))
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err != nil || time.Until(expires) < 59*time.Minute || time.Until(expires) > time.Hour {
+		t.Errorf("Expires = %q; want about an hour from now", h.Get("Expires"))
+	}
+
+	h = get("forever")
+	if got := h.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control without expiry = %q; want no-cache", got)
+	}
+	if got := h.Get("Expires"); got != "" {
+		t.Errorf("Expires without expiry = %q; want none", got)
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	h = http.Header{}
+	setCacheHeaders(h, now.Add(-time.Minute), now)
+	if got := h.Get("Cache-Control"); got != "max-age=0" {
+		t.Errorf("Cache-Control of an expired value = %q; want max-age=0", got)
+	}
+}
+
+func TestServeHTTPLoadContext(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+		MaxLoadDuration:    200 * time.Millisecond,
+	}}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan bool, 1)
+	getter := GetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		cancelled <- ctx.Err() == context.Canceled
+		return ctx.Err()
+	})
+	detached := NewGroup("TestServeHTTPLoadContext-detached", 1<<20, getter, WithPeerPicker(NoPeers{}))
+	defer DeregisterGroup(detached.Name())
+	attached := NewGroup("TestServeHTTPLoadContext-attached", 1<<20, getter, WithPeerPicker(NoPeers{}), WithCancelOnDisconnect())
+	defer DeregisterGroup(attached.Name())
+
+	// A load outliving MaxLoadDuration is answered with 504.
+	res, err := http.Get(ts.URL + defaultBasePath + detached.Name() + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status of a load exceeding MaxLoadDuration = %d; want 504", res.StatusCode)
+	}
+	<-started
+	<-cancelled
+
+	for _, tt := range []struct {
+		group         *Group
+		wantCancelled bool
+	}{
+		{detached, false},
+		{attached, true},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+defaultBasePath+tt.group.Name()+"/gone", nil)
+		go func() {
+			<-started
+			cancel()
+		}()
+		if _, err := http.DefaultClient.Do(req); err == nil {
+			t.Fatal("request unexpectedly completed")
+		}
+		if got := <-cancelled; got != tt.wantCancelled {
+			t.Errorf("%s: load cancelled by the peer going away = %v; want %v", tt.group.Name(), got, tt.wantCancelled)
+		}
+	}
+}
+
+func TestHTTPGetterNotModified(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	var mu sync.Mutex
+	content := strings.Repeat("x", 1<<10)
+	owner := newGroup("TestHTTPGetterNotModified-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return dest.SetString(content, time.Now().Add(50*time.Millisecond))
+	}), NoPeers{})
+	defer DeregisterGroup(owner.Name())
+	var statuses []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, r)
+		statuses = append(statuses, rec.Code)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	client := newGroup("TestHTTPGetterNotModified-client", 1<<20, GetterFunc(func(context.Context, string, Sink) error {
+		return errors.New("loaded locally")
+	}), fakePeers{renamingPeer{h, owner.Name()}})
+	defer DeregisterGroup(client.Name())
+
+	get := func() string {
+		var s string
+		if err := client.Get(context.Background(), "key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if got := get(); got != content {
+		t.Fatalf("first Get = %d bytes; want %d", len(got), len(content))
+	}
+	// The owner computed the etag of the value once, when caching it.
+	if cached, ok := owner.mainCache.get("key"); !ok || cached.etag != valueETag([]byte(content)) {
+		t.Errorf("owner cached the value with etag %q; want %q", cached.etag, valueETag([]byte(content)))
+	}
+
+	// Once both copies expired, the owner reloads the same value and the
+	// client keeps its own.
+	time.Sleep(100 * time.Millisecond)
+	if got := get(); got != content {
+		t.Errorf("Get of an unchanged value = %d bytes; want %d", len(got), len(content))
+	}
+	if got := client.Stats.PeerNotModified.Get(); got != 1 {
+		t.Errorf("PeerNotModified = %d; want 1", got)
+	}
+
+	// A changed value is sent in full.
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	content = strings.Repeat("y", 1<<10)
+	mu.Unlock()
+	if got := get(); got != content {
+		t.Errorf("Get of a changed value = %q...; want %q...", got[:1], content[:1])
+	}
+	if want := []int{http.StatusOK, http.StatusNotModified, http.StatusOK}; fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("peer response statuses = %v; want %v", statuses, want)
+	}
+}
+
+func TestServeHTTPMaxConcurrentLoads(t *testing.T) {
+	opts := HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}
+	p := &HTTPPool{opts: opts, loadSem: make(chan struct{}, 1)}
+	opts.ShedExcessLoads = true
+	shedding := &HTTPPool{opts: opts, loadSem: p.loadSem}
+
+	unblock := make(chan struct{})
+	g := newGroup("TestServeHTTPMaxConcurrentLoads-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "slow" {
+			<-unblock
+		}
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	tsShedding := httptest.NewServer(shedding)
+	defer tsShedding.Close()
+
+	group := g.Name()
+	get := func(ctx context.Context, url, key string) error {
+		h := newHTTPGetter(url+defaultBasePath, &HTTPPoolOptions{})
+		return h.Get(ctx, &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{})
+	}
+	if err := get(context.Background(), ts.URL, "warm"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take the only slot.
+	slow := make(chan error)
+	go func() { slow <- get(context.Background(), ts.URL, "slow") }()
+	for len(p.loadSem) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := get(context.Background(), ts.URL, "warm"); err != nil {
+		t.Errorf("Get of a cached value at the load limit = %v; want it served", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	queued := make(chan error)
+	go func() { queued <- get(ctx, ts.URL, "cold") }()
+	for p.Stats().QueuedLoads != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-queued; err == nil {
+		t.Error("Get waiting for a load slot succeeded; want its context to expire")
+	}
+
+	err := get(context.Background(), tsShedding.URL, "cold")
+	var rerr RemoteLoadError
+	if !errors.As(err, &rerr) || rerr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Get over the load limit with ShedExcessLoads = %v; want 429", err)
+	}
+	if got := shedding.Stats(); got != (PoolStats{ActiveLoads: 1, ShedLoads: 1}) {
+		t.Errorf("Stats = %+v; want 1 active and 1 shed load", got)
+	}
+
+	// Shed requests go through ServerErrorHandler.
+	var handled error
+	shedding.opts.ServerErrorHandler = func(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		DefaultServerErrorHandler(ctx, w, r, err)
+	}
+	if err := get(context.Background(), tsShedding.URL, "cold"); !errors.As(err, &rerr) || rerr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Get over the load limit with a ServerErrorHandler = %v; want 429", err)
+	}
+	if !errors.Is(handled, ErrServerOverloaded) {
+		t.Errorf("ServerErrorHandler got %v; want ErrServerOverloaded", handled)
+	}
+
+	close(unblock)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	// The slot is released once the response is written.
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats() != (PoolStats{}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats once idle = %+v; want zero", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeHTTPEscapedPath(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	g := newGroup("TestServeHTTPEscapedPath/group%", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString(key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	group := g.Name()
+	for _, key := range []string{"a/b", "/", "%2F", "a b?c#d", "100%", "", "\x00\xff"} {
+		out := &pb.GetResponse{}
+		if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+			t.Errorf("Get(%q) = %v", key, err)
+			continue
+		}
+		if got := string(out.Value); got != key {
+			t.Errorf("key seen by the peer = %q; want %q", got, key)
+		}
+	}
+}
+
+func FuzzPeerRequestURL(f *testing.F) {
+	f.Add("group", "key")
+	f.Add("a/b", "c/d")
+	f.Add("%", "%25")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, group, key string) {
+		u, err := url.Parse(PeerRequestURL("http://10.0.0.1:8000"+defaultBasePath, &pb.GetRequest{Group: &group, Key: &key}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := u.EscapedPath()
+		if !strings.HasPrefix(path, defaultBasePath) {
+			t.Fatalf("path %q lacks the base path", path)
+		}
+		gotGroup, gotKey, err := parsePeerPath(path[len(defaultBasePath):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotGroup != group || gotKey != key {
+			t.Errorf("parsePeerPath = %q, %q; want %q, %q", gotGroup, gotKey, group, key)
+		}
+	})
+}
+
+func TestParsePeerPathAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _, _ = parsePeerPath("group/some/key")
+	})
+	if allocs != 0 {
+		t.Errorf("parsePeerPath of an unescaped path made %v allocations; want 0", allocs)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPGetterChunkedValue(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+		ChunkBytes:         64 << 10,
+	}}
+	value := make([]byte, 3<<20+123)
+	for i := range value {
+		value[i] = byte(i * 7 / 3)
+	}
+	g := newGroup("TestHTTPGetterChunkedValue-group", 16<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetBytes(value, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	var contentType string
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{
+		VerifyChecksums: true,
+		Transport: func(context.Context) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				res, err := http.DefaultTransport.RoundTrip(req)
+				if err == nil {
+					contentType = res.Header.Get("Content-Type")
+				}
+				return res, err
+			})
+		},
+	})
+	group, key := g.Name(), "big"
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != chunkedContentType {
+		t.Errorf("Content-Type = %q; want %q", contentType, chunkedContentType)
+	}
+	if !bytes.Equal(out.Value, value) {
+		t.Errorf("reassembled value of %d bytes differs from the %d bytes sent", len(out.Value), len(value))
+	}
+	if out.Checksum == nil || out.TotalSize != nil || out.Offset != nil {
+		t.Errorf("GetResponse = checksum %v, total size %v, offset %v; want only a checksum", out.Checksum, out.TotalSize, out.Offset)
+	}
+
+	// Peers that predate chunks get a single message.
+	res, err := http.Get(ts.URL + defaultBasePath + group + "/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	single := &pb.GetResponse{}
+	if err := proto.Unmarshal(body, single); err != nil || !bytes.Equal(single.Value, value) {
+		t.Errorf("response to a peer without CapChunked = %d bytes, %v; want the value in one message", len(single.Value), err)
+	}
+
+	// A response cut short is an error.
+	rec := httptest.NewRecorder()
+	writeChunks(rec, &pb.GetResponse{Value: value}, 64<<10)
+	truncated := rec.Body.Bytes()[:rec.Body.Len()/2]
+	if err := readChunks(bytes.NewReader(truncated), &pb.GetResponse{}, defaultMaxResponseBytes); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readChunks of a truncated response = %v; want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestUndecodableResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("\xff\xff not a protobuf"))
+	}))
+	defer ts.Close()
+	peer := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	noFallback := WithPeerErrorHandler(func(_ context.Context, _ *Group, _, _ string, err error) (bool, error) {
+		return false, err
+	})
+
+	g := NewGroup("TestUndecodableResponse-error", cacheSize, getter, WithPeerPicker(fakePeers{peer}), noFallback)
+	defer DeregisterGroup(g.Name())
+	var s string
+	err := g.Get(context.Background(), "key", StringSink(&s))
+	if !errors.Is(err, ErrUndecodableResponse) {
+		t.Errorf("Get of an undecodable response = %v; want ErrUndecodableResponse", err)
+	}
+	// The decoding error is kept as the cause.
+	var derr undecodableError
+	if !errors.As(err, &derr) || errors.Unwrap(derr) == nil {
+		t.Errorf("Get of an undecodable response = %v; want the decoding error wrapped", err)
+	}
+	if n := g.Stats.PeerDecodeErrors.Get(); n != 1 {
+		t.Errorf("PeerDecodeErrors = %d; want 1", n)
+	}
+
+	fallback := NewGroup("TestUndecodableResponse-fallback", cacheSize, getter, WithPeerPicker(fakePeers{peer}), noFallback, WithLocalLoadOnDecodeError())
+	defer DeregisterGroup(fallback.Name())
+	if err := fallback.Get(context.Background(), "key", StringSink(&s)); err != nil {
+		t.Fatalf("Get of an undecodable response WithLocalLoadOnDecodeError = %v", err)
+	}
+	if s != "local:key" {
+		t.Errorf("Get of an undecodable response WithLocalLoadOnDecodeError = %q; want a local load", s)
+	}
+	if n, errs := fallback.Stats.PeerDecodeErrors.Get(), fallback.Stats.PeerErrors.Get(); n != 1 || errs != 0 {
+		t.Errorf("PeerDecodeErrors, PeerErrors = %d, %d; want 1, 0", n, errs)
+	}
+}
+
+func TestExpireHeader(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	expire := time.Now().Add(time.Hour)
+	g := newGroup("TestExpireHeader-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		if key == "forever" {
+			return dest.SetString(key, time.Time{})
+		}
+		return dest.SetString(key, expire)
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		key  string
+		want string
+	}{
+		{"ttl", strconv.FormatInt(expire.UnixNano(), 10)},
+		{"forever", ""},
+	} {
+		// HEAD only serves cached values, so GET first.
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, _ := http.NewRequest(method, ts.URL+defaultBasePath+g.Name()+"/"+tt.key, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("%s %s: status = %d; want 200", method, tt.key, res.StatusCode)
+			}
+			if got := res.Header.Get(expireHeader); got != tt.want {
+				t.Errorf("%s %s: %s = %q; want %q", method, tt.key, expireHeader, got, tt.want)
+			}
+		}
+	}
+
+	// HEAD does not load missing values, nor count as a get of the
+	// caches.
+	before := g.CacheStats(MainCache)
+	for _, key := range []string{"ttl", "missing"} {
+		req, _ := http.NewRequest(http.MethodHead, ts.URL+defaultBasePath+g.Name()+"/"+key, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if key == "missing" && (res.StatusCode != http.StatusNotFound || res.Header.Get(notFoundHeader) != "key") {
+			t.Errorf("HEAD of a missing key: status = %d, %s = %q; want 404, key", res.StatusCode, notFoundHeader, res.Header.Get(notFoundHeader))
+		}
+	}
+	if after := g.CacheStats(MainCache); after.Gets != before.Gets || after.Hits != before.Hits {
+		t.Errorf("HEAD requests moved the cache gets, hits from %d, %d to %d, %d", before.Gets, before.Hits, after.Gets, after.Hits)
+	}
+	if n := g.Stats.LocalLoads.Get(); n != 2 {
+		t.Errorf("LocalLoads = %d; want 2, for the GETs only", n)
+	}
+
+	// A response without the expire field falls back to the header.
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(expireHeader, "1234")
+		body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("v")})
+		_, _ = w.Write(body)
+	}))
+	defer peer.Close()
+	h := newHTTPGetter(peer.URL+defaultBasePath, &HTTPPoolOptions{})
+	group, key := "group", "key"
+	out := &pb.GetResponse{}
+	if err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetExpire() != 1234 {
+		t.Errorf("expire from the header = %d; want 1234", out.GetExpire())
+	}
+}
+
+func TestHTTPGetterMaxResponseBytes(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 10<<10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case defaultBasePath + "group/flushed":
+			// Without a Content-Length.
+			_, _ = w.Write(big[:1])
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(big[1:])
+		case defaultBasePath + "group/chunked":
+			w.Header().Set(capabilitiesHeader, supportedCapabilities.String())
+			writeChunks(w, &pb.GetResponse{Value: big}, 1<<10)
+		default:
+			_, _ = w.Write(big)
+		}
+	}))
+	defer peer.Close()
+
+	h := newHTTPGetter(peer.URL+defaultBasePath, &HTTPPoolOptions{MaxResponseBytes: 4 << 10})
+	group := "group"
+	for _, key := range []string{"sized", "flushed", "chunked"} {
+		err := h.Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{})
+		if !errors.Is(err, ErrResponseTooLarge) {
+			t.Errorf("Get of a %s response over MaxResponseBytes = %v; want ErrResponseTooLarge", key, err)
+		}
+	}
+}
+
+func TestConcurrentGetsShareOnePeerRequest(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("value")})
+		_, _ = w.Write(body)
+	}))
+	defer peer.Close()
+
+	h := newHTTPGetter(peer.URL+defaultBasePath, &HTTPPoolOptions{})
+	g := newGroup("TestConcurrentGetsShareOnePeerRequest-group", 1<<20, GetterFunc(func(context.Context, string, Sink) error {
+		return errors.New("loaded locally")
+	}), fakePeers{h})
+	defer DeregisterGroup(g.Name())
+
+	const callers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s string
+			errs <- g.Get(context.Background(), "key", StringSink(&s))
+		}()
+	}
+	// Let the callers pile up on the request in flight.
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d concurrent Gets made %d requests to the peer; want 1", callers, n)
+	}
+}
+
+func TestNewHTTPPoolWithValidation(t *testing.T) {
+	for _, tt := range []struct {
+		opts []HTTPPoolOption
+		want string
+	}{
+		{[]HTTPPoolOption{WithReplicas(-1)}, "Replicas -1"},
+		{[]HTTPPoolOption{WithBasePath("/")}, `BasePath "/"`},
+		{[]HTTPPoolOption{WithBasePath("/_groupcache/?a=b")}, `BasePath "/_groupcache/?a=b"`},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{MigrationWindow: -time.Second})}, "MigrationWindow -1s"},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{MaxLoadDuration: -time.Second})}, "MaxLoadDuration -1s"},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{MaxResponseBytes: -1})}, "MaxResponseBytes -1"},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{Ketama: true, XXHash: true})}, "Ketama true"},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{Ketama: true, HashSeed: 1})}, "Ketama true"},
+		{[]HTTPPoolOption{WithHTTPPoolOptions(HTTPPoolOptions{Ketama: true, ReplicaKeyFunc: consistenthash.DefaultReplicaKey})}, "Ketama true"},
+		// Later options override earlier ones.
+		{[]HTTPPoolOption{WithReplicas(10), WithHTTPPoolOptions(HTTPPoolOptions{Replicas: -2})}, "Replicas -2"},
+	} {
+		p, err := NewHTTPPoolWith("http://localhost:8000", tt.opts...)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewHTTPPoolWith error = %v; want one naming %s", err, tt.want)
+		}
+		if p != nil {
+			t.Errorf("NewHTTPPoolWith with invalid options made a pool")
+		}
+	}
+
+	// NewHTTPPoolOpts accepts what it did before options were validated,
+	// and neither calls the callbacks of the options.
+	defer func(old func(string) PeerPicker) { portPicker = old }(portPicker)
+	called := false
+	opts := &HTTPPoolOptions{
+		BasePath: "/TestNewHTTPPoolWithValidation/?a=b",
+		Replicas: -1,
+		Transport: func(context.Context) http.RoundTripper {
+			called = true
+			return nil
+		},
+	}
+	lenient := NewHTTPPoolOpts("http://localhost:8000", opts)
+	p, err := NewHTTPPoolWith("http://localhost:8000", WithBasePath("/TestNewHTTPPoolWithValidation/"), WithTransport(opts.Transport))
+	if err != nil {
+		t.Fatalf("NewHTTPPoolWith with a Transport = %v; want nil", err)
+	}
+	if called {
+		t.Error("validating the options called Transport")
+	}
+	lenient.Close()
+	p.Close()
+	opts.Ketama, opts.XXHash = true, true
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("NewHTTPPoolOpts with Ketama and XXHash did not panic")
+			}
+		}()
+		NewHTTPPoolOpts("http://localhost:8000", opts).Close()
+	}()
+}
+
+func TestDeadPeerFallsBackToLocalLoad(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	h := newHTTPGetter(deadURL+defaultBasePath, &HTTPPoolOptions{})
+	var localLoads int32
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		atomic.AddInt32(&localLoads, 1)
+		return dest.SetString("local:"+key, time.Time{})
+	})
+
+	// Without the option, the failure of the owner is returned.
+	strict := NewGroup("TestDeadPeerFallsBackToLocalLoad-strict", 1<<20, getter, WithPeerPicker(fakePeers{h}))
+	defer DeregisterGroup(strict.Name())
+	var s string
+	var rerr RemoteLoadError
+	if err := strict.Get(context.Background(), "key", StringSink(&s)); !errors.As(err, &rerr) || localLoads != 0 {
+		t.Errorf("Get with a dead owner = %v after %d local loads; want a RemoteLoadError after none", err, localLoads)
+	}
+
+	g := NewGroup("TestDeadPeerFallsBackToLocalLoad-group", 1<<20, getter, WithPeerPicker(fakePeers{h}), WithLoadLocallyOnPeerFailure())
+	defer DeregisterGroup(g.Name())
+	source, err := g.GetWithInfo(context.Background(), "key", StringSink(&s))
+	if err != nil {
+		t.Fatalf("Get with a dead owner = %v; want the value loaded locally", err)
+	}
+	if s != "local:key" || source != SourceLocal || localLoads != 1 {
+		t.Errorf("Get with a dead owner = %q from %v after %d local loads; want local:key from %v after 1", s, source, localLoads, SourceLocal)
+	}
+	if n := g.Stats.PeerErrors.Get(); n != 1 {
+		t.Errorf("PeerErrors = %d; want 1", n)
+	}
+
+	// A 5xx falls back too, while a 4xx is an answer for the key.
+	var status int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed", status)
+	}))
+	defer ts.Close()
+	answering := NewGroup("TestDeadPeerFallsBackToLocalLoad-answering", 0, getter,
+		WithPeerPicker(fakePeers{newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})}), WithLoadLocallyOnPeerFailure())
+	defer DeregisterGroup(answering.Name())
+	atomic.StoreInt32(&localLoads, 0)
+	status = http.StatusInternalServerError
+	if err := answering.Get(context.Background(), "key", StringSink(&s)); err != nil || localLoads != 1 {
+		t.Errorf("Get with an owner failing with 500 = %v after %d local loads; want the value loaded locally", err, localLoads)
+	}
+	status = http.StatusBadRequest
+	if err := answering.Get(context.Background(), "key", StringSink(&s)); !errors.As(err, &rerr) || rerr.StatusCode != status || localLoads != 1 {
+		t.Errorf("Get with an owner answering 400 = %v after %d local loads; want its RemoteLoadError and no local load", err, localLoads)
+	}
+}
+
+func TestHTTPPoolPeerLatency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("value")})
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	const delay = 30 * time.Millisecond
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath: defaultBasePath,
+		Replicas: defaultReplicas,
+		Transport: func(context.Context) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				time.Sleep(delay)
+				return http.DefaultTransport.RoundTrip(req)
+			})
+		},
+	}}
+	p.Set(ts.URL)
+	group, key := "group", "key"
+	for i := 0; i < 5; i++ {
+		if err := p.getters[ts.URL].Get(context.Background(), &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := p.PeerStats()[ts.URL].Latency
+	if stats.Count != 5 {
+		t.Errorf("latency count = %d; want 5", stats.Count)
+	}
+	if stats.Min < delay || stats.Mean() < delay || stats.Max < stats.Min {
+		t.Errorf("latency min %v, mean %v, max %v; want at least the injected %v", stats.Min, stats.Mean(), stats.Max, delay)
+	}
+	if p50 := stats.Percentile(50); p50 < delay || p50 > stats.Max {
+		t.Errorf("50th percentile latency = %v; want between %v and the max %v", p50, delay, stats.Max)
+	}
+
+	var s LatencyStats
+	for _, d := range []time.Duration{3 * time.Millisecond, 4 * time.Millisecond, 15 * time.Millisecond, 40 * time.Millisecond} {
+		s.add(d)
+	}
+	for p, want := range map[float64]time.Duration{25: 5 * time.Millisecond, 50: 5 * time.Millisecond, 75: 20 * time.Millisecond, 100: 40 * time.Millisecond} {
+		if got := s.Percentile(p); got != want {
+			t.Errorf("Percentile(%v) = %v; want %v", p, got, want)
+		}
+	}
+}
+
+func TestHTTPPoolMigration(t *testing.T) {
+	const self, old, added = "http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"
+	p := &HTTPPool{
+		self: self,
+		opts: HTTPPoolOptions{
+			BasePath: defaultBasePath,
+			Replicas: defaultReplicas,
+			HashFn:   consistenthash.Hash32(crc32.ChecksumIEEE),
+		},
+	}
+	p.Set(self, old)
+	oldGetter := p.getters[old]
+	if err := p.BeginMigration([]string{self, added}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.BeginMigration([]string{self}); err == nil {
+		t.Error("BeginMigration during a migration succeeded")
+	}
+
+	moved := 0
+	for _, key := range testKeys(100) {
+		prev, ok := p.PickPreviousPeer(key)
+		wasOld := p.prevPeers.Get(key) == old
+		if ok != wasOld {
+			t.Errorf("PickPreviousPeer(%q) = %v; want %v", key, ok, wasOld)
+		}
+		if ok {
+			moved++
+			if prev != oldGetter {
+				t.Errorf("PickPreviousPeer(%q) is not the getter of the previous owner", key)
+			}
+		}
+	}
+	if moved == 0 {
+		t.Error("no key moved from the removed peer")
+	}
+	if got := len(p.GetAll()); got != 2 {
+		t.Errorf("GetAll during a migration has %d peers; want 2", got)
+	}
+
+	p.CompleteMigration()
+	if _, ok := p.PickPreviousPeer(testKeys(1)[0]); ok {
+		t.Error("PickPreviousPeer after CompleteMigration picked a peer")
+	}
+	if got := len(p.GetAll()); got != 1 {
+		t.Errorf("GetAll after CompleteMigration has %d peers; want 1", got)
+	}
+
+	p.opts.MigrationWindow = time.Millisecond
+	if err := p.BeginMigration([]string{self, old}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.RLock()
+		migrating := p.migrating
+		p.mu.RUnlock()
+		if !migrating {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("migration not completed after MigrationWindow")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if p.getters[added] != nil {
+		t.Error("getter of a removed peer kept after the migration")
+	}
+
+	// The timer of a migration that already ended, firing late, leaves
+	// the next migration alone.
+	p.opts.MigrationWindow = time.Hour
+	if err := p.BeginMigration([]string{self}); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.RLock()
+	stale := p.migrationGen
+	p.mu.RUnlock()
+	p.CompleteMigration()
+	if err := p.BeginMigration([]string{self, old}); err != nil {
+		t.Fatal(err)
+	}
+	p.completeMigration(stale)
+	p.mu.RLock()
+	migrating := p.migrating
+	p.mu.RUnlock()
+	if !migrating {
+		t.Error("the timer of an earlier migration completed the current one")
+	}
+	p.CompleteMigration()
+}
+
+// previousOwnerPeers makes its group the owner of every key, with prev
+// as the previous owner.
+type previousOwnerPeers struct {
+	prev ProtoGetter
+}
+
+func (p previousOwnerPeers) PickPeer(string) (ProtoGetter, bool) { return nil, false }
+
+func (p previousOwnerPeers) GetAll() []ProtoGetter { return []ProtoGetter{p.prev} }
+
+func (p previousOwnerPeers) PickPreviousPeer(string) (ProtoGetter, bool) { return p.prev, true }
+
+func TestPreviousOwnerFallback(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		Replicas:           defaultReplicas,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	var prevLoads AtomicInt
+	prev := newGroup("TestPreviousOwnerFallback-prev", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		prevLoads.Add(1)
+		return dest.SetString("prev:"+key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(prev.Name())
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	var s string
+	if err := prev.Get(dummyCtx, "cached", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHTTPGetter(ts.URL+defaultBasePath, &HTTPPoolOptions{})
+	owner := newGroup("TestPreviousOwnerFallback-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		return dest.SetString("owner:"+key, time.Time{})
+	}), previousOwnerPeers{renamingPeer{h, prev.Name()}})
+	defer DeregisterGroup(owner.Name())
+
+	for _, tt := range []struct{ key, want string }{
+		{"cached", "prev:cached"},
+		{"uncached", "owner:uncached"},
+	} {
+		if err := owner.Get(context.Background(), tt.key, StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if s != tt.want {
+			t.Errorf("Get(%q) = %q; want %q", tt.key, s, tt.want)
+		}
+	}
+	if got := prevLoads.Get(); got != 1 {
+		t.Errorf("previous owner loaded %d keys; want 1", got)
+	}
+	if hits, misses := owner.Stats.PreviousOwnerHits.Get(), owner.Stats.PreviousOwnerMisses.Get(); hits != 1 || misses != 1 {
+		t.Errorf("PreviousOwnerHits, PreviousOwnerMisses = %d, %d; want 1, 1", hits, misses)
+	}
+	if !owner.mainCache.contains("cached") {
+		t.Error("value from the previous owner not in the main cache")
+	}
+}
+
+func TestServeHTTPNormalizesKeys(t *testing.T) {
+	p := &HTTPPool{opts: HTTPPoolOptions{
+		BasePath:           defaultBasePath,
+		ServerErrorHandler: DefaultServerErrorHandler,
+	}}
+	var loaded []string
+	g := NewGroup("TestServeHTTPNormalizesKeys-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loaded = append(loaded, key)
+		return dest.SetString("value", time.Time{})
+	}), WithPeerPicker(NoPeers{}), WithKeyNormalizeFn(strings.ToLower))
+	defer DeregisterGroup(g.Name())
+
+	// Requests from peers that do not normalize the key.
+	for _, key := range []string{"KEY", "Key"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/"+key, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d; want %d", key, rec.Code, http.StatusOK)
+		}
+	}
+	if !reflect.DeepEqual(loaded, []string{"key"}) {
+		t.Errorf("loaded keys %q; want [\"key\"]", loaded)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, defaultBasePath+g.Name()+"/kEY", nil))
+	if g.cached("key") {
+		t.Error("key still cached after a DELETE of another case")
+	}
+}
+
+func TestHTTPPoolKetama(t *testing.T) {
+	p := &HTTPPool{
+		self: "http://10.0.1.1:11211",
+		opts: HTTPPoolOptions{BasePath: defaultBasePath, Ketama: true},
+	}
+	p.Set("http://10.0.1.1:11211", "http://10.0.1.2:11211", "http://10.0.1.3:11211")
+
+	// The ring of the memcached servers of the same names.
+	ring := consistenthash.NewKetama(nil)
+	ring.Add("10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211")
+	for _, key := range testKeys(100) {
+		want := ring.Get(key)
+		if want == "10.0.1.1:11211" {
+			if peer, ok := p.PickPeer(key); ok {
+				t.Errorf("PickPeer(%q) = %v; want self", key, peer)
+			}
+			continue
+		}
+		peer, ok := p.PickPeer(key)
+		if !ok || peer.GetURL() != "http://"+want+defaultBasePath {
+			t.Errorf("PickPeer(%q) = %v; want %s", key, peer, want)
+		}
+	}
+}
+
+func TestHTTPPoolHashSeed(t *testing.T) {
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"}
+	owners := func(seed uint64) map[string]string {
+		p := &HTTPPool{
+			self: "http://10.0.0.1:8000",
+			opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas, HashSeed: seed},
+		}
+		p.Set(peers...)
+		res := make(map[string]string)
+		for _, key := range testKeys(100) {
+			owner := "self"
+			if peer, ok := p.PickPeer(key); ok {
+				owner = peer.GetURL()
+			}
+			res[key] = owner
+		}
+		return res
+	}
+	if !reflect.DeepEqual(owners(7), owners(7)) {
+		t.Error("owners differ between pools of the same HashSeed")
+	}
+	if reflect.DeepEqual(owners(0), owners(7)) {
+		t.Error("owners are the same for another HashSeed")
+	}
+}
+
+func TestHTTPPoolPickPeerHashed(t *testing.T) {
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"}
+	for _, tt := range []struct {
+		name string
+		opts HTTPPoolOptions
+		fn   consistenthash.Hash
+	}{
+		{"HashFn", HTTPPoolOptions{HashFn: consistenthash.StableHash}, consistenthash.StableHash},
+		{"HashSeed", HTTPPoolOptions{HashFn: consistenthash.XXHash64, HashSeed: 7}, consistenthash.XXHash64},
+		{"Ketama", HTTPPoolOptions{Ketama: true}, consistenthash.KetamaHash},
+	} {
+		tt.opts.BasePath = defaultBasePath
+		if !tt.opts.Ketama {
+			tt.opts.Replicas = defaultReplicas
+		}
+		p := &HTTPPool{self: "http://10.0.0.1:8000", opts: tt.opts}
+		p.Set()
+		if _, ok := p.PickPeerHashed(1); ok {
+			t.Errorf("%s: PickPeerHashed without peers nominated a peer", tt.name)
+		}
+		p.Set(peers...)
+		var remote int
+		for _, key := range testKeys(100) {
+			want, wantOK := p.PickPeer(key)
+			got, ok := p.PickPeerHashed(tt.fn([]byte(key)))
+			if got != want || ok != wantOK {
+				t.Fatalf("%s: PickPeerHashed of the hash of %q = %v, %t; want %v, %t", tt.name, key, got, ok, want, wantOK)
+			}
+			if ok {
+				remote++
+			}
+		}
+		if remote == 0 || remote == 100 {
+			t.Errorf("%s: %d of 100 keys owned by other peers; want some", tt.name, remote)
+		}
+	}
+}
+
+func TestHTTPPoolRingSnapshot(t *testing.T) {
+	p, err := NewHTTPPoolWith("http://10.0.0.1:8000", WithHTTPPoolOptions(HTTPPoolOptions{
+		BasePath: "/snapshot-a/",
+		XXHash:   true,
+		HashSeed: 42,
+		Replicas: 20,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.SetWeighted(map[string]int{"http://10.0.0.1:8000": 1, "http://10.0.0.2:8000": 2, "http://10.0.0.3:8000": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(p.RingSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap RingSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Self != "http://10.0.0.1:8000" || snap.Ring.Seed != 42 || snap.Ring.Members["http://10.0.0.2:8000"] != 40 {
+		t.Errorf("RingSnapshot = %+v; want self, seed 42 and 40 replicas for the peer of weight 2", snap)
+	}
+
+	// The BasePath of the snapshot is taken.
+	if _, err := NewHTTPPoolFromSnapshot(snap); err == nil {
+		t.Error("NewHTTPPoolFromSnapshot with the BasePath of another pool succeeded")
+	}
+	restored, err := NewHTTPPoolFromSnapshot(snap, WithBasePath("/snapshot-b/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	owner := func(p *HTTPPool, key string) string {
+		if peer, ok := p.PickPeer(key); ok {
+			return strings.TrimSuffix(peer.GetURL(), p.opts.BasePath)
+		}
+		return "self"
+	}
+	for _, key := range testKeys(1000) {
+		if got, want := owner(restored, key), owner(p, key); got != want {
+			t.Fatalf("restored pool picks %s for %q; want %s", got, key, want)
+		}
+	}
+
+	snap.Ring.Members["http://10.0.0.4:8000"] = 15
+	if _, err := NewHTTPPoolFromSnapshot(snap, WithBasePath("/snapshot-c/")); err == nil || !strings.Contains(err.Error(), "10.0.0.4") {
+		t.Errorf("NewHTTPPoolFromSnapshot with 15 replicas out of 20 = %v; want an error naming the peer", err)
+	}
+}
+
+func TestHTTPPoolReplicaKeyFunc(t *testing.T) {
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://10.0.0.3:8000"}
+	replicaKey := func(member string, replica int) []byte {
+		return []byte(member + "-" + strconv.Itoa(replica))
+	}
+	p := &HTTPPool{
+		self: "http://10.0.0.1:8000",
+		opts: HTTPPoolOptions{BasePath: defaultBasePath, Replicas: defaultReplicas, ReplicaKeyFunc: replicaKey},
+	}
+	p.Set(peers...)
+
+	ring := consistenthash.New(defaultReplicas, nil)
+	ring.SetReplicaKeyFunc(replicaKey)
+	ring.Add(peers...)
+	for _, key := range testKeys(100) {
+		want := ring.Get(key)
+		got := p.self
+		if peer, ok := p.PickPeer(key); ok {
+			got = strings.TrimSuffix(peer.GetURL(), defaultBasePath)
+		}
+		if got != want {
+			t.Errorf("owner of %q = %s; want %s", key, got, want)
+		}
+	}
+}
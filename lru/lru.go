@@ -32,6 +32,11 @@ type Cache struct {
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key Key, value interface{})
 
+	// OnEvictedAge optionally specifies a callback function to be
+	// executed when an entry is purged from the cache, after OnEvicted,
+	// with how long ago the entry was added or last updated.
+	OnEvictedAge func(key Key, value interface{}, age time.Duration)
+
 	ll    *list.List
 	cache map[interface{}]*list.Element
 }
@@ -43,6 +48,7 @@ type entry struct {
 	key    Key
 	value  interface{}
 	expire time.Time
+	added  time.Time // only set with OnEvictedAge
 }
 
 // New creates a new Cache.
@@ -62,12 +68,17 @@ func (c *Cache) Add(key Key, value interface{}, expire time.Time) {
 		c.cache = make(map[interface{}]*list.Element)
 		c.ll = list.New()
 	}
+	var added time.Time
+	if c.OnEvictedAge != nil {
+		added = time.Now()
+	}
 	if ee, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ee)
-		ee.Value.(*entry).value = value
+		e := ee.Value.(*entry)
+		e.value, e.expire, e.added = value, expire, added
 		return
 	}
-	ele := c.ll.PushFront(&entry{key, value, expire})
+	ele := c.ll.PushFront(&entry{key, value, expire, added})
 	c.cache[key] = ele
 	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
 		c.RemoveOldest()
@@ -93,6 +104,19 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	return
 }
 
+// Peek returns the value of key and its expiry, even if it has expired,
+// without updating its recency.
+func (c *Cache) Peek(key Key) (value interface{}, expire time.Time, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*entry)
+		return entry.value, entry.expire, true
+	}
+	return
+}
+
 // Remove removes the provided key from the cache.
 func (c *Cache) Remove(key Key) {
 	if c.cache == nil {
@@ -118,9 +142,16 @@ func (c *Cache) removeElement(e *list.Element) {
 	c.ll.Remove(e)
 	kv := e.Value.(*entry)
 	delete(c.cache, kv.key)
+	c.evicted(kv)
+}
+
+func (c *Cache) evicted(kv *entry) {
 	if c.OnEvicted != nil {
 		c.OnEvicted(kv.key, kv.value)
 	}
+	if c.OnEvictedAge != nil {
+		c.OnEvictedAge(kv.key, kv.value, time.Since(kv.added))
+	}
 }
 
 // Len returns the number of items in the cache.
@@ -131,13 +162,25 @@ func (c *Cache) Len() int {
 	return c.ll.Len()
 }
 
+// Range calls fn for each item in the cache, from the least to the most
+// recently used, until fn returns false. It does not change the order of
+// the items, and fn must not modify the cache.
+func (c *Cache) Range(fn func(key Key, value interface{}, expire time.Time) bool) {
+	if c.cache == nil {
+		return
+	}
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		kv := e.Value.(*entry)
+		if !fn(kv.key, kv.value, kv.expire) {
+			return
+		}
+	}
+}
+
 // Clear purges all stored items from the cache.
 func (c *Cache) Clear() {
-	if c.OnEvicted != nil {
-		for _, e := range c.cache {
-			kv := e.Value.(*entry)
-			c.OnEvicted(kv.key, kv.value)
-		}
+	for _, e := range c.cache {
+		c.evicted(e.Value.(*entry))
 	}
 	c.ll = nil
 	c.cache = nil
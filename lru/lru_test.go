@@ -97,6 +97,53 @@ func TestEvict(t *testing.T) {
 	}
 }
 
+func TestEvictAge(t *testing.T) {
+	var ages []time.Duration
+	lru := New(1)
+	lru.OnEvictedAge = func(_ Key, _ interface{}, age time.Duration) {
+		ages = append(ages, age)
+	}
+	lru.Add("myKey0", 1234, time.Time{})
+	time.Sleep(10 * time.Millisecond)
+	lru.Add("myKey1", 1234, time.Time{})
+
+	if len(ages) != 1 || ages[0] < 10*time.Millisecond || ages[0] > time.Second {
+		t.Fatalf("got evicted ages %v; want one of about 10ms", ages)
+	}
+}
+
+func TestAddUpdatesExpire(t *testing.T) {
+	lru := New(0)
+	lru.Add("myKey", 1, time.Now().Add(-time.Second))
+	lru.Add("myKey", 2, time.Time{})
+	if val, ok := lru.Get("myKey"); !ok || val != 2 {
+		t.Fatalf("Get after replacing an expired entry = %v, %v; want 2, true", val, ok)
+	}
+}
+
+func TestRange(t *testing.T) {
+	lru := New(0)
+	for i := 0; i < 3; i++ {
+		lru.Add(fmt.Sprintf("myKey%d", i), i, time.Time{})
+	}
+	lru.Get("myKey0")
+
+	var keys []Key
+	lru.Range(func(key Key, value interface{}, expire time.Time) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if want := []Key{"myKey1", "myKey2", "myKey0"}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("Range visited %v; want %v", keys, want)
+	}
+
+	var n int
+	lru.Range(func(Key, interface{}, time.Time) bool { n++; return false })
+	if n != 1 {
+		t.Fatalf("Range visited %d items after fn returned false; want 1", n)
+	}
+}
+
 func TestExpire(t *testing.T) {
 	var tests = []struct {
 		name       string
@@ -20,6 +20,7 @@ package groupcache
 
 import (
 	"context"
+	"sync"
 
 	pb "accedo.io/groupcache/v2/groupcachepb"
 )
@@ -32,6 +33,15 @@ type ProtoGetter interface {
 	GetURL() string
 }
 
+// ProtoSetter is a ProtoGetter that can also store a value in the caches
+// of its peer, which groups made WithReadRepair use.
+type ProtoSetter interface {
+	ProtoGetter
+	// Set stores value, as a GetResponse would hold it, for the group
+	// and key of in in the caches of the peer.
+	Set(context context.Context, in *pb.GetRequest, value *pb.GetResponse) error
+}
+
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
 type PeerPicker interface {
@@ -43,6 +53,37 @@ type PeerPicker interface {
 	GetAll() []ProtoGetter
 }
 
+// MultiPeerPicker is a PeerPicker that can nominate several owners for a
+// key, which groups created WithReplication use.
+type MultiPeerPicker interface {
+	PeerPicker
+	// PickPeers returns up to n distinct owners of the specific key, in
+	// order of preference. The current peer, if it is one of them, is
+	// returned as a nil ProtoGetter.
+	PickPeers(key string, n int) []ProtoGetter
+}
+
+// HashedPeerPicker is a PeerPicker that can locate the owner of a key from
+// its hash, for callers of Group.GetHashed that already hashed the key.
+type HashedPeerPicker interface {
+	PeerPicker
+	// PickPeerHashed is like PickPeer for a key with the given hash.
+	PickPeerHashed(hash uint64) (peer ProtoGetter, ok bool)
+}
+
+// MigratingPeerPicker is a PeerPicker whose peers are changing, e.g.
+// HTTPPool between BeginMigration and CompleteMigration. Before loading a
+// key it owns, a peer first asks the previous owner of the key for its
+// cached value, if any.
+type MigratingPeerPicker interface {
+	PeerPicker
+
+	// PickPreviousPeer returns the peer that owned the specific key
+	// before the peers changed, and true, if it is neither its current
+	// owner nor the current peer.
+	PickPreviousPeer(key string) (peer ProtoGetter, ok bool)
+}
+
 // NoPeers is an implementation of PeerPicker that never finds a peer.
 type NoPeers struct{}
 
@@ -50,7 +91,8 @@ func (NoPeers) PickPeer(key string) (peer ProtoGetter, ok bool) { return }
 func (NoPeers) GetAll() []ProtoGetter                           { return []ProtoGetter{} }
 
 var (
-	portPicker func(groupName string) PeerPicker
+	portPickerMu sync.RWMutex // guards portPicker
+	portPicker   func(groupName string) PeerPicker
 )
 
 // RegisterPeerPicker registers the peer initialization function.
@@ -58,10 +100,9 @@ var (
 // Either RegisterPeerPicker or RegisterPerGroupPeerPicker should be
 // called exactly once, but not both.
 func RegisterPeerPicker(fn func() PeerPicker) {
-	if portPicker != nil {
+	if !registerPortPicker(func(_ string) PeerPicker { return fn() }) {
 		panic("RegisterPeerPicker called more than once")
 	}
-	portPicker = func(_ string) PeerPicker { return fn() }
 }
 
 // RegisterPerGroupPeerPicker registers the peer initialization function,
@@ -70,17 +111,39 @@ func RegisterPeerPicker(fn func() PeerPicker) {
 // Either RegisterPeerPicker or RegisterPerGroupPeerPicker should be
 // called exactly once, but not both.
 func RegisterPerGroupPeerPicker(fn func(groupName string) PeerPicker) {
-	if portPicker != nil {
+	if !registerPortPicker(fn) {
 		panic("RegisterPeerPicker called more than once")
 	}
+}
+
+// registerPortPicker registers fn unless a peer initialization function
+// already is, and returns whether it did.
+func registerPortPicker(fn func(groupName string) PeerPicker) bool {
+	portPickerMu.Lock()
+	defer portPickerMu.Unlock()
+	if portPicker != nil {
+		return false
+	}
 	portPicker = fn
+	return true
+}
+
+// unregisterPortPicker unregisters the peer initialization function, so
+// that another may be registered.
+func unregisterPortPicker() {
+	portPickerMu.Lock()
+	portPicker = nil
+	portPickerMu.Unlock()
 }
 
 func getPeers(groupName string) PeerPicker {
-	if portPicker == nil {
+	portPickerMu.RLock()
+	pick := portPicker
+	portPickerMu.RUnlock()
+	if pick == nil {
 		return NoPeers{}
 	}
-	pk := portPicker(groupName)
+	pk := pick(groupName)
 	if pk == nil {
 		pk = NoPeers{}
 	}
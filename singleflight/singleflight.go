@@ -19,57 +19,260 @@ limitations under the License.
 package singleflight
 
 import (
+	"context"
+	"fmt"
 	"github.com/pkg/errors"
+	"runtime/debug"
 	"sync"
 	"time"
 )
 
 // call is an in-flight or completed Do call
 type call struct {
-	wg      sync.WaitGroup
+	done    chan struct{} // closed once val and err are set
 	created time.Time
 	val     interface{}
 	err     error
+
+	// dups and chans are the number of duplicate callers and the
+	// channels of the DoChan callers, guarded by the mutex of the group.
+	dups  int
+	chans []chan<- Result
+
+	// ttl and errTTL are how long the results are held once done, as
+	// set by DoCached, and expires when they stop being served.
+	ttl, errTTL time.Duration
+	expires     time.Time
+}
+
+// Result holds the results of a call, as delivered by DoChan.
+type Result struct {
+	Val interface{}
+	Err error
+
+	// Shared is whether the results were delivered to several callers.
+	Shared bool
+}
+
+// ErrOverloaded is returned by Do when MaxFlights calls are in flight.
+var ErrOverloaded = errors.New("singleflight: too many calls in flight")
+
+// ErrGoexit is returned to the callers waiting for a call whose fn
+// called runtime.Goexit, as t.Fatal does in tests, rather than return.
+var ErrGoexit = errors.New("singleflight: leader called runtime.Goexit")
+
+// PanicError is returned to the callers waiting for a call whose fn
+// panicked. The caller running fn panics again with Value.
+type PanicError struct {
+	Value interface{} // the value fn panicked with
+	Stack string      // the stack of fn when it panicked
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("singleflight leader panicked: %v\n\n%s", p.Value, p.Stack)
 }
 
 // Group represents a class of work and forms a namespace in which
 // units of work can be executed with duplicate suppression.
 type Group struct {
-	mu sync.Mutex       // protects m
-	m  map[string]*call // lazily initialized
+	// MaxFlights optionally limits the number of keys with a call in
+	// flight. Once reached, Do fails with ErrOverloaded for other keys,
+	// while duplicate calls still wait for the call in flight.
+	// If zero, there is no limit.
+	MaxFlights int
+
+	mu   sync.Mutex       // protects m and held
+	m    map[string]*call // lazily initialized
+	held map[string]*call // done calls held by DoCached, lazily initialized
 }
 
 // Do executes and returns the results of the given function, making
 // sure that only one execution is in-flight for a given key at a
 // time. If a duplicate comes in, the duplicate caller waits for the
-// original to complete and receives the same results.
+// original to complete and receives the same results. If fn panics,
+// the duplicate callers receive a *PanicError, and the original caller
+// panics again with the same value.
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.DoCtx(nil, key, fn)
+}
+
+// DoCtx is like Do, but a duplicate caller stops waiting for the call in
+// flight once ctx is done, returning ctx.Err(), while the call goes on
+// for the other callers. The caller running fn is not affected by ctx,
+// which fn may however use. A nil ctx is never done.
+func (g *Group) DoCtx(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.doCtx(ctx, key, 0, 0, fn)
+}
+
+// DoCached is like Do, but the results are held once fn returns, for ttl
+// or, if fn failed, for errTTL, and returned to later DoCached callers
+// for key without calling fn again, e.g. to spare a new load of a hot key
+// right after the previous one. A zero TTL holds nothing. A call started
+// by Do, DoCtx or DoChan holds nothing either, and a call shared by
+// several DoCached callers holds its results for the TTLs of the first.
+// Results of fn that panicked are never held. Held results are only
+// returned by DoCached, and dropped once expired or by Forget.
+func (g *Group) DoCached(key string, ttl, errTTL time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	return g.doCtx(nil, key, ttl, errTTL, fn)
+}
+
+// doCtx implements DoCtx and DoCached; a zero ttl and errTTL neither
+// use nor hold results.
+func (g *Group) doCtx(ctx context.Context, key string, ttl, errTTL time.Duration, fn func() (interface{}, error)) (interface{}, error) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
+	if c, ok := g.held[key]; ok && (ttl > 0 || errTTL > 0) {
+		if time.Now().Before(c.expires) {
+			g.mu.Unlock()
+			return c.val, c.err
+		}
+		delete(g.held, key)
+	}
 	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		select {
+		case <-c.done:
+			return c.val, c.err
+		case <-done:
+			return nil, ctx.Err()
+		}
+	}
+	if g.MaxFlights > 0 && len(g.m) >= g.MaxFlights {
 		g.mu.Unlock()
-		c.wg.Wait()
-		return c.val, c.err
+		return nil, ErrOverloaded
 	}
+	c := g.newCall(key)
+	c.ttl, c.errTTL = ttl, errTTL
+	g.mu.Unlock()
+
+	g.doCall(c, key, fn)
+	return c.val, c.err
+}
+
+// DoChan is like Do, but returns at once a channel that receives the
+// results when they are ready, with fn running in its own goroutine.
+// Calls are shared with those of Do for the same key. The channel is
+// buffered, so the results are delivered even if it is never read.
+// If fn panics, the callers waiting for it receive a *PanicError, and
+// the panic goes on in the goroutine running fn.
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.chans = append(c.chans, ch)
+		g.mu.Unlock()
+		return ch
+	}
+	if g.MaxFlights > 0 && len(g.m) >= g.MaxFlights {
+		g.mu.Unlock()
+		ch <- Result{Err: ErrOverloaded}
+		return ch
+	}
+	c := g.newCall(key)
+	c.chans = append(c.chans, ch)
+	g.mu.Unlock()
+
+	go g.doCall(c, key, fn)
+	return ch
+}
+
+// newCall registers a call in flight for key; g.mu must be held.
+func (g *Group) newCall(key string) *call {
 	c := &call{
+		done:    make(chan struct{}),
 		created: time.Now().UTC(),
-		err:     errors.Errorf("singleflight leader panicked"),
 	}
-	c.wg.Add(1)
 	g.m[key] = c
-	g.mu.Unlock()
+	return c
+}
 
+// doCall runs fn for c, then delivers its results to the callers.
+// A panic of fn is recovered to deliver a *PanicError, then raised again.
+func (g *Group) doCall(c *call, key string, fn func() (interface{}, error)) {
+	var normalReturn bool
+	var panicked *PanicError
 	defer func() {
-		c.wg.Done()
+		// Neither returned nor panicked: fn called runtime.Goexit.
+		if !normalReturn && panicked == nil {
+			c.err = ErrGoexit
+		}
+		close(c.done)
 		g.mu.Lock()
-		delete(g.m, key)
+		if g.m[key] == c {
+			delete(g.m, key)
+			if normalReturn {
+				g.hold(key, c)
+			}
+		}
+		res := Result{Val: c.val, Err: c.err, Shared: c.dups > 0}
+		chans := c.chans
 		g.mu.Unlock()
+		for _, ch := range chans {
+			ch <- res
+		}
+		if panicked != nil {
+			panic(panicked.Value)
+		}
 	}()
 
-	c.val, c.err = fn()
-	return c.val, c.err
+	func() {
+		defer func() {
+			if !normalReturn {
+				if r := recover(); r != nil {
+					panicked = &PanicError{Value: r, Stack: string(debug.Stack())}
+					c.val, c.err = nil, panicked
+				}
+			}
+		}()
+		c.val, c.err = fn()
+		normalReturn = true
+	}()
+}
+
+// hold holds the results of c, done, for its TTL, and drops them on a
+// timer once expired; g.mu must be held.
+func (g *Group) hold(key string, c *call) {
+	ttl := c.ttl
+	if c.err != nil {
+		ttl = c.errTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if g.held == nil {
+		g.held = make(map[string]*call)
+	}
+	c.expires = time.Now().Add(ttl)
+	g.held[key] = c
+	time.AfterFunc(ttl, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.held[key] == c {
+			delete(g.held, key)
+		}
+	})
+}
+
+// Forget forgets the call in flight for key, if any, so that later calls
+// for key start a new one rather than wait for it, e.g. once what it
+// loads is known to be stale. The callers already waiting for it still
+// receive its results. Results held by DoCached for key are dropped too.
+func (g *Group) Forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.m, key)
+	delete(g.held, key)
 }
 
 // Count returns the number of currently active single flight entries.
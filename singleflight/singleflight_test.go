@@ -17,8 +17,10 @@ limitations under the License.
 package singleflight
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -149,3 +151,354 @@ func TestDoConcurrentPanic(t *testing.T) {
 		t.Errorf("number of calls = %d; want 1", got)
 	}
 }
+
+func TestDoPanicError(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	leaderPanic := make(chan interface{}, 1)
+	go func() {
+		defer func() { leaderPanic <- recover() }()
+		_, _ = g.Do("key", func() (interface{}, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+	for g.Count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ch := g.DoChan("key", func() (interface{}, error) { return "dup", nil })
+	close(release)
+
+	res := <-ch
+	var pe *PanicError
+	if !errors.As(res.Err, &pe) {
+		t.Fatalf("DoChan error = %v; want a *PanicError", res.Err)
+	}
+	if pe.Value != "boom" {
+		t.Errorf("PanicError.Value = %v; want boom", pe.Value)
+	}
+	if !strings.Contains(pe.Stack, "TestDoPanicError") {
+		t.Errorf("PanicError.Stack misses the panicking function:\n%s", pe.Stack)
+	}
+	if r := <-leaderPanic; r != "boom" {
+		t.Errorf("leader panicked with %v; want boom", r)
+	}
+}
+
+func TestDoGoexit(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		_, _ = g.Do("key", func() (interface{}, error) {
+			<-release
+			runtime.Goexit()
+			return nil, nil
+		})
+		t.Error("Do returned after runtime.Goexit")
+	}()
+	for g.Count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ch := g.DoChan("key", func() (interface{}, error) { return "dup", nil })
+	close(release)
+
+	if res := <-ch; res.Err != ErrGoexit {
+		t.Errorf("DoChan error = %v; want ErrGoexit", res.Err)
+	}
+	<-exited
+}
+
+func TestDoCached(t *testing.T) {
+	var g Group
+	var calls int32
+	fn := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := g.DoCached("key", 50*time.Millisecond, 0, fn); v != int32(1) || err != nil {
+			t.Errorf("DoCached %d = %v, %v; want the held 1", i, v, err)
+		}
+	}
+	// Do neither uses nor holds results.
+	if v, _ := g.Do("key", fn); v != int32(2) {
+		t.Errorf("Do = %v; want 2", v)
+	}
+
+	// Held results are dropped by Forget, and once expired.
+	g.Forget("key")
+	if v, _ := g.DoCached("key", 20*time.Millisecond, 0, fn); v != int32(3) {
+		t.Errorf("DoCached after Forget = %v; want 3", v)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if n := heldCount(&g); n != 0 {
+		t.Errorf("%d results held after expiring; want 0", n)
+	}
+	if v, _ := g.DoCached("key", 20*time.Millisecond, 0, fn); v != int32(4) {
+		t.Errorf("DoCached after expiring = %v; want 4", v)
+	}
+}
+
+func TestDoCachedErrors(t *testing.T) {
+	var g Group
+	var calls int32
+	fn := func() (interface{}, error) {
+		return nil, fmt.Errorf("failure %d", atomic.AddInt32(&calls, 1))
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := g.DoCached("key", time.Minute, 0, fn); err == nil || err.Error() != fmt.Sprintf("failure %d", i+1) {
+			t.Errorf("DoCached %d without errTTL = %v; want a new failure", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := g.DoCached("other", 0, time.Minute, fn); err == nil || err.Error() != "failure 3" {
+			t.Errorf("DoCached %d with errTTL = %v; want the held failure 3", i, err)
+		}
+	}
+
+	// Panics are not held.
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() { _ = recover() }()
+			_, _ = g.DoCached("panic", time.Minute, time.Minute, func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				panic("boom")
+			})
+		}()
+	}
+	if calls != 5 {
+		t.Errorf("fn called %d times; want 5", calls)
+	}
+}
+
+// heldCount returns the number of results held by g.
+func heldCount(g *Group) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.held)
+}
+
+func TestDoMaxFlights(t *testing.T) {
+	g := Group{MaxFlights: 2}
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	var done sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		started.Add(1)
+		done.Add(1)
+		go func(key string) {
+			defer done.Done()
+			_, _ = g.Do(key, func() (interface{}, error) {
+				started.Done()
+				<-release
+				return key, nil
+			})
+		}(key)
+	}
+	started.Wait()
+
+	if _, err := g.Do("c", func() (interface{}, error) { return "c", nil }); err != ErrOverloaded {
+		t.Errorf("Do with MaxFlights stuck calls = %v; want ErrOverloaded", err)
+	}
+
+	// Duplicates of a call in flight still wait for it.
+	dup := make(chan interface{})
+	go func() {
+		v, _ := g.Do("a", func() (interface{}, error) { return "dup", nil })
+		dup <- v
+	}()
+	time.Sleep(20 * time.Millisecond) // let the duplicate join the call
+	close(release)
+	if v := <-dup; v != "a" {
+		t.Errorf("duplicate Do = %v; want the result of the call in flight", v)
+	}
+	done.Wait()
+
+	if v, err := g.Do("c", func() (interface{}, error) { return "c", nil }); err != nil || v != "c" {
+		t.Errorf("Do once calls completed = %v, %v; want c, nil", v, err)
+	}
+}
+
+func TestDoChan(t *testing.T) {
+	var g Group
+	res := <-g.DoChan("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if res.Val != "bar" || res.Err != nil || res.Shared {
+		t.Errorf("DoChan = %+v; want bar, no error, not shared", res)
+	}
+
+	// A result nobody reads does not keep the call in flight.
+	release := make(chan struct{})
+	g.DoChan("unread", func() (interface{}, error) {
+		<-release
+		return "unread", nil
+	})
+	close(release)
+	for g.Count() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoChanSharesDo(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+
+	done := make(chan interface{})
+	go func() {
+		v, _ := g.Do("key", fn)
+		done <- v
+	}()
+	for g.Count() == 0 {
+		time.Sleep(time.Millisecond) // let Do lead the call
+	}
+	ch1 := g.DoChan("key", fn)
+	ch2 := g.DoChan("key", fn)
+	close(release)
+
+	if v := <-done; v != "bar" {
+		t.Errorf("Do = %v; want bar", v)
+	}
+	for _, ch := range []<-chan Result{ch1, ch2} {
+		if res := <-ch; res.Val != "bar" || res.Err != nil || !res.Shared {
+			t.Errorf("DoChan joining Do = %+v; want bar, no error, shared", res)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("number of calls = %d; want 1", got)
+	}
+
+	// Do joins a DoChan call too.
+	release = make(chan struct{})
+	ch := g.DoChan("key", fn)
+	go func() {
+		v, _ := g.Do("key", func() (interface{}, error) { return "dup", nil })
+		done <- v
+	}()
+	time.Sleep(20 * time.Millisecond) // let Do join the call
+	close(release)
+	if v := <-done; v != "bar" {
+		t.Errorf("Do joining DoChan = %v; want bar", v)
+	}
+	if res := <-ch; !res.Shared {
+		t.Errorf("DoChan joined by Do = %+v; want shared", res)
+	}
+}
+
+func TestDoChanMaxFlights(t *testing.T) {
+	g := Group{MaxFlights: 1}
+	release := make(chan struct{})
+	ch := g.DoChan("a", func() (interface{}, error) {
+		<-release
+		return "a", nil
+	})
+	if res := <-g.DoChan("b", func() (interface{}, error) { return "b", nil }); res.Err != ErrOverloaded {
+		t.Errorf("DoChan with MaxFlights calls in flight = %+v; want ErrOverloaded", res)
+	}
+	close(release)
+	if res := <-ch; res.Val != "a" {
+		t.Errorf("DoChan = %+v; want a", res)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	first := make(chan interface{}, 2)
+	go func() {
+		v, _ := g.Do("key", func() (interface{}, error) {
+			<-release
+			return "first", nil
+		})
+		first <- v
+	}()
+	for g.Count() == 0 {
+		time.Sleep(time.Millisecond) // let the first call start
+	}
+	waiter := g.DoChan("key", func() (interface{}, error) { return "waiter", nil })
+
+	g.Forget("key")
+	secondRelease := make(chan struct{})
+	second := g.DoChan("key", func() (interface{}, error) {
+		<-secondRelease
+		return "second", nil
+	})
+	close(release)
+	if v := <-first; v != "first" {
+		t.Errorf("forgotten call = %v; want first", v)
+	}
+	if res := <-waiter; res.Val != "first" {
+		t.Errorf("waiter of the forgotten call = %+v; want first", res)
+	}
+
+	// The forgotten call completing leaves the new one in flight.
+	if n := g.Count(); n != 1 {
+		t.Errorf("Count after the forgotten call completed = %d; want 1", n)
+	}
+	dup := g.DoChan("key", func() (interface{}, error) { return "dup", nil })
+	close(secondRelease)
+	if res := <-second; res.Val != "second" {
+		t.Errorf("call after Forget = %+v; want second", res)
+	}
+	if res := <-dup; res.Val != "second" {
+		t.Errorf("duplicate of the call after Forget = %+v; want second", res)
+	}
+
+	g.Forget("missing")
+}
+
+func TestDoCtx(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	leader := make(chan interface{})
+	go func() {
+		v, _ := g.DoCtx(context.Background(), "key", func() (interface{}, error) {
+			<-release
+			return "bar", nil
+		})
+		leader <- v
+	}()
+	for g.Count() == 0 {
+		time.Sleep(time.Millisecond) // let the leader start the call
+	}
+
+	waiter := make(chan interface{})
+	go func() {
+		v, _ := g.DoCtx(context.Background(), "key", func() (interface{}, error) { return "dup", nil })
+		waiter <- v
+	}()
+
+	// A waiter whose context is done returns at once.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := g.DoCtx(ctx, "key", func() (interface{}, error) { return "dup", nil }); err != context.DeadlineExceeded {
+		t.Errorf("DoCtx waiting past its deadline = %v; want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("DoCtx returned %v after its deadline; want promptly", d)
+	}
+
+	// The leader and the other waiters go on.
+	close(release)
+	if v := <-leader; v != "bar" {
+		t.Errorf("leader DoCtx = %v; want bar", v)
+	}
+	if v := <-waiter; v != "bar" {
+		t.Errorf("waiting DoCtx = %v; want bar", v)
+	}
+
+	// A leader ignores its context, which fn may use.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if v, err := g.DoCtx(ctx, "key", func() (interface{}, error) { return "lead", nil }); v != "lead" || err != nil {
+		t.Errorf("DoCtx leading with a done context = %v, %v; want lead, nil", v, err)
+	}
+}
@@ -17,9 +17,12 @@ limitations under the License.
 package groupcache
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -28,6 +31,7 @@ var _ Sink = &allocBytesSink{}
 var _ Sink = &protoSink{}
 var _ Sink = &truncBytesSink{}
 var _ Sink = &byteViewSink{}
+var _ Sink = &jsonSink{}
 
 // A Sink receives data from a Get call.
 //
@@ -47,6 +51,16 @@ type Sink interface {
 
 	// view returns a frozen view of the bytes for caching.
 	view() (ByteView, error)
+
+	// setVersion sets the version of the value.
+	setVersion(version string)
+}
+
+// SetVersion sets the version of the value of s, such as the revision of
+// the value in the backing store, so that Group.RemoveVersion can tell
+// out-of-order removes apart. It must be called after the Set method.
+func SetVersion(s Sink, version string) {
+	s.setVersion(version)
 }
 
 func cloneBytes(b []byte) []byte {
@@ -83,6 +97,10 @@ type stringSink struct {
 	// TODO(bradfitz): track whether any Sets were called.
 }
 
+func (s *stringSink) setVersion(version string) {
+	s.v.version = version
+}
+
 func (s *stringSink) view() (ByteView, error) {
 	// TODO(bradfitz): return an error if no Set was called
 	return s.v, nil
@@ -137,6 +155,10 @@ func (s *byteViewSink) setView(v ByteView) error {
 	return nil
 }
 
+func (s *byteViewSink) setVersion(version string) {
+	s.dst.version = version
+}
+
 func (s *byteViewSink) view() (ByteView, error) {
 	return *s.dst, nil
 }
@@ -173,6 +195,10 @@ type protoSink struct {
 	v ByteView // encoded
 }
 
+func (s *protoSink) setVersion(version string) {
+	s.v.version = version
+}
+
 func (s *protoSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -219,6 +245,65 @@ func (s *protoSink) SetProto(m proto.Message, e time.Time) error {
 	return nil
 }
 
+// JSONSink returns a sink that decodes JSON values into v, as
+// json.Unmarshal would. The raw JSON is what gets cached.
+func JSONSink(v interface{}) Sink {
+	return &jsonSink{
+		dst: v,
+	}
+}
+
+type jsonSink struct {
+	dst interface{} // authoritative value
+
+	v ByteView // encoded
+}
+
+func (s *jsonSink) setVersion(version string) {
+	s.v.version = version
+}
+
+func (s *jsonSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *jsonSink) unmarshal(b []byte) error {
+	if err := json.Unmarshal(b, s.dst); err != nil {
+		return fmt.Errorf("groupcache: decoding JSON value: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonSink) SetBytes(b []byte, e time.Time) error {
+	if err := s.unmarshal(b); err != nil {
+		return err
+	}
+	s.v.b = cloneBytes(b)
+	s.v.s = ""
+	s.v.e = e
+	return nil
+}
+
+func (s *jsonSink) SetString(v string, e time.Time) error {
+	if err := s.unmarshal([]byte(v)); err != nil {
+		return err
+	}
+	s.v.b = nil
+	s.v.s = v
+	s.v.e = e
+	return nil
+}
+
+// SetProto sets the value to the JSON encoding of m, as produced
+// by jsonpb.
+func (s *jsonSink) SetProto(m proto.Message, e time.Time) error {
+	v, err := (&jsonpb.Marshaler{}).MarshalToString(m)
+	if err != nil {
+		return err
+	}
+	return s.SetString(v, e)
+}
+
 // AllocatingByteSliceSink returns a Sink that allocates
 // a byte slice to hold the received value and assigns
 // it to *dst. The memory is not retained by groupcache.
@@ -231,6 +316,10 @@ type allocBytesSink struct {
 	v   ByteView
 }
 
+func (s *allocBytesSink) setVersion(version string) {
+	s.v.version = version
+}
+
 func (s *allocBytesSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -279,6 +368,77 @@ func (s *allocBytesSink) SetString(v string, e time.Time) error {
 	return nil
 }
 
+// ReusingByteSliceSink returns a Sink that writes the value into *dst,
+// reusing its capacity: *dst is truncated to zero length and the value
+// appended to it, so callers getting values in a loop can pass the same
+// slice every time and only allocate when it needs to grow. The memory
+// is not retained by groupcache.
+func ReusingByteSliceSink(dst *[]byte) Sink {
+	return &reuseBytesSink{dst: dst}
+}
+
+type reuseBytesSink struct {
+	dst *[]byte
+	v   ByteView
+}
+
+func (s *reuseBytesSink) setVersion(version string) {
+	s.v.version = version
+}
+
+func (s *reuseBytesSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *reuseBytesSink) setView(v ByteView) error {
+	if s.dst == nil {
+		return errors.New("nil ReusingByteSliceSink *[]byte dst")
+	}
+	if v.b != nil {
+		*s.dst = append((*s.dst)[:0], v.b...)
+	} else {
+		*s.dst = append((*s.dst)[:0], v.s...)
+	}
+	s.v = v
+	return nil
+}
+
+func (s *reuseBytesSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b, e)
+}
+
+func (s *reuseBytesSink) SetBytes(b []byte, e time.Time) error {
+	return s.setBytesOwned(cloneBytes(b), e)
+}
+
+func (s *reuseBytesSink) setBytesOwned(b []byte, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil ReusingByteSliceSink *[]byte dst")
+	}
+	// The view keeps b, so the caller's slice gets a copy that it may
+	// overwrite without changing the cached value.
+	*s.dst = append((*s.dst)[:0], b...)
+	s.v.b = b
+	s.v.s = ""
+	s.v.e = e
+	return nil
+}
+
+func (s *reuseBytesSink) SetString(v string, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil ReusingByteSliceSink *[]byte dst")
+	}
+	*s.dst = append((*s.dst)[:0], v...)
+	s.v.b = nil
+	s.v.s = v
+	s.v.e = e
+	return nil
+}
+
 // TruncatingByteSliceSink returns a Sink that writes up to len(*dst)
 // bytes to *dst. If more bytes are available, they're silently
 // truncated. If fewer bytes are available than len(*dst), *dst
@@ -292,6 +452,10 @@ type truncBytesSink struct {
 	v   ByteView
 }
 
+func (s *truncBytesSink) setVersion(version string) {
+	s.v.version = version
+}
+
 func (s *truncBytesSink) view() (ByteView, error) {
 	return s.v, nil
 }